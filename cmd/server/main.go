@@ -4,10 +4,10 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/websocket/v2"
 	"audio-converter/internal/config"
 	"audio-converter/internal/handlers"
 	"audio-converter/internal/middleware"
@@ -16,27 +16,24 @@ import (
 func main() {
 	// Load configuration
 	cfg := config.New()
+	bodyLimit, err := strconv.Atoi(cfg.MaxUploadSize)
+	if err != nil || bodyLimit <= 0 {
+		log.Fatalf("Invalid MAX_UPLOAD_SIZE %q", cfg.MaxUploadSize)
+	}
 
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		EnablePrintRoutes: true,
+		BodyLimit:         bodyLimit,
 	})
 
 	// Middleware
 	app.Use(middleware.Logger())
 
-	// WebSocket route
-	app.Use("/ws", func(c *fiber.Ctx) error {
-		if websocket.IsWebSocketUpgrade(c) {
-			c.Locals("allowed", true)
-			return c.Next()
-		}
-		return fiber.ErrUpgradeRequired
-	})
-
 	// Routes
-	app.Get("/health", handlers.HealthCheck)
-	app.Get("/ws/convert", websocket.New(handlers.HandleAudioConversion))
+	if err := handlers.RegisterRoutes(app, cfg); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Start server in a goroutine
 	go func() {
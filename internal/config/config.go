@@ -5,14 +5,63 @@ import (
 )
 
 type Config struct {
-	ServerPort string
-	LogLevel   string
+	ServerPort     string
+	LogLevel       string
+	EncoderBackend string
+	// OutputContainer is "flac" or "ogg"
+	OutputContainer string
+	// MaxUploadSize bounds HTTP request bodies, in bytes
+	MaxUploadSize string
+
+	// Encoder defaults; empty values use the compression level's preset
+	CompressionLevel   string
+	BlockSize          string
+	MaxLPCOrder        string
+	RicePartitionOrder string
+	MidSide            string
+
+	// Quantization of floating-point input
+	FloatBitsPerSample string
+	Dither             string
+	Clipping           string
+	GainDB             string
+
+	// PCM sample rate for DSD input
+	DSDSampleRate string
+
+	// Store non-audio WAV chunks for a byte-exact restore
+	KeepForeignMetadata string
+
+	// Decode every encoded frame and compare it with the input
+	Verify        string
+	VerifyDumpDir string
 }
 
 func New() *Config {
 	return &Config{
-		ServerPort: getEnv("SERVER_PORT", ":8080"),
-		LogLevel:   getEnv("LOG_LEVEL", "info"),
+		ServerPort:      getEnv("SERVER_PORT", ":8080"),
+		LogLevel:        getEnv("LOG_LEVEL", "info"),
+		EncoderBackend:  getEnv("ENCODER_BACKEND", "native"),
+		OutputContainer: getEnv("OUTPUT_CONTAINER", "flac"),
+		MaxUploadSize:   getEnv("MAX_UPLOAD_SIZE", "268435456"),
+
+		CompressionLevel:   getEnv("COMPRESSION_LEVEL", "5"),
+		BlockSize:          getEnv("BLOCK_SIZE", ""),
+		MaxLPCOrder:        getEnv("MAX_LPC_ORDER", ""),
+		RicePartitionOrder: getEnv("RICE_PARTITION_ORDER", ""),
+		MidSide:            getEnv("MID_SIDE", ""),
+
+		FloatBitsPerSample: getEnv("FLOAT_BITS_PER_SAMPLE", "24"),
+		Dither:             getEnv("DITHER", "tpdf"),
+		Clipping:           getEnv("CLIPPING", "clip"),
+		GainDB:             getEnv("GAIN_DB", "0"),
+
+		DSDSampleRate: getEnv("DSD_SAMPLE_RATE", "88200"),
+
+		KeepForeignMetadata: getEnv("KEEP_FOREIGN_METADATA", "false"),
+
+		Verify:        getEnv("VERIFY", "false"),
+		VerifyDumpDir: getEnv("VERIFY_DUMP_DIR", ""),
 	}
 }
 
@@ -21,4 +70,4 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
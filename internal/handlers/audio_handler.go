@@ -1,10 +1,13 @@
 package handlers
 
 import (
-	"bytes"
+	"errors"
 	"io"
 	"log"
+	"strconv"
 
+	"audio-converter/internal/config"
+	"audio-converter/internal/models"
 	"audio-converter/internal/services"
 
 	"github.com/gofiber/fiber/v2"
@@ -17,49 +20,176 @@ func HealthCheck(c *fiber.Ctx) error {
 	})
 }
 
-func HandleAudioConversion(c *websocket.Conn) {
+// AudioHandler serves conversion sessions with converter options taken from
+// the service configuration.
+type AudioHandler struct {
+	options services.Options
+}
+
+func NewAudioHandler(cfg *config.Config) (*AudioHandler, error) {
+	opts, err := services.OptionsFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &AudioHandler{options: opts}, nil
+}
+
+// HandleAudioConversion converts a WAV stream into a single continuous FLAC
+// stream.
+func (h *AudioHandler) HandleAudioConversion(c *websocket.Conn) {
+	serve(c, newSession(c, h.options, false))
+}
+
+// HandleAudioDecoding converts a FLAC stream back into a WAV stream.
+func (h *AudioHandler) HandleAudioDecoding(c *websocket.Conn) {
+	serve(c, newSession(c, h.options, true))
+}
+
+// HandleConvert converts the audio file in the request body to FLAC with the
+// configured settings. Headerless PCM is declared with the raw start options
+// as query parameters, e.g. ?rawSampleRate=48000&rawChannels=2&rawBitsPerSample=16.
+func (h *AudioHandler) HandleConvert(c *fiber.Ctx) error {
+	raw, err := rawOptionsFromQuery(c)
+	if err != nil {
+		return sendError(c, err)
+	}
+	opts := h.options
+	opts.Raw = raw
+	converter, err := services.NewConverterWithOptions(opts)
+	if err != nil {
+		return sendError(c, err)
+	}
+	flacData, err := converter.ConvertChunk(c.Body())
+	if err != nil {
+		return sendError(c, err)
+	}
+	contentType := "audio/flac"
+	if opts.Container == services.ContainerOgg {
+		contentType = "audio/ogg"
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Send(flacData)
+}
+
+// rawOptionsFromQuery reads the raw PCM format from the query parameters
+// named like the start options.
+func rawOptionsFromQuery(c *fiber.Ctx) (services.RawOptions, error) {
+	var opts services.RawOptions
+	ints := []struct {
+		name string
+		dest **int
+	}{
+		{"rawSampleRate", &opts.SampleRate},
+		{"rawChannels", &opts.Channels},
+		{"rawBitsPerSample", &opts.BitsPerSample},
+	}
+	for _, param := range ints {
+		value := c.Query(param.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return opts, invalidQuery(param.name, value)
+		}
+		*param.dest = &n
+	}
+	if value := c.Query("rawByteOrder"); value != "" {
+		opts.ByteOrder = &value
+	}
+	if value := c.Query("rawSigned"); value != "" {
+		signed, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, invalidQuery("rawSigned", value)
+		}
+		opts.Signed = &signed
+	}
+	return opts, nil
+}
+
+// invalidQuery reports a query parameter that could not be parsed.
+func invalidQuery(name, value string) error {
+	return &models.ConversionError{
+		Code:    models.ErrInvalidFormat,
+		Message: "Invalid " + name + " " + strconv.Quote(value),
+	}
+}
+
+// HandleDecode converts a FLAC file in the request body to WAV.
+func (h *AudioHandler) HandleDecode(c *fiber.Ctx) error {
+	wavData, err := services.DecodeFLAC(c.Body())
+	if err != nil {
+		return sendError(c, err)
+	}
+	c.Set(fiber.HeaderContentType, "audio/wav")
+	return c.Send(wavData)
+}
+
+// sendError reports a failed HTTP conversion as a JSON error with the same
+// code a WebSocket session would use.
+func sendError(c *fiber.Ctx, err error) error {
+	log.Printf("conversion error: %v", err)
+
+	code, message := models.ErrConversionFailed, err.Error()
+	var convErr *models.ConversionError
+	if errors.As(err, &convErr) {
+		code, message = convErr.Code, convErr.Message
+	}
+	return c.Status(httpStatusFor(code)).JSON(fiber.Map{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// httpStatusFor maps a conversion error code to an HTTP status.
+func httpStatusFor(code string) int {
+	switch code {
+	case models.ErrInvalidFormat:
+		return fiber.StatusUnsupportedMediaType
+	case models.ErrInvalidChunkSize, models.ErrStreamCorrupted:
+		return fiber.StatusUnprocessableEntity
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
+
+// serve runs a session until the client or a fatal error ends it.
+func serve(c *websocket.Conn, sess *session) {
 	var (
 		mt  int
 		msg []byte
 		err error
 	)
-
-	// Create buffers for audio processing
-	wavBuffer := bytes.NewBuffer(nil)
-	converter := services.NewConverter()
+	c.SetCloseHandler(sess.handleClose)
 
 	for {
 		if mt, msg, err = c.ReadMessage(); err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
 				log.Printf("read error: %v", err)
 			}
-			break
+			return
 		}
 
 		// Handle different message types
 		switch mt {
 		case websocket.BinaryMessage:
-			// Append WAV data to buffer
-			wavBuffer.Write(msg)
-
-			// Process complete WAV chunks
-			if wavBuffer.Len() >= 4096 { // Process in 4KB chunks
-				// Convert WAV chunk to FLAC
-				flacData, err := converter.ConvertChunk(wavBuffer.Next(4096))
-				if err != nil {
-					log.Printf("conversion error: %v", err)
-					continue
-				}
-
-				// Send converted FLAC data back to client
-				if err := c.WriteMessage(websocket.BinaryMessage, flacData); err != nil {
-					log.Printf("write error: %v", err)
-					break
-				}
+			if err := sess.handleBinary(msg); err != nil && sess.fail(err) {
+				return
+			}
+
+		case websocket.TextMessage:
+			// Control messages; finish and cancel end the session
+			done, err := sess.handleText(msg)
+			if err != nil && sess.fail(err) {
+				return
+			}
+			if done {
+				sess.close(websocket.CloseNormalClosure, "")
+				return
 			}
 
 		case websocket.CloseMessage:
 			return
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// ProtocolVersion is the version of the JSON control protocol spoken over
+// WebSocket text messages. Clients may omit the version field, in which case
+// the current version is assumed.
+const ProtocolVersion = 1
+
+// Client message types.
+const (
+	msgStart  = "start"
+	msgFinish = "finish"
+	msgCancel = "cancel"
+	msgPing   = "ping"
+)
+
+// Server event types.
+const (
+	evtReady    = "ready"
+	evtFormat   = "format"
+	evtProgress = "progress"
+	evtError    = "error"
+	evtHeader   = "header"
+	evtStats    = "stats"
+	evtDone     = "done"
+)
+
+// envelope carries the fields shared by every control message.
+type envelope struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+}
+
+func newEnvelope(typ string) envelope {
+	return envelope{Version: ProtocolVersion, Type: typ}
+}
+
+// sessionOptions configure a conversion. They are sent by the client in the
+// start message and echoed back in the ready event. Encoder and quantization
+// settings left out of the start message keep the server's configured
+// defaults.
+type sessionOptions struct {
+	// ProgressInterval is the amount of audio, in seconds, encoded between
+	// progress events. Zero disables progress events.
+	ProgressInterval float64 `json:"progressInterval"`
+	// KeepForeignMetadata stores the non-audio bytes of the WAV stream in
+	// the FLAC stream for a byte-exact restore.
+	KeepForeignMetadata *bool `json:"keepForeignMetadata,omitempty"`
+	// Verify decodes every FLAC frame again and compares it with the input
+	// before it is sent.
+	Verify *bool `json:"verify,omitempty"`
+	// Container packages the stream as native FLAC ("flac") or Ogg FLAC
+	// ("ogg").
+	Container services.Container `json:"container,omitempty"`
+	services.EncoderOptions
+	services.FloatOptions
+	services.DSDOptions
+	services.RawOptions
+}
+
+func defaultSessionOptions() sessionOptions {
+	return sessionOptions{
+		ProgressInterval: 1,
+	}
+}
+
+// clientMessage is any message sent by the client. Options is only used by
+// start.
+type clientMessage struct {
+	envelope
+	Options *sessionOptions `json:"options,omitempty"`
+}
+
+type readyEvent struct {
+	envelope
+	Options sessionOptions `json:"options"`
+}
+
+type formatEvent struct {
+	envelope
+	Format models.AudioFormat `json:"format"`
+}
+
+type progressEvent struct {
+	envelope
+	BytesReceived  int64   `json:"bytesReceived"`
+	BytesSent      int64   `json:"bytesSent"`
+	SamplesEncoded uint64  `json:"samplesEncoded"`
+	Seconds        float64 `json:"seconds"`
+}
+
+// errorEvent reports a failure. Fatal errors are followed by a close frame
+// whose code is chosen by closeCodeFor.
+type errorEvent struct {
+	envelope
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Fatal   bool   `json:"fatal"`
+}
+
+// headerEvent carries the final start of the stream. Clients that store the
+// stream write Data over the bytes at Offset; Data is base64 in JSON.
+type headerEvent struct {
+	envelope
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+type statsEvent struct {
+	envelope
+	Stats models.ConversionStats `json:"stats"`
+}
+
+type doneEvent struct {
+	envelope
+	Cancelled bool `json:"cancelled,omitempty"`
+}
+
+// recoverableError is reported to the client without ending the session.
+type recoverableError struct {
+	*models.ConversionError
+}
+
+func newRecoverableError(code, message string) error {
+	return recoverableError{&models.ConversionError{Code: code, Message: message}}
+}
+
+// closeCodeFor maps a conversion error code to the WebSocket close code sent
+// after a fatal error.
+func closeCodeFor(code string) int {
+	switch code {
+	case models.ErrInvalidFormat:
+		return websocket.CloseUnsupportedData
+	case models.ErrInvalidChunkSize, models.ErrStreamCorrupted:
+		return websocket.CloseInvalidFramePayloadData
+	default:
+		return websocket.CloseInternalServerErr
+	}
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"audio-converter/internal/config"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+// RegisterRoutes mounts the health check, WebSocket and HTTP conversion
+// endpoints on app.
+func RegisterRoutes(app *fiber.App, cfg *config.Config) error {
+	audioHandler, err := NewAudioHandler(cfg)
+	if err != nil {
+		return err
+	}
+
+	// WebSocket route
+	app.Use("/ws", func(c *fiber.Ctx) error {
+		if websocket.IsWebSocketUpgrade(c) {
+			c.Locals("allowed", true)
+			return c.Next()
+		}
+		return fiber.ErrUpgradeRequired
+	})
+
+	// Routes
+	app.Get("/health", HealthCheck)
+	app.Get("/ws/convert", websocket.New(audioHandler.HandleAudioConversion))
+	app.Get("/ws/decode", websocket.New(audioHandler.HandleAudioDecoding))
+	app.Post("/convert", audioHandler.HandleConvert)
+	app.Post("/decode", audioHandler.HandleDecode)
+
+	return nil
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// closeTimeout bounds how long we wait to deliver a close frame.
+const closeTimeout = time.Second
+
+// conversion is the stream a session drives: WAV to FLAC, or FLAC back to
+// WAV.
+type conversion interface {
+	Write(p []byte) ([]byte, error)
+	Close() ([]byte, error)
+	Format() *models.AudioFormat
+	OutputFormat() *models.AudioFormat
+	Samples() uint64
+	Stats() models.ConversionStats
+}
+
+// headerPatcher is implemented by conversions whose header can only be
+// completed once the stream has ended.
+type headerPatcher interface {
+	HeaderPatch() (int64, []byte)
+}
+
+// session tracks the conversion state of a single WebSocket connection.
+type session struct {
+	conn      *websocket.Conn
+	converter services.Options
+	// decode is set for sessions converting FLAC to WAV.
+	decode    bool
+	options   sessionOptions
+	stream    conversion
+	startedAt time.Time
+
+	bytesReceived int64
+	bytesSent     int64
+	formatSent    bool
+	nextProgress  uint64
+	finished      bool
+}
+
+func newSession(conn *websocket.Conn, converter services.Options, decode bool) *session {
+	return &session{
+		conn:      conn,
+		converter: converter,
+		decode:    decode,
+	}
+}
+
+// begin starts the conversion. Clients that send audio without a start
+// message get the default options. Decoding has no settings besides the
+// progress interval.
+func (s *session) begin(opts sessionOptions) error {
+	if s.decode {
+		s.options = sessionOptions{ProgressInterval: opts.ProgressInterval}
+		s.stream = services.NewStreamDecoder()
+		s.startedAt = time.Now()
+		return nil
+	}
+
+	converterOpts := s.converter
+	encoder, err := converterOpts.Encoder.Merge(opts.EncoderOptions).Resolve()
+	if err != nil {
+		return err
+	}
+	float, err := converterOpts.Float.Merge(opts.FloatOptions).Resolve()
+	if err != nil {
+		return err
+	}
+	dsd, err := converterOpts.DSD.Merge(opts.DSDOptions).Resolve()
+	if err != nil {
+		return err
+	}
+	raw, err := converterOpts.Raw.Merge(opts.RawOptions).Resolve()
+	if err != nil {
+		return err
+	}
+	converterOpts.Encoder = encoder
+	converterOpts.Float = float
+	converterOpts.DSD = dsd
+	converterOpts.Raw = raw
+	if opts.KeepForeignMetadata != nil {
+		converterOpts.KeepForeignMetadata = *opts.KeepForeignMetadata
+	}
+	if opts.Verify != nil {
+		converterOpts.Verify = *opts.Verify
+	}
+	if opts.Container != "" {
+		converterOpts.Container = opts.Container
+	}
+	converter, err := services.NewConverterWithOptions(converterOpts)
+	if err != nil {
+		return err
+	}
+
+	opts.EncoderOptions = encoder
+	opts.FloatOptions = float
+	opts.DSDOptions = dsd
+	opts.RawOptions = raw
+	opts.KeepForeignMetadata = &converterOpts.KeepForeignMetadata
+	opts.Verify = &converterOpts.Verify
+	opts.Container = converterOpts.Container
+	s.options = opts
+	s.stream = converter.NewStream()
+	s.startedAt = time.Now()
+	return nil
+}
+
+// handleBinary feeds WAV data to the session encoder and sends back any
+// completed FLAC frames.
+func (s *session) handleBinary(msg []byte) error {
+	if s.finished {
+		return &models.ConversionError{
+			Code:    models.ErrStreamCorrupted,
+			Message: "Audio received after the stream was finished",
+		}
+	}
+	if len(msg) == 0 {
+		return newRecoverableError(models.ErrInvalidChunkSize, "Empty audio message")
+	}
+	if s.stream == nil {
+		if err := s.begin(defaultSessionOptions()); err != nil {
+			return err
+		}
+	}
+
+	s.bytesReceived += int64(len(msg))
+	flacData, err := s.stream.Write(msg)
+	if err != nil {
+		return err
+	}
+	if err := s.sendBinary(flacData); err != nil {
+		return err
+	}
+
+	format := s.stream.Format()
+	if format == nil {
+		return nil
+	}
+	if !s.formatSent {
+		s.formatSent = true
+		if err := s.sendJSON(formatEvent{envelope: newEnvelope(evtFormat), Format: *format}); err != nil {
+			return err
+		}
+	}
+	if s.options.ProgressInterval > 0 && s.stream.Samples() >= s.nextProgress {
+		// Samples are counted at the output rate, which differs for DSD
+		rate := s.stream.OutputFormat().SampleRate
+		s.nextProgress = s.stream.Samples() + uint64(s.options.ProgressInterval*float64(rate))
+		return s.sendProgress()
+	}
+	return nil
+}
+
+// handleText processes a control message from the client. It reports whether
+// the session is over and the connection should be closed.
+func (s *session) handleText(msg []byte) (bool, error) {
+	// Decode start options over the defaults so clients only need to send
+	// the fields they want to change.
+	opts := defaultSessionOptions()
+	m := clientMessage{Options: &opts}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return false, newRecoverableError(models.ErrInvalidFormat, "Invalid control message")
+	}
+	if m.Version > ProtocolVersion {
+		return false, newRecoverableError(models.ErrInvalidFormat, "Unsupported protocol version")
+	}
+
+	switch m.Type {
+	case msgStart:
+		if s.stream != nil {
+			return false, newRecoverableError(models.ErrInvalidFormat, "Session already started")
+		}
+		if err := s.begin(opts); err != nil {
+			var convErr *models.ConversionError
+			if errors.As(err, &convErr) {
+				return false, recoverableError{convErr}
+			}
+			return false, err
+		}
+		return false, s.sendJSON(readyEvent{envelope: newEnvelope(evtReady), Options: s.options})
+
+	case msgFinish:
+		return true, s.finish()
+
+	case msgCancel:
+		s.finished = true
+		return true, s.sendJSON(doneEvent{envelope: newEnvelope(evtDone), Cancelled: true})
+
+	case msgPing:
+		return false, s.sendProgress()
+
+	default:
+		return false, newRecoverableError(models.ErrInvalidFormat, "Unknown control message type")
+	}
+}
+
+// finish flushes the audio still buffered in the encoder as the final FLAC
+// frame, sends the finalized header, reports the session statistics and
+// tells the client the stream is complete.
+func (s *session) finish() error {
+	if s.finished {
+		return nil
+	}
+	s.finished = true
+	if s.stream == nil {
+		if err := s.begin(defaultSessionOptions()); err != nil {
+			return err
+		}
+	}
+
+	flacData, err := s.stream.Close()
+	if err != nil {
+		return err
+	}
+	if err := s.sendBinary(flacData); err != nil {
+		return err
+	}
+	if patcher, ok := s.stream.(headerPatcher); ok {
+		offset, data := patcher.HeaderPatch()
+		if err := s.sendJSON(headerEvent{envelope: newEnvelope(evtHeader), Offset: offset, Data: data}); err != nil {
+			return err
+		}
+	}
+
+	stats := s.stream.Stats()
+	stats.TotalBytesProcessed = s.bytesReceived
+	stats.TotalBytesWritten = s.bytesSent
+	stats.ConversionTime = time.Since(s.startedAt).Milliseconds()
+	if err := s.sendJSON(statsEvent{envelope: newEnvelope(evtStats), Stats: stats}); err != nil {
+		return err
+	}
+	return s.sendJSON(doneEvent{envelope: newEnvelope(evtDone)})
+}
+
+// handleClose answers a close frame from the client. A normal closure is
+// treated like "finish", so the trailing audio is delivered before the close
+// handshake completes.
+func (s *session) handleClose(code int, text string) error {
+	if code == websocket.CloseNormalClosure {
+		if err := s.finish(); err != nil {
+			evt := s.reportError(err)
+			code = closeCodeFor(evt.Code)
+		}
+	}
+	return s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(closeTimeout))
+}
+
+// fail reports err to the client. It reports whether the error was fatal, in
+// which case the connection has been closed with a matching close code.
+func (s *session) fail(err error) bool {
+	evt := s.reportError(err)
+	if !evt.Fatal {
+		return false
+	}
+	s.close(closeCodeFor(evt.Code), evt.Message)
+	return true
+}
+
+// reportError logs err and sends it to the client as an error event.
+func (s *session) reportError(err error) errorEvent {
+	log.Printf("conversion error: %v", err)
+
+	evt := errorEvent{
+		envelope: newEnvelope(evtError),
+		Code:     models.ErrConversionFailed,
+		Message:  err.Error(),
+		Fatal:    true,
+	}
+	var recoverable recoverableError
+	var convErr *models.ConversionError
+	switch {
+	case errors.As(err, &recoverable):
+		evt.Code = recoverable.Code
+		evt.Message = recoverable.Message
+		evt.Fatal = false
+	case errors.As(err, &convErr):
+		evt.Code = convErr.Code
+		evt.Message = convErr.Message
+	}
+	if err := s.sendJSON(evt); err != nil {
+		log.Printf("write error: %v", err)
+	}
+	return evt
+}
+
+// close ends the session with the given close code.
+func (s *session) close(code int, text string) {
+	// Control frame payloads are limited to 125 bytes, two of which hold the code
+	if len(text) > 123 {
+		text = text[:123]
+	}
+	msg := websocket.FormatCloseMessage(code, text)
+	if err := s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout)); err != nil {
+		log.Printf("write error: %v", err)
+	}
+}
+
+// sendProgress reports how far the conversion has got.
+func (s *session) sendProgress() error {
+	evt := progressEvent{
+		envelope:      newEnvelope(evtProgress),
+		BytesReceived: s.bytesReceived,
+		BytesSent:     s.bytesSent,
+	}
+	if s.stream != nil {
+		evt.SamplesEncoded = s.stream.Samples()
+		if format := s.stream.OutputFormat(); format != nil {
+			evt.Seconds = float64(evt.SamplesEncoded) / float64(format.SampleRate)
+		}
+	}
+	return s.sendJSON(evt)
+}
+
+func (s *session) sendBinary(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	s.bytesSent += int64(len(data))
+	return s.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (s *session) sendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(websocket.TextMessage, data)
+}
@@ -3,9 +3,13 @@ package models
 import "fmt"
 
 type AudioFormat struct {
-	SampleRate    int
-	NumChannels   int
-	BitsPerSample int
+	SampleRate    int `json:"sampleRate"`
+	NumChannels   int `json:"channels"`
+	BitsPerSample int `json:"bitsPerSample"`
+	// Float is set for IEEE floating-point samples
+	Float bool `json:"float,omitempty"`
+	// DSD is set for 1-bit Direct Stream Digital samples
+	DSD bool `json:"dsd,omitempty"`
 }
 
 type ConversionJob struct {
@@ -18,11 +22,42 @@ type ConversionJob struct {
 	CompletedAt  int64
 }
 
+// ConversionStats summarises a finished conversion. ConversionTime is in
+// milliseconds and TotalSamples counts samples per channel. ClippedSamples
+// counts floating-point samples that exceeded full scale when quantized.
+// CuePoints and Loops list the markers found in the WAV file. SizeSaved is set
+// when FLAC input was re-encoded: the input size less the output size.
 type ConversionStats struct {
-	TotalBytesProcessed int64
-	ConversionTime      int64
-	InputFormat         AudioFormat
-	OutputFormat        AudioFormat
+	TotalBytesProcessed int64        `json:"totalBytesProcessed"`
+	TotalBytesWritten   int64        `json:"totalBytesWritten"`
+	TotalSamples        uint64       `json:"totalSamples"`
+	ConversionTime      int64        `json:"conversionTime"`
+	InputFormat         AudioFormat  `json:"inputFormat"`
+	OutputFormat        AudioFormat  `json:"outputFormat"`
+	Clipped             bool         `json:"clipped"`
+	ClippedSamples      uint64       `json:"clippedSamples"`
+	CuePoints           []CuePoint   `json:"cuePoints,omitempty"`
+	Loops               []SampleLoop `json:"loops,omitempty"`
+	SizeSaved           *int64       `json:"sizeSaved,omitempty"`
+	DiscardedBytes      int64        `json:"discardedBytes,omitempty"`
+}
+
+// CuePoint is a marker in the audio, Offset samples per channel from the
+// start.
+type CuePoint struct {
+	ID     uint32 `json:"id"`
+	Offset uint64 `json:"offset"`
+	Label  string `json:"label,omitempty"`
+}
+
+// SampleLoop is a loop of a sampler instrument. Start and End are the
+// offsets of its first and last samples; a PlayCount of zero loops forever.
+type SampleLoop struct {
+	CuePointID uint32 `json:"cuePointId"`
+	Type       string `json:"type"`
+	Start      uint64 `json:"start"`
+	End        uint64 `json:"end"`
+	PlayCount  uint32 `json:"playCount"`
 }
 
 type ConversionError struct {
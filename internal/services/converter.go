@@ -3,72 +3,298 @@ package services
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
-	"os/exec"
-	"os"
+	"strconv"
 
-	"github.com/go-audio/audio"
-	"github.com/go-audio/wav"
+	"audio-converter/internal/config"
+	"audio-converter/pkg/utils"
 )
 
+// Backend selects the FLAC encoder implementation used by a Converter.
+type Backend string
+
+const (
+	// BackendNative encodes in-process on top of mewkiz/flac.
+	BackendNative Backend = "native"
+	// BackendFFmpeg shells out to the ffmpeg binary for every conversion.
+	BackendFFmpeg Backend = "ffmpeg"
+)
+
+// ParseBackend validates a backend name taken from configuration.
+func ParseBackend(name string) (Backend, error) {
+	switch b := Backend(name); b {
+	case BackendNative, BackendFFmpeg:
+		return b, nil
+	default:
+		return "", fmt.Errorf("unknown encoder backend %q", name)
+	}
+}
+
+// Container selects how the encoded FLAC stream is packaged.
+type Container string
+
+const (
+	// ContainerFLAC writes a native FLAC stream.
+	ContainerFLAC Container = "flac"
+	// ContainerOgg wraps the stream in Ogg pages as described by RFC 5334.
+	ContainerOgg Container = "ogg"
+)
+
+// ParseContainer validates an output container name.
+func ParseContainer(name string) (Container, error) {
+	switch c := Container(name); c {
+	case ContainerFLAC, ContainerOgg:
+		return c, nil
+	default:
+		return "", invalidOption("unknown output container %q", name)
+	}
+}
+
+// Options configures a Converter.
+type Options struct {
+	Backend   Backend
+	Container Container
+	Encoder   EncoderOptions
+	Float     FloatOptions
+	DSD       DSDOptions
+	// Raw declares the format of headerless PCM input.
+	Raw RawOptions
+	// KeepForeignMetadata stores every non-audio byte of the WAV file in
+	// APPLICATION blocks, so that RestoreWAV rebuilds the original file.
+	KeepForeignMetadata bool
+	// Verify decodes every encoded frame and compares it with the input
+	// samples; a mismatch fails the conversion and is saved to VerifyDir,
+	// or the system temporary directory when that is empty.
+	Verify    bool
+	VerifyDir string
+}
+
+// DefaultOptions returns the options used by NewConverter.
+func DefaultOptions() Options {
+	return Options{
+		Backend:   BackendNative,
+		Container: ContainerFLAC,
+	}
+}
+
+// OptionsFromConfig builds converter options from the service configuration.
+func OptionsFromConfig(cfg *config.Config) (Options, error) {
+	opts := DefaultOptions()
+	backend, err := ParseBackend(cfg.EncoderBackend)
+	if err != nil {
+		return opts, err
+	}
+	opts.Backend = backend
+	if cfg.OutputContainer != "" {
+		container, err := ParseContainer(cfg.OutputContainer)
+		if err != nil {
+			return opts, err
+		}
+		opts.Container = container
+	}
+
+	settings := []struct {
+		name  string
+		value string
+		dest  **int
+	}{
+		{"COMPRESSION_LEVEL", cfg.CompressionLevel, &opts.Encoder.CompressionLevel},
+		{"BLOCK_SIZE", cfg.BlockSize, &opts.Encoder.BlockSize},
+		{"MAX_LPC_ORDER", cfg.MaxLPCOrder, &opts.Encoder.MaxLPCOrder},
+		{"RICE_PARTITION_ORDER", cfg.RicePartitionOrder, &opts.Encoder.MaxPartitionOrder},
+	}
+	for _, setting := range settings {
+		if setting.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(setting.value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s %q: %v", setting.name, setting.value, err)
+		}
+		*setting.dest = &n
+	}
+	if cfg.MidSide != "" {
+		midSide, err := strconv.ParseBool(cfg.MidSide)
+		if err != nil {
+			return opts, fmt.Errorf("invalid MID_SIDE %q: %v", cfg.MidSide, err)
+		}
+		opts.Encoder.MidSide = &midSide
+	}
+
+	if cfg.FloatBitsPerSample != "" {
+		bits, err := strconv.Atoi(cfg.FloatBitsPerSample)
+		if err != nil {
+			return opts, fmt.Errorf("invalid FLOAT_BITS_PER_SAMPLE %q: %v", cfg.FloatBitsPerSample, err)
+		}
+		opts.Float.BitsPerSample = &bits
+	}
+	if dither := cfg.Dither; dither != "" {
+		opts.Float.Dither = &dither
+	}
+	if clipping := cfg.Clipping; clipping != "" {
+		opts.Float.Clipping = &clipping
+	}
+	if cfg.GainDB != "" {
+		gain, err := strconv.ParseFloat(cfg.GainDB, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid GAIN_DB %q: %v", cfg.GainDB, err)
+		}
+		opts.Float.GainDB = &gain
+	}
+	if cfg.DSDSampleRate != "" {
+		rate, err := strconv.Atoi(cfg.DSDSampleRate)
+		if err != nil {
+			return opts, fmt.Errorf("invalid DSD_SAMPLE_RATE %q: %v", cfg.DSDSampleRate, err)
+		}
+		opts.DSD.SampleRate = &rate
+	}
+	if cfg.KeepForeignMetadata != "" {
+		keep, err := strconv.ParseBool(cfg.KeepForeignMetadata)
+		if err != nil {
+			return opts, fmt.Errorf("invalid KEEP_FOREIGN_METADATA %q: %v", cfg.KeepForeignMetadata, err)
+		}
+		opts.KeepForeignMetadata = keep
+	}
+	if cfg.Verify != "" {
+		verify, err := strconv.ParseBool(cfg.Verify)
+		if err != nil {
+			return opts, fmt.Errorf("invalid VERIFY %q: %v", cfg.Verify, err)
+		}
+		opts.Verify = verify
+	}
+	opts.VerifyDir = cfg.VerifyDumpDir
+
+	if _, err := opts.Encoder.params(); err != nil {
+		return opts, err
+	}
+	if _, err := opts.Float.params(); err != nil {
+		return opts, err
+	}
+	if _, err := opts.DSD.params(); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
 // Converter holds conversion settings for sample rate, channels, etc.
 type Converter struct {
-	sampleRate    int
-	numChannels   int
-	bitsPerSample int
+	backend     Backend
+	container   Container
+	params      encoderParams
+	float       floatParams
+	dsd         dsdParams
+	raw         *rawParams
+	keepForeign bool
+	verifier    *frameVerifier
 }
 
-// NewConverter initializes a new Converter instance with default values.
+// NewConverter initializes a new Converter instance with default values. The
+// audio format is always taken from the input.
 func NewConverter() *Converter {
 	return &Converter{
-		sampleRate:    44100,
-		numChannels:   2,
-		bitsPerSample: 16,
+		backend:   BackendNative,
+		container: ContainerFLAC,
+		params:    defaultEncoderParams(),
+		float:     defaultFloatParams(),
+		dsd:       defaultDSDParams(),
 	}
 }
 
-// ConvertChunk converts WAV data to FLAC using external ffmpeg tool for encoding.
-func (c *Converter) ConvertChunk(wavData []byte) ([]byte, error) {
-	// Create a WAV decoder to read the audio data.
-	wavReader := bytes.NewReader(wavData)
-	decoder := wav.NewDecoder(wavReader)
-
-	if !decoder.IsValidFile() {
-		return nil, fmt.Errorf("invalid WAV data")
-	}
-
-	// Decode the WAV data into an audio buffer
-	buf := &audio.IntBuffer{
-		Format: &audio.Format{
-			NumChannels: c.numChannels,
-			SampleRate:  c.sampleRate,
-		},
+// NewConverterWithOptions initializes a Converter using the given options. It
+// fails when the encoder, floating-point, DSD or raw options are out of range
+// or the container cannot be produced with them.
+func NewConverterWithOptions(opts Options) (*Converter, error) {
+	params, err := opts.Encoder.params()
+	if err != nil {
+		return nil, err
 	}
-	if _, err := decoder.PCMBuffer(buf); err != nil {
+	float, err := opts.Float.params()
+	if err != nil {
 		return nil, err
 	}
-
-	// Write WAV data to a temporary file for ffmpeg to read
-	tmpWavFile, err := ioutil.TempFile("", "input*.wav")
+	dsd, err := opts.DSD.params()
 	if err != nil {
 		return nil, err
 	}
-	defer tmpWavFile.Close()
-	defer os.Remove(tmpWavFile.Name())
-
-	if _, err := tmpWavFile.Write(wavData); err != nil {
+	raw, err := opts.Raw.params()
+	if err != nil {
 		return nil, err
 	}
+	c := NewConverter()
+	c.backend = opts.Backend
+	c.params = params
+	c.float = float
+	c.dsd = dsd
+	c.raw = raw
+	c.keepForeign = opts.KeepForeignMetadata
+	if opts.Verify {
+		c.verifier = &frameVerifier{dir: opts.VerifyDir}
+	}
+	if opts.Container != "" {
+		if c.container, err = ParseContainer(string(opts.Container)); err != nil {
+			return nil, err
+		}
+	}
+	if c.container == ContainerOgg && c.keepForeign {
+		return nil, invalidOption("foreign metadata can only be kept in native FLAC output")
+	}
+	return c, nil
+}
 
-	// Set up the ffmpeg command to read the WAV file and output FLAC data
-	cmd := exec.Command("ffmpeg", "-i", tmpWavFile.Name(), "-f", "flac", "pipe:1")
-	var flacBuffer bytes.Buffer
-	cmd.Stdout = &flacBuffer
-
-	// Run the ffmpeg command to convert the WAV to FLAC
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("error converting WAV to FLAC: %v", err)
+// ConvertChunk converts WAV, AIFF, DSD or declared raw PCM data to FLAC, or
+// re-encodes FLAC data, using the configured backend. The FLAC stream has the
+// sample rate, channel count and bit depth of the input, the configured depth
+// for floating-point input or 24 bits at the configured rate for DSD input,
+// and is packaged in the configured container.
+func (c *Converter) ConvertChunk(wavData []byte) ([]byte, error) {
+	if c.backend == BackendFFmpeg {
+		if c.keepForeign {
+			return nil, invalidOption("foreign metadata can only be kept by the native backend")
+		}
+		if c.container == ContainerOgg {
+			return nil, invalidOption("Ogg output is only produced by the native backend")
+		}
+		if c.verifier != nil {
+			return nil, invalidOption("frames are only verified by the native backend")
+		}
+		if c.raw != nil {
+			return nil, invalidOption("raw PCM input is only converted by the native backend")
+		}
+		if bytes.HasPrefix(wavData, []byte(flacSignature)) {
+			return nil, invalidOption("FLAC input is only re-encoded by the native backend")
+		}
+		header, err := utils.ParseHeader(wavData)
+		if err != nil {
+			return nil, err
+		}
+		if header.Format.DSD {
+			return nil, unsupportedFormat("DSD input is only converted by the native backend")
+		}
+		if _, err := flacFormat(header, c.float, c.dsd); err != nil {
+			return nil, err
+		}
+		return convertWithFFmpeg(wavData, c.params.level)
 	}
 
-	return flacBuffer.Bytes(), nil
+	// Encode the whole file as one stream, then fill in STREAMINFO now that
+	// the totals are known. Unlike a stream, the file's metadata after the
+	// data chunk is available before encoding starts. Close runs the checks
+	// of re-encoded FLAC and kept foreign metadata.
+	stream := c.NewStream()
+	if header, err := utils.ParseHeader(wavData); err == nil && c.raw == nil && header.DataSize != utils.UnknownDataSize {
+		if end := int64(header.DataOffset) + header.DataSize; end < int64(len(wavData)) {
+			stream.tail = wavData[end:]
+		}
+	}
+	flacData, err := stream.Write(wavData)
+	if err != nil {
+		return nil, err
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		return nil, err
+	}
+	flacData = append(flacData, tail...)
+	offset, header := stream.HeaderPatch()
+	copy(flacData[offset:], header)
+	return flacData, nil
 }
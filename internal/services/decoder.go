@@ -0,0 +1,416 @@
+package services
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/mewkiz/flac/meta"
+
+	"audio-converter/internal/models"
+	"audio-converter/pkg/utils"
+)
+
+// StreamDecoder converts a FLAC stream back into a WAV file. Joining every
+// slice returned by Write and Close, in order, yields the WAV file. Streams
+// encoded with KeepForeignMetadata get their original header and chunks back;
+// others get a WAV header for the stream's bit depth and channel mask.
+type StreamDecoder struct {
+	input []byte
+	info  meta.StreamInfo
+	// header describes the WAV output, or is nil until the FLAC metadata has
+	// been read.
+	header *utils.WAVHeader
+	// restored is set when the WAV header comes from stored RIFF chunks, in
+	// which case suffix holds the chunks after the audio.
+	restored  bool
+	prefixLen int
+	suffix    []byte
+	frames    frameReader
+	md5       hash.Hash
+	samples   uint64
+	dataBytes int64
+	closed    bool
+}
+
+// NewStreamDecoder starts decoding a FLAC stream.
+func NewStreamDecoder() *StreamDecoder {
+	return &StreamDecoder{md5: md5.New()}
+}
+
+// Format returns the format of the FLAC stream, or nil while its metadata has
+// not been received yet.
+func (d *StreamDecoder) Format() *models.AudioFormat {
+	if d.header == nil {
+		return nil
+	}
+	return &models.AudioFormat{
+		SampleRate:    int(d.info.SampleRate),
+		NumChannels:   int(d.info.NChannels),
+		BitsPerSample: int(d.info.BitsPerSample),
+	}
+}
+
+// OutputFormat returns the format of the WAV output, or nil while the FLAC
+// metadata has not been received yet.
+func (d *StreamDecoder) OutputFormat() *models.AudioFormat {
+	if d.header == nil {
+		return nil
+	}
+	return &d.header.Format
+}
+
+// Samples returns the number of samples per channel decoded so far.
+func (d *StreamDecoder) Samples() uint64 {
+	return d.samples
+}
+
+// Stats returns the totals of the conversion so far.
+func (d *StreamDecoder) Stats() models.ConversionStats {
+	stats := models.ConversionStats{TotalSamples: d.samples}
+	if d.header != nil {
+		stats.InputFormat = *d.Format()
+		stats.OutputFormat = *d.OutputFormat()
+	}
+	return stats
+}
+
+// Write consumes the next piece of the FLAC stream and returns the WAV bytes
+// that became available. The first non-empty result starts with the WAV
+// header.
+func (d *StreamDecoder) Write(p []byte) ([]byte, error) {
+	if d.closed {
+		return nil, &models.ConversionError{
+			Code:    models.ErrStreamCorrupted,
+			Message: "Stream already closed",
+		}
+	}
+	d.input = append(d.input, p...)
+
+	var out []byte
+	if d.header == nil {
+		metadata, n, err := parseFLACMetadata(d.input)
+		if err != nil || metadata == nil {
+			return nil, err
+		}
+		d.input = d.input[n:]
+		if out, err = d.start(metadata); err != nil {
+			return nil, err
+		}
+	}
+	pcm, err := d.decodeFrames(false)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, pcm...), nil
+}
+
+// decodeFrames decodes the complete frames at the start of the input and
+// returns their WAV samples. final is set once the stream has ended.
+func (d *StreamDecoder) decodeFrames(final bool) ([]byte, error) {
+	var out []byte
+	for len(d.input) > 0 {
+		block, n, err := d.frames.next(d.input, final)
+		if err == errIncompleteFrame {
+			break
+		}
+		if err != nil {
+			return nil, streamCorrupted("Invalid FLAC frame: %v", err)
+		}
+		if len(block) != int(d.info.NChannels) {
+			return nil, streamCorrupted("FLAC frame has %d channels, STREAMINFO declares %d", len(block), d.info.NChannels)
+		}
+		d.input = d.input[n:]
+		pcm, err := d.encodeBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pcm...)
+	}
+	return out, nil
+}
+
+// Close checks the decoded audio against the STREAMINFO totals and MD5
+// signature and returns the rest of the WAV file. A mismatch is reported as
+// ErrStreamCorrupted.
+func (d *StreamDecoder) Close() ([]byte, error) {
+	if d.closed {
+		return nil, nil
+	}
+	d.closed = true
+	if d.header == nil {
+		return nil, streamCorrupted("Stream ended before the FLAC metadata was received")
+	}
+	// The last frame has no sync code after it
+	out, err := d.decodeFrames(true)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.input) > 0 {
+		return nil, streamCorrupted("Stream ends inside a FLAC frame")
+	}
+	if d.info.NSamples != 0 && d.samples != d.info.NSamples {
+		return nil, streamCorrupted("Decoded %d samples, STREAMINFO declares %d", d.samples, d.info.NSamples)
+	}
+	if d.info.MD5sum != [md5.Size]byte{} && !bytes.Equal(d.md5.Sum(nil), d.info.MD5sum[:]) {
+		return nil, streamCorrupted("MD5 signature mismatch: the decoded audio differs from the original")
+	}
+	if d.restored {
+		return append(out, d.suffix...), nil
+	}
+	// Chunks are padded to an even length
+	if d.dataBytes%2 == 1 {
+		out = append(out, 0)
+	}
+	return out, nil
+}
+
+// start chooses the WAV header once the FLAC metadata is known and returns
+// its bytes.
+func (d *StreamDecoder) start(metadata *flacMetadata) ([]byte, error) {
+	d.info = metadata.info
+	d.frames.bps = uint(d.info.BitsPerSample)
+	if len(metadata.riff) > 0 {
+		return d.restoreHeader(metadata.riff)
+	}
+
+	bps := int(d.info.BitsPerSample)
+	channels := int(d.info.NChannels)
+	mask := metadata.channelMask
+	if mask == 0 {
+		mask = utils.DefaultChannelMask(channels)
+	}
+	header := &utils.WAVHeader{
+		Form: "RIFF",
+		Format: models.AudioFormat{
+			SampleRate:    int(d.info.SampleRate),
+			NumChannels:   channels,
+			BitsPerSample: bps,
+		},
+		FormatTag:     utils.WAVFormatPCM,
+		Extensible:    channels > 2 || bps > 16 || bps%8 != 0 || metadata.channelMask != 0,
+		ContainerBits: (bps + 7) / 8 * 8,
+		ChannelMask:   mask,
+		DataSize:      utils.UnknownDataSize,
+	}
+	header.BlockAlign = channels * header.ContainerBits / 8
+	if d.info.NSamples > 0 {
+		header.DataSize = int64(d.info.NSamples) * int64(header.BlockAlign)
+	}
+	prefix := header.Encode()
+	header.DataOffset = len(prefix)
+	d.header = header
+	d.prefixLen = len(prefix)
+	return prefix, nil
+}
+
+// restoreHeader rebuilds the WAV file up to its first sample from the chunks
+// stored in APPLICATION blocks: the samples go after the block holding the
+// data chunk header.
+func (d *StreamDecoder) restoreHeader(riff [][]byte) ([]byte, error) {
+	prefix, suffix, err := splitRIFF(riff)
+	if err != nil {
+		return nil, err
+	}
+	header, err := utils.ParseWAVHeader(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if header.Format.Float || header.Format.NumChannels != int(d.info.NChannels) || header.Format.BitsPerSample != int(d.info.BitsPerSample) {
+		return nil, unsupportedFormat("Stored RIFF chunks do not match the FLAC stream")
+	}
+	d.header = header
+	d.restored = true
+	d.prefixLen = len(prefix)
+	d.suffix = suffix
+	return prefix, nil
+}
+
+// splitRIFF joins the chunks stored in APPLICATION blocks into the bytes of
+// the WAV file before its samples, which end with the data chunk header, and
+// after them.
+func splitRIFF(riff [][]byte) (prefix, suffix []byte, err error) {
+	var before, after bytes.Buffer
+	inPrefix := true
+	for _, data := range riff {
+		if inPrefix {
+			before.Write(data)
+			inPrefix = len(data) != 8 || string(data[:4]) != "data"
+		} else {
+			after.Write(data)
+		}
+	}
+	if inPrefix {
+		return nil, nil, streamCorrupted("Stored RIFF chunks have no data chunk")
+	}
+	return before.Bytes(), after.Bytes(), nil
+}
+
+func (d *StreamDecoder) encodeBlock(block [][]int32) ([]byte, error) {
+	hashSamples(d.md5, block, int(d.info.BitsPerSample))
+	samples := make([]int, 0, len(block)*len(block[0]))
+	for i := range block[0] {
+		for _, channel := range block {
+			samples = append(samples, int(channel[i]))
+		}
+	}
+	pcm, err := utils.EncodePCM(samples, d.header.ContainerBits, d.header.Format.BitsPerSample)
+	if err != nil {
+		return nil, err
+	}
+	d.samples += uint64(len(block[0]))
+	d.dataBytes += int64(len(pcm))
+	return pcm, nil
+}
+
+// DecodeFLAC converts a complete FLAC file to WAV. Unlike a stream, a file
+// whose STREAMINFO does not give its length gets a WAV header with the real
+// sizes.
+func DecodeFLAC(flacData []byte) ([]byte, error) {
+	d, wavData, err := decodeAll(flacData)
+	if err != nil {
+		return nil, err
+	}
+	if !d.restored && d.header.DataSize == utils.UnknownDataSize {
+		header := *d.header
+		header.DataSize = d.dataBytes
+		wavData = append(header.Encode(), wavData[d.prefixLen:]...)
+	}
+	return wavData, nil
+}
+
+func decodeAll(flacData []byte) (*StreamDecoder, []byte, error) {
+	d := NewStreamDecoder()
+	wavData, err := d.Write(flacData)
+	if err != nil {
+		return nil, nil, err
+	}
+	tail, err := d.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, append(wavData, tail...), nil
+}
+
+// flacMetadata holds what the decoder needs from a FLAC stream's metadata
+// blocks.
+type flacMetadata struct {
+	info meta.StreamInfo
+	// riff holds the data of the APPLICATION blocks with stored RIFF chunks.
+	riff [][]byte
+	// channelMask is the WAV channel mask from a channelMaskTag, or zero.
+	channelMask uint32
+}
+
+// flacSignature starts every native FLAC stream.
+const flacSignature = "fLaC"
+
+// parseFLACMetadata reads the signature and metadata blocks at the start of
+// data and returns them with their length in bytes. It returns nil metadata
+// and no error while data ends before the last metadata block.
+func parseFLACMetadata(data []byte) (*flacMetadata, int, error) {
+	n := len(flacSignature)
+	if len(data) < n {
+		n = len(data)
+	}
+	if string(data[:n]) != flacSignature[:n] {
+		return nil, 0, unsupportedFormat("Not a FLAC stream")
+	}
+
+	metadata := &flacMetadata{}
+	pos := len(flacSignature)
+	for first := true; ; first = false {
+		if len(data) < pos+4 {
+			return nil, 0, nil
+		}
+		last := data[pos]&0x80 != 0
+		typ := meta.Type(data[pos] & 0x7F)
+		length := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		body := pos + 4
+		if len(data) < body+length {
+			return nil, 0, nil
+		}
+		if first != (typ == meta.TypeStreamInfo) {
+			return nil, 0, streamCorrupted("STREAMINFO must be the first metadata block")
+		}
+
+		switch typ {
+		case meta.TypeStreamInfo:
+			if length != 34 {
+				return nil, 0, streamCorrupted("STREAMINFO block has length %d", length)
+			}
+			metadata.info = decodeStreamInfo(data[body : body+length])
+		case meta.TypeApplication:
+			if length >= 4 && binary.BigEndian.Uint32(data[body:]) == riffApplicationID {
+				metadata.riff = append(metadata.riff, data[body+4:body+length])
+			}
+		case meta.TypeVorbisComment:
+			for _, tag := range parseVorbisComment(data[body : body+length]) {
+				if strings.EqualFold(tag[0], channelMaskTag) {
+					if mask, err := strconv.ParseUint(tag[1], 0, 32); err == nil {
+						metadata.channelMask = uint32(mask)
+					}
+				}
+			}
+		}
+		pos = body + length
+		if last {
+			return metadata, pos, nil
+		}
+	}
+}
+
+// decodeStreamInfo is the inverse of encodeStreamInfo.
+func decodeStreamInfo(body []byte) meta.StreamInfo {
+	packed := binary.BigEndian.Uint64(body[10:18])
+	info := meta.StreamInfo{
+		BlockSizeMin:  binary.BigEndian.Uint16(body[0:2]),
+		BlockSizeMax:  binary.BigEndian.Uint16(body[2:4]),
+		FrameSizeMin:  uint32(body[4])<<16 | uint32(body[5])<<8 | uint32(body[6]),
+		FrameSizeMax:  uint32(body[7])<<16 | uint32(body[8])<<8 | uint32(body[9]),
+		SampleRate:    uint32(packed >> 44),
+		NChannels:     uint8(packed>>41&0x7) + 1,
+		BitsPerSample: uint8(packed>>36&0x1F) + 1,
+		NSamples:      packed & (1<<36 - 1),
+	}
+	copy(info.MD5sum[:], body[18:34])
+	return info
+}
+
+// parseVorbisComment returns the tags of a VORBIS_COMMENT block body, or as
+// many as it holds before a malformed field.
+func parseVorbisComment(body []byte) [][2]string {
+	if len(body) < 4 {
+		return nil
+	}
+	pos := 4 + int(binary.LittleEndian.Uint32(body))
+	if pos+4 > len(body) || pos < 4 {
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint32(body[pos:]))
+	pos += 4
+	var tags [][2]string
+	for i := 0; i < count && pos+4 <= len(body); i++ {
+		n := int(binary.LittleEndian.Uint32(body[pos:]))
+		pos += 4
+		if n < 0 || n > len(body)-pos {
+			break
+		}
+		if name, value, ok := strings.Cut(string(body[pos:pos+n]), "="); ok {
+			tags = append(tags, [2]string{name, value})
+		}
+		pos += n
+	}
+	return tags
+}
+
+func streamCorrupted(format string, args ...interface{}) error {
+	return &models.ConversionError{
+		Code:    models.ErrStreamCorrupted,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
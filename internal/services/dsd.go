@@ -0,0 +1,234 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"audio-converter/pkg/utils"
+)
+
+// DSD input is decimated to 24-bit PCM at one of these rates.
+const (
+	DSDRate88200         = 88200
+	DSDRate176400        = 176400
+	DefaultDSDSampleRate = DSDRate88200
+)
+
+// dsdBitsPerSample is the depth of the PCM decimated from DSD input.
+const dsdBitsPerSample = 24
+
+// dsdFilterLength is the length of the decimation filter in output samples.
+// Longer filters narrow the transition band below the output Nyquist
+// frequency at the cost of more work per sample.
+const dsdFilterLength = 32
+
+// DSDOptions control how 1-bit DSD input is converted to PCM. Nil fields
+// take their defaults.
+type DSDOptions struct {
+	SampleRate *int `json:"dsdSampleRate,omitempty"`
+}
+
+// dsdParams is the validated form of DSDOptions.
+type dsdParams struct {
+	sampleRate int
+}
+
+func defaultDSDParams() dsdParams {
+	return dsdParams{sampleRate: DefaultDSDSampleRate}
+}
+
+// Merge returns a copy of o with every field set in override replacing the
+// corresponding field of o.
+func (o DSDOptions) Merge(override DSDOptions) DSDOptions {
+	if override.SampleRate != nil {
+		o.SampleRate = override.SampleRate
+	}
+	return o
+}
+
+// Resolve validates o and returns it with every field filled in.
+func (o DSDOptions) Resolve() (DSDOptions, error) {
+	p, err := o.params()
+	if err != nil {
+		return o, err
+	}
+	return DSDOptions{SampleRate: &p.sampleRate}, nil
+}
+
+func (o DSDOptions) params() (dsdParams, error) {
+	p := defaultDSDParams()
+	if o.SampleRate != nil {
+		switch *o.SampleRate {
+		case DSDRate88200, DSDRate176400:
+		default:
+			return p, invalidOption("DSD input can be converted to %d or %d Hz", DSDRate88200, DSDRate176400)
+		}
+		p.sampleRate = *o.SampleRate
+	}
+	return p, nil
+}
+
+// dsdTags records the source of PCM decimated from a DSD file.
+func dsdTags(header *utils.WAVHeader) [][2]string {
+	container := "DSF"
+	if header.Form == "DFF" {
+		container = "DSDIFF"
+	}
+	rate := header.Format.SampleRate
+	tags := [][2]string{{"DSD_SAMPLE_RATE", fmt.Sprint(rate)}}
+	// DSD64 is 64 times 44.1 kHz, or 64 times 48 kHz in the 48 kHz family
+	for _, base := range []int{44100, 48000} {
+		if rate%base == 0 {
+			tags = append(tags, [2]string{"DSD_RATE", fmt.Sprintf("DSD%d", rate/base)})
+			break
+		}
+	}
+	return append(tags, [2]string{"DSD_CONTAINER", container})
+}
+
+// dsdDecimator converts 1-bit DSD to PCM with a windowed-sinc low-pass
+// filter evaluated a byte at a time: each byte of the filter window has a
+// table of the sums its 256 bit patterns contribute.
+type dsdDecimator struct {
+	layout utils.DSDLayout
+	// step is the number of DSD bytes per channel for each output sample.
+	step   int
+	tables [][256]float64
+	// pending holds the bytes of each channel not yet passed by the filter,
+	// most significant bit first.
+	pending [][]byte
+	// inputLeft and outputLeft count the bytes per channel still to be read
+	// and the samples per channel still to be produced.
+	inputLeft  uint64
+	outputLeft uint64
+}
+
+// newDSDDecimator prepares the conversion of the DSD samples described by
+// header to PCM at rate, which must divide the DSD rate by a multiple of 8.
+func newDSDDecimator(header *utils.WAVHeader, rate int) (*dsdDecimator, error) {
+	dsdRate := header.Format.SampleRate
+	ratio := dsdRate / rate
+	if dsdRate%rate != 0 || ratio%8 != 0 || ratio == 0 {
+		return nil, unsupportedFormat("DSD at %d Hz cannot be converted to %d Hz", dsdRate, rate)
+	}
+
+	h := dsdFilter(dsdFilterLength*ratio, ratio)
+	tables := make([][256]float64, len(h)/8)
+	for k := range tables {
+		for b := 0; b < 256; b++ {
+			var sum float64
+			for i := 0; i < 8; i++ {
+				if b&(0x80>>i) != 0 {
+					sum += h[8*k+i]
+				} else {
+					sum -= h[8*k+i]
+				}
+			}
+			tables[k][b] = sum
+		}
+	}
+
+	// Half a window of silence centres the filter on the first sample
+	pending := make([][]byte, header.Format.NumChannels)
+	for c := range pending {
+		pending[c] = silence(len(tables) / 2)
+	}
+	return &dsdDecimator{
+		layout:     *header.DSD,
+		step:       ratio / 8,
+		tables:     tables,
+		pending:    pending,
+		inputLeft:  (header.DSD.Samples + 7) / 8,
+		outputLeft: header.DSD.Samples / uint64(ratio),
+	}, nil
+}
+
+// dsdFilter returns a Blackman-windowed sinc low-pass filter of the given
+// length with unity gain, for decimation by ratio. The cutoff leaves room for
+// the transition band below the output Nyquist frequency.
+func dsdFilter(taps, ratio int) []float64 {
+	cutoff := (0.5 - 2.75/dsdFilterLength) / float64(ratio)
+	h := make([]float64, taps)
+	var sum float64
+	for n := range h {
+		m := float64(n) - float64(taps-1)/2
+		x := 2 * math.Pi * cutoff * m
+		sinc := 1.0
+		if x != 0 {
+			sinc = math.Sin(x) / x
+		}
+		phase := 2 * math.Pi * float64(n) / float64(taps-1)
+		h[n] = sinc * (0.42 - 0.5*math.Cos(phase) + 0.08*math.Cos(2*phase))
+		sum += h[n]
+	}
+	for n := range h {
+		h[n] /= sum
+	}
+	return h
+}
+
+// write consumes whole blocks of DSD data and returns the interleaved PCM
+// samples, full scale being -1.0 to 1.0, that became available. Padding
+// after the last DSD sample is ignored.
+func (d *dsdDecimator) write(data []byte) []float64 {
+	blockSize := d.layout.BlockSize
+	blockAlign := blockSize * len(d.pending)
+	for pos := 0; pos+blockAlign <= len(data) && d.inputLeft > 0; pos += blockAlign {
+		n := blockSize
+		if uint64(n) > d.inputLeft {
+			n = int(d.inputLeft)
+		}
+		d.inputLeft -= uint64(n)
+		for c := range d.pending {
+			block := data[pos+c*blockSize : pos+c*blockSize+n]
+			if d.layout.LSBFirst {
+				for _, b := range block {
+					d.pending[c] = append(d.pending[c], bits.Reverse8(b))
+				}
+			} else {
+				d.pending[c] = append(d.pending[c], block...)
+			}
+		}
+	}
+	return d.filter()
+}
+
+// flush returns the samples that need the silence after the last DSD sample.
+func (d *dsdDecimator) flush() []float64 {
+	for c := range d.pending {
+		d.pending[c] = append(d.pending[c], silence(len(d.tables)/2)...)
+	}
+	return d.filter()
+}
+
+// filter produces every output sample whose window has been received.
+func (d *dsdDecimator) filter() []float64 {
+	var out []float64
+	pos := 0
+	for d.outputLeft > 0 && pos+len(d.tables) <= len(d.pending[0]) {
+		for c := range d.pending {
+			window := d.pending[c][pos : pos+len(d.tables)]
+			var sum float64
+			for k, b := range window {
+				sum += d.tables[k][b]
+			}
+			out = append(out, sum)
+		}
+		pos += d.step
+		d.outputLeft--
+	}
+	for c := range d.pending {
+		d.pending[c] = append(d.pending[c][:0], d.pending[c][pos:]...)
+	}
+	return out
+}
+
+// silence returns n bytes of DSD silence.
+func silence(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = utils.DSDSilence
+	}
+	return b
+}
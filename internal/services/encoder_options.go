@@ -0,0 +1,124 @@
+package services
+
+import (
+	"fmt"
+
+	"audio-converter/internal/models"
+)
+
+// DefaultCompressionLevel is used when no level is configured.
+const DefaultCompressionLevel = 5
+
+// EncoderOptions tunes the FLAC encoder. Nil fields take the value implied by
+// the compression level, which itself defaults to DefaultCompressionLevel.
+type EncoderOptions struct {
+	CompressionLevel  *int  `json:"compressionLevel,omitempty"`
+	BlockSize         *int  `json:"blockSize,omitempty"`
+	MaxLPCOrder       *int  `json:"maxLpcOrder,omitempty"`
+	MaxPartitionOrder *int  `json:"maxPartitionOrder,omitempty"`
+	MidSide           *bool `json:"midSide,omitempty"`
+}
+
+// compressionLevels follows the presets of the reference encoder. Levels 7
+// and 8 search every LPC order instead of estimating the best one.
+var compressionLevels = [...]encoderParams{
+	0: {level: 0, blockSize: 1152, maxLPCOrder: 0, maxPartitionOrder: 3, midSide: false},
+	1: {level: 1, blockSize: 1152, maxLPCOrder: 0, maxPartitionOrder: 3, midSide: true},
+	2: {level: 2, blockSize: 1152, maxLPCOrder: 0, maxPartitionOrder: 3, midSide: true},
+	3: {level: 3, blockSize: 4096, maxLPCOrder: 6, maxPartitionOrder: 4, midSide: false},
+	4: {level: 4, blockSize: 4096, maxLPCOrder: 8, maxPartitionOrder: 4, midSide: true},
+	5: {level: 5, blockSize: 4096, maxLPCOrder: 8, maxPartitionOrder: 5, midSide: true},
+	6: {level: 6, blockSize: 4096, maxLPCOrder: 8, maxPartitionOrder: 6, midSide: true},
+	7: {level: 7, blockSize: 4096, maxLPCOrder: 12, maxPartitionOrder: 6, midSide: true, exhaustive: true},
+	8: {level: 8, blockSize: 4096, maxLPCOrder: 12, maxPartitionOrder: 6, midSide: true, exhaustive: true},
+}
+
+// Bounds of the encoder settings, as allowed by the FLAC format.
+const (
+	minBlockSize          = 16
+	maxBlockSize          = 65535
+	maxLPCOrder           = 32
+	maxRicePartitionOrder = 15
+)
+
+// Merge returns a copy of o with every field set in override replacing the
+// corresponding field of o.
+func (o EncoderOptions) Merge(override EncoderOptions) EncoderOptions {
+	if override.CompressionLevel != nil {
+		o.CompressionLevel = override.CompressionLevel
+	}
+	if override.BlockSize != nil {
+		o.BlockSize = override.BlockSize
+	}
+	if override.MaxLPCOrder != nil {
+		o.MaxLPCOrder = override.MaxLPCOrder
+	}
+	if override.MaxPartitionOrder != nil {
+		o.MaxPartitionOrder = override.MaxPartitionOrder
+	}
+	if override.MidSide != nil {
+		o.MidSide = override.MidSide
+	}
+	return o
+}
+
+// Resolve validates o and returns it with every field filled in.
+func (o EncoderOptions) Resolve() (EncoderOptions, error) {
+	p, err := o.params()
+	if err != nil {
+		return o, err
+	}
+	level := DefaultCompressionLevel
+	if o.CompressionLevel != nil {
+		level = *o.CompressionLevel
+	}
+	return EncoderOptions{
+		CompressionLevel:  &level,
+		BlockSize:         &p.blockSize,
+		MaxLPCOrder:       &p.maxLPCOrder,
+		MaxPartitionOrder: &p.maxPartitionOrder,
+		MidSide:           &p.midSide,
+	}, nil
+}
+
+// params converts the options into the settings used by the encoder.
+func (o EncoderOptions) params() (encoderParams, error) {
+	level := DefaultCompressionLevel
+	if o.CompressionLevel != nil {
+		level = *o.CompressionLevel
+	}
+	if level < 0 || level >= len(compressionLevels) {
+		return encoderParams{}, invalidOption("compression level must be between 0 and %d", len(compressionLevels)-1)
+	}
+	p := compressionLevels[level]
+
+	if o.BlockSize != nil {
+		if *o.BlockSize < minBlockSize || *o.BlockSize > maxBlockSize {
+			return p, invalidOption("block size must be between %d and %d", minBlockSize, maxBlockSize)
+		}
+		p.blockSize = *o.BlockSize
+	}
+	if o.MaxLPCOrder != nil {
+		if *o.MaxLPCOrder < 0 || *o.MaxLPCOrder > maxLPCOrder {
+			return p, invalidOption("max LPC order must be between 0 and %d", maxLPCOrder)
+		}
+		p.maxLPCOrder = *o.MaxLPCOrder
+	}
+	if o.MaxPartitionOrder != nil {
+		if *o.MaxPartitionOrder < 0 || *o.MaxPartitionOrder > maxRicePartitionOrder {
+			return p, invalidOption("max Rice partition order must be between 0 and %d", maxRicePartitionOrder)
+		}
+		p.maxPartitionOrder = *o.MaxPartitionOrder
+	}
+	if o.MidSide != nil {
+		p.midSide = *o.MidSide
+	}
+	return p, nil
+}
+
+func invalidOption(format string, args ...interface{}) error {
+	return &models.ConversionError{
+		Code:    models.ErrInvalidFormat,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
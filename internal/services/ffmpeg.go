@@ -0,0 +1,38 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// convertWithFFmpeg converts WAV data to FLAC using the external ffmpeg tool
+// at the given compression level.
+func convertWithFFmpeg(wavData []byte, level int) ([]byte, error) {
+	// Write WAV data to a temporary file for ffmpeg to read
+	tmpWavFile, err := ioutil.TempFile("", "input*.wav")
+	if err != nil {
+		return nil, err
+	}
+	defer tmpWavFile.Close()
+	defer os.Remove(tmpWavFile.Name())
+
+	if _, err := tmpWavFile.Write(wavData); err != nil {
+		return nil, err
+	}
+
+	// Set up the ffmpeg command to read the WAV file and output FLAC data
+	cmd := exec.Command("ffmpeg", "-i", tmpWavFile.Name(), "-compression_level", strconv.Itoa(level), "-f", "flac", "pipe:1")
+	var flacBuffer bytes.Buffer
+	cmd.Stdout = &flacBuffer
+
+	// Run the ffmpeg command to convert the WAV to FLAC
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error converting WAV to FLAC: %v", err)
+	}
+
+	return flacBuffer.Bytes(), nil
+}
@@ -0,0 +1,510 @@
+package services
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/mewkiz/flac/frame"
+)
+
+// encoderParams holds the tuning used by the native FLAC encoder when it
+// analyses a block of audio.
+type encoderParams struct {
+	level             int
+	blockSize         int
+	maxLPCOrder       int
+	maxPartitionOrder int
+	midSide           bool
+	// exhaustive tries every LPC order instead of only the one the
+	// prediction error suggests.
+	exhaustive bool
+}
+
+// defaultEncoderParams mirrors the reference encoder's default compression
+// level.
+func defaultEncoderParams() encoderParams {
+	return compressionLevels[DefaultCompressionLevel]
+}
+
+// Limits imposed by the FLAC bitstream on the values we choose.
+const (
+	maxFixedOrder     = 4
+	maxRiceParam      = 14 // 4-bit parameter, 15 is the escape code
+	maxRice2Param     = 30 // 5-bit parameter, 31 is the escape code
+	maxLPCPrecision   = 15
+	maxLPCShift       = 15
+	subframeHeaderLen = 8
+)
+
+// subframeChoice is the result of analysing one channel of a block: the
+// header to hand to the bitstream writer and the estimated encoded size.
+type subframeChoice struct {
+	header frame.SubHeader
+	bits   uint64
+}
+
+// buildFrame analyses one block of per-channel samples and returns a frame
+// ready for flac.Encoder.WriteFrame. The sample slices are referenced, not
+// copied; the encoder restores them after writing.
+func (p encoderParams) buildFrame(channels [][]int32, bps uint, sampleRate uint32) *frame.Frame {
+	n := len(channels[0])
+	f := &frame.Frame{
+		Header: frame.Header{
+			HasFixedBlockSize: true,
+			BlockSize:         uint16(n),
+			SampleRate:        sampleRate,
+			Channels:          frame.Channels(len(channels) - 1),
+			BitsPerSample:     uint8(bps),
+		},
+		Subframes: make([]*frame.Subframe, len(channels)),
+	}
+
+	choices := make([]subframeChoice, len(channels))
+	for i, samples := range channels {
+		choices[i] = p.analyzeSubframe(samples, bps)
+	}
+
+	// Stereo decorrelation: the side channel costs one extra bit per sample,
+	// so only keep it when the prediction gain outweighs that.
+	if len(channels) == 2 && p.midSide && bps < 32 {
+		left, right := channels[0], channels[1]
+		mid := make([]int32, n)
+		side := make([]int32, n)
+		for i := range left {
+			mid[i] = int32((int64(left[i]) + int64(right[i])) >> 1)
+			side[i] = left[i] - right[i]
+		}
+		midChoice := p.analyzeSubframe(mid, bps)
+		sideChoice := p.analyzeSubframe(side, bps+1)
+
+		best := choices[0].bits + choices[1].bits
+		if b := choices[0].bits + sideChoice.bits; b < best {
+			best = b
+			f.Channels = frame.ChannelsLeftSide
+		}
+		if b := sideChoice.bits + choices[1].bits; b < best {
+			best = b
+			f.Channels = frame.ChannelsSideRight
+		}
+		if b := midChoice.bits + sideChoice.bits; b < best {
+			f.Channels = frame.ChannelsMidSide
+		}
+
+		switch f.Channels {
+		case frame.ChannelsLeftSide:
+			choices[1] = sideChoice
+		case frame.ChannelsSideRight:
+			choices[0] = sideChoice
+		case frame.ChannelsMidSide:
+			choices[0], choices[1] = midChoice, sideChoice
+		}
+	}
+
+	for i, samples := range channels {
+		f.Subframes[i] = &frame.Subframe{
+			SubHeader: choices[i].header,
+			Samples:   samples,
+			NSamples:  n,
+		}
+	}
+	return f
+}
+
+// analyzeSubframe picks the cheapest prediction method for a single channel
+// of a block.
+func (p encoderParams) analyzeSubframe(samples []int32, bps uint) subframeChoice {
+	n := len(samples)
+	if isConstant(samples) {
+		return subframeChoice{
+			header: frame.SubHeader{Pred: frame.PredConstant},
+			bits:   subframeHeaderLen + uint64(bps),
+		}
+	}
+
+	wasted := wastedBits(samples)
+	if wasted > 0 {
+		shifted := make([]int32, n)
+		for i, s := range samples {
+			shifted[i] = s >> wasted
+		}
+		samples = shifted
+	}
+	ebps := bps - wasted
+	headerBits := uint64(subframeHeaderLen) + uint64(wasted)
+
+	best := subframeChoice{
+		header: frame.SubHeader{Pred: frame.PredVerbatim, Wasted: wasted},
+		bits:   headerBits + uint64(n)*uint64(ebps),
+	}
+
+	residuals := make([]int32, n)
+	for order := 0; order <= maxFixedOrder && order < n; order++ {
+		if !computeResiduals(samples, frame.FixedCoeffs[order], 0, residuals[:n-order]) {
+			continue
+		}
+		rice, method, riceBits := p.riceParameters(residuals[:n-order], n, order)
+		total := headerBits + uint64(order)*uint64(ebps) + riceBits
+		if total < best.bits {
+			best = subframeChoice{
+				header: frame.SubHeader{
+					Pred:                 frame.PredFixed,
+					Order:                order,
+					Wasted:               wasted,
+					ResidualCodingMethod: method,
+					RiceSubframe:         rice,
+				},
+				bits: total,
+			}
+		}
+	}
+
+	maxOrder := p.maxLPCOrder
+	if maxOrder >= n {
+		maxOrder = n - 1
+	}
+	if maxOrder < 1 {
+		return best
+	}
+	precision := lpcPrecision(ebps, n)
+	predictors, errPowers := levinsonDurbin(autocorrelation(samples, maxOrder), maxOrder)
+	if !p.exhaustive {
+		guess := estimateLPCOrder(errPowers, n, ebps, precision)
+		for i := range predictors {
+			if i+1 != guess {
+				predictors[i] = nil
+			}
+		}
+	}
+	for order, lpc := range predictors {
+		if lpc == nil {
+			continue
+		}
+		order++
+		coeffs, shift, ok := quantizeLPC(lpc, precision)
+		if !ok || !computeResiduals(samples, coeffs, shift, residuals[:n-order]) {
+			continue
+		}
+		rice, method, riceBits := p.riceParameters(residuals[:n-order], n, order)
+		total := headerBits + uint64(order)*uint64(ebps) + 4 + 5 + uint64(order)*uint64(precision) + riceBits
+		if total < best.bits {
+			best = subframeChoice{
+				header: frame.SubHeader{
+					Pred:                 frame.PredFIR,
+					Order:                order,
+					Wasted:               wasted,
+					ResidualCodingMethod: method,
+					CoeffPrec:            precision,
+					CoeffShift:           shift,
+					Coeffs:               coeffs,
+					RiceSubframe:         rice,
+				},
+				bits: total,
+			}
+		}
+	}
+	return best
+}
+
+// isConstant reports whether every sample in the block has the same value.
+func isConstant(samples []int32) bool {
+	for _, s := range samples[1:] {
+		if s != samples[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// wastedBits returns the number of trailing zero bits shared by every sample.
+func wastedBits(samples []int32) uint {
+	var acc int32
+	for _, s := range samples {
+		acc |= s
+		if acc&1 != 0 {
+			return 0
+		}
+	}
+	if acc == 0 {
+		return 0
+	}
+	return uint(bits.TrailingZeros32(uint32(acc)))
+}
+
+// computeResiduals fills residuals with the prediction error of coeffs over
+// samples. It reports false when a prediction or residual does not fit the
+// 32-bit range the bitstream writer works in.
+func computeResiduals(samples, coeffs []int32, shift int32, residuals []int32) bool {
+	order := len(coeffs)
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, c := range coeffs {
+			sum += int64(c) * int64(samples[i-j-1])
+		}
+		pred := sum >> uint(shift)
+		if pred > math.MaxInt32 || pred < math.MinInt32 {
+			return false
+		}
+		r := int64(samples[i]) - pred
+		if r > math.MaxInt32 || r < math.MinInt32 {
+			return false
+		}
+		residuals[i-order] = int32(r)
+	}
+	return true
+}
+
+// riceParameters chooses the partition order and per-partition Rice
+// parameters for the residuals of a subframe with the given block size and
+// predictor order. It returns the estimated size of the coded residual in
+// bits.
+func (p encoderParams) riceParameters(residuals []int32, blockSize, order int) (*frame.RiceSubframe, frame.ResidualCodingMethod, uint64) {
+	maxOrder := p.maxPartitionOrder
+	for maxOrder > 0 && (blockSize%(1<<maxOrder) != 0 || blockSize>>maxOrder <= order) {
+		maxOrder--
+	}
+
+	// Sum the folded residuals of the finest partitioning once, then merge
+	// neighbouring partitions to evaluate the coarser orders.
+	nparts := 1 << maxOrder
+	sums := make([]uint64, nparts)
+	counts := make([]int, nparts)
+	pos := 0
+	for i := range sums {
+		count := blockSize >> maxOrder
+		if i == 0 {
+			count -= order
+		}
+		for _, r := range residuals[pos : pos+count] {
+			sums[i] += uint64(zigzag(r))
+		}
+		counts[i] = count
+		pos += count
+	}
+
+	var (
+		best       *frame.RiceSubframe
+		bestMethod frame.ResidualCodingMethod
+		bestBits   uint64 = math.MaxUint64
+	)
+	for partOrder := maxOrder; partOrder >= 0; partOrder-- {
+		partitions := make([]frame.RicePartition, len(sums))
+		method := frame.ResidualCodingMethodRice1
+		var total uint64
+		for i, sum := range sums {
+			k, cost := riceParam(sum, counts[i])
+			if k > maxRiceParam {
+				method = frame.ResidualCodingMethodRice2
+			}
+			partitions[i].Param = k
+			total += cost
+		}
+		paramBits := uint64(4)
+		if method == frame.ResidualCodingMethodRice2 {
+			paramBits = 5
+		}
+		total += 2 + 4 + paramBits*uint64(len(partitions))
+		if total < bestBits {
+			best = &frame.RiceSubframe{PartOrder: partOrder, Partitions: partitions}
+			bestMethod = method
+			bestBits = total
+		}
+
+		if partOrder > 0 {
+			for i := 0; i < len(sums)/2; i++ {
+				sums[i] = sums[2*i] + sums[2*i+1]
+				counts[i] = counts[2*i] + counts[2*i+1]
+			}
+			sums = sums[:len(sums)/2]
+			counts = counts[:len(counts)/2]
+		}
+	}
+	return best, bestMethod, bestBits
+}
+
+// riceParam returns the Rice parameter that minimises the estimated coded
+// size of a partition with the given sum of folded residuals, along with
+// that size in bits.
+func riceParam(sum uint64, count int) (uint, uint64) {
+	if count == 0 {
+		return 0, 0
+	}
+	n := uint64(count)
+	var k uint
+	if mean := sum / n; mean > 0 {
+		k = uint(bits.Len64(mean)) - 1
+	}
+	if k > maxRice2Param {
+		k = maxRice2Param
+	}
+	cost := func(k uint) uint64 { return n*uint64(k+1) + sum>>k }
+	best, bestCost := k, cost(k)
+	if k > 0 {
+		if c := cost(k - 1); c < bestCost {
+			best, bestCost = k-1, c
+		}
+	}
+	if k < maxRice2Param {
+		if c := cost(k + 1); c < bestCost {
+			best, bestCost = k+1, c
+		}
+	}
+	return best, bestCost
+}
+
+// zigzag folds a signed residual into the unsigned value Rice coding uses.
+func zigzag(r int32) uint32 {
+	return uint32(r<<1) ^ uint32(r>>31)
+}
+
+// autocorrelation computes the autocorrelation of samples for lags 0 through
+// maxLag after applying a Tukey window.
+func autocorrelation(samples []int32, maxLag int) []float64 {
+	n := len(samples)
+	x := make([]float64, n)
+	taper := n / 4
+	for i, s := range samples {
+		w := 1.0
+		switch {
+		case taper > 0 && i < taper:
+			w = 0.5 - 0.5*math.Cos(math.Pi*float64(i)/float64(taper))
+		case taper > 0 && i >= n-taper:
+			w = 0.5 - 0.5*math.Cos(math.Pi*float64(n-1-i)/float64(taper))
+		}
+		x[i] = float64(s) * w
+	}
+
+	autoc := make([]float64, maxLag+1)
+	for lag := range autoc {
+		var sum float64
+		for i := lag; i < n; i++ {
+			sum += x[i] * x[i-lag]
+		}
+		autoc[lag] = sum
+	}
+	return autoc
+}
+
+// levinsonDurbin solves for the linear predictors of every order up to
+// maxOrder. Element i of the result holds the coefficients of order i+1, or
+// nil when the recursion became unstable at that order, along with the
+// remaining prediction error power.
+func levinsonDurbin(autoc []float64, maxOrder int) ([][]float64, []float64) {
+	result := make([][]float64, maxOrder)
+	errPowers := make([]float64, maxOrder)
+	if autoc[0] == 0 {
+		return result, errPowers
+	}
+	lpc := make([]float64, maxOrder)
+	tmp := make([]float64, maxOrder)
+	errPower := autoc[0]
+	for i := 0; i < maxOrder; i++ {
+		acc := autoc[i+1]
+		for j := 0; j < i; j++ {
+			acc -= lpc[j] * autoc[i-j]
+		}
+		if errPower <= 0 {
+			break
+		}
+		k := acc / errPower
+		copy(tmp, lpc[:i])
+		for j := 0; j < i; j++ {
+			lpc[j] = tmp[j] - k*tmp[i-1-j]
+		}
+		lpc[i] = k
+		errPower *= 1 - k*k
+		result[i] = append([]float64(nil), lpc[:i+1]...)
+		errPowers[i] = errPower
+	}
+	return result, errPowers
+}
+
+// estimateLPCOrder guesses the LPC order giving the smallest subframe from
+// the prediction error power of each order, without encoding any of them.
+func estimateLPCOrder(errPowers []float64, blockSize int, bps, precision uint) int {
+	best, bestBits := 0, math.Inf(1)
+	for i, e := range errPowers {
+		order := i + 1
+		if e <= 0 {
+			continue
+		}
+		// Expected bits per residual of a Laplacian source with this error
+		// power, plus the cost of the warm-up samples and coefficients.
+		perSample := 0.5 * math.Log2(2*math.Pi*math.E*e/float64(blockSize))
+		if perSample < 0 {
+			perSample = 0
+		}
+		bits := perSample*float64(blockSize-order) + float64(order)*float64(bps+precision)
+		if bits < bestBits {
+			best, bestBits = order, bits
+		}
+	}
+	return best
+}
+
+// lpcPrecision returns the quantization precision of LPC coefficients for a
+// subframe, following the reference encoder's choice by block size.
+func lpcPrecision(bps uint, blockSize int) uint {
+	var precision uint
+	switch {
+	case blockSize <= 192:
+		precision = 7
+	case blockSize <= 384:
+		precision = 8
+	case blockSize <= 576:
+		precision = 9
+	case blockSize <= 1152:
+		precision = 10
+	case blockSize <= 2304:
+		precision = 11
+	case blockSize <= 4608:
+		precision = 12
+	default:
+		precision = 13
+	}
+	if bps > 16 {
+		precision += 2
+	}
+	if precision > maxLPCPrecision {
+		precision = maxLPCPrecision
+	}
+	return precision
+}
+
+// quantizeLPC converts floating-point predictor coefficients to integers of
+// the given precision and returns the shift to apply to their sum.
+func quantizeLPC(lpc []float64, precision uint) ([]int32, int32, bool) {
+	var cmax float64
+	for _, c := range lpc {
+		cmax = math.Max(cmax, math.Abs(c))
+	}
+	if cmax == 0 || math.IsNaN(cmax) || math.IsInf(cmax, 0) {
+		return nil, 0, false
+	}
+
+	// One bit of the precision holds the sign.
+	_, exp := math.Frexp(cmax)
+	shift := int(precision) - 1 - exp
+	if shift > maxLPCShift {
+		shift = maxLPCShift
+	}
+	if shift < 0 {
+		return nil, 0, false
+	}
+
+	qmax := int64(1)<<(precision-1) - 1
+	qmin := -qmax - 1
+	coeffs := make([]int32, len(lpc))
+	var carry float64
+	for i, c := range lpc {
+		carry += c * float64(int64(1)<<uint(shift))
+		q := int64(math.Round(carry))
+		if q > qmax {
+			q = qmax
+		} else if q < qmin {
+			q = qmin
+		}
+		carry -= float64(q)
+		coeffs[i] = int32(q)
+	}
+	return coeffs, int32(shift), true
+}
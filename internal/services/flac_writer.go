@@ -0,0 +1,302 @@
+package services
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+)
+
+// flacWriter buffers de-interleaved PCM and encodes it block by block into a
+// FLAC stream. Frames of up to 24 bits per sample go through mewkiz/flac's
+// bitstream writer, 32-bit frames through encodeFrame. The writer keeps the
+// STREAMINFO totals itself so both kinds of stream are finalized alike.
+type flacWriter struct {
+	dest    io.Writer
+	w       *countingWriter
+	enc     *flac.Encoder
+	info    meta.StreamInfo
+	params  encoderParams
+	pending [][]int32
+	md5     hash.Hash
+	frames  uint64
+	// verifier, when set, checks every frame as soon as it is encoded.
+	verifier *frameVerifier
+	// header holds the signature and metadata blocks written before the
+	// first frame.
+	header []byte
+	// seekTable, when set, gets a seek point for the frame holding each of
+	// seekTargets, the target samples still ahead in ascending order.
+	seekTable   *meta.SeekTable
+	seekTargets []uint64
+}
+
+// newFlacWriter writes the FLAC signature, STREAMINFO for the given format and
+// any further metadata blocks to w and returns a writer ready to accept
+// samples.
+func newFlacWriter(w io.Writer, sampleRate, numChannels, bitsPerSample int, params encoderParams, blocks ...*meta.Block) (*flacWriter, error) {
+	info := meta.StreamInfo{
+		BlockSizeMin:  uint16(params.blockSize),
+		BlockSizeMax:  uint16(params.blockSize),
+		SampleRate:    uint32(sampleRate),
+		NChannels:     uint8(numChannels),
+		BitsPerSample: uint8(bitsPerSample),
+	}
+	// The encoder only sees a counting wrapper, which hides any Seek method
+	// so that mewkiz does not rewrite STREAMINFO with totals of its own. The
+	// metadata it writes is discarded for that of encodeMetadata, which also
+	// copies blocks mewkiz cannot encode.
+	cw := &countingWriter{w: io.Discard}
+	streamInfo := info
+	enc, err := flac.NewEncoder(cw, &streamInfo)
+	if err != nil {
+		return nil, err
+	}
+	header, err := encodeMetadata(&info, blocks)
+	if err != nil {
+		return nil, err
+	}
+	cw.w, cw.n = w, 0
+	if _, err := cw.Write(header); err != nil {
+		return nil, err
+	}
+	return &flacWriter{
+		dest:    w,
+		w:       cw,
+		enc:     enc,
+		info:    info,
+		params:  params,
+		pending: make([][]int32, numChannels),
+		md5:     md5.New(),
+		header:  header,
+	}, nil
+}
+
+// WriteInterleaved queues interleaved samples and encodes every complete block.
+func (fw *flacWriter) WriteInterleaved(samples []int) error {
+	nch := len(fw.pending)
+	if len(samples)%nch != 0 {
+		return errors.New("sample count is not a multiple of the channel count")
+	}
+	for i, s := range samples {
+		fw.pending[i%nch] = append(fw.pending[i%nch], int32(s))
+	}
+	for len(fw.pending[0]) >= fw.params.blockSize {
+		if err := fw.writeBlock(fw.params.blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush encodes any queued samples as a final, possibly short, block.
+func (fw *flacWriter) Flush() error {
+	if len(fw.pending[0]) == 0 {
+		return nil
+	}
+	return fw.writeBlock(len(fw.pending[0]))
+}
+
+// Close flushes queued samples and completes the STREAMINFO totals and MD5
+// signature. STREAMINFO was written before they were known; callers that can
+// seek write StreamInfo over it at streamInfoOffset.
+func (fw *flacWriter) Close() error {
+	if err := fw.Flush(); err != nil {
+		return err
+	}
+	// A stream shorter than one block consists of that block alone
+	if fw.info.NSamples > 0 && fw.info.NSamples < uint64(fw.params.blockSize) {
+		fw.info.BlockSizeMin = uint16(fw.info.NSamples)
+		fw.info.BlockSizeMax = uint16(fw.info.NSamples)
+	}
+	copy(fw.info.MD5sum[:], fw.md5.Sum(nil))
+	if sink, ok := fw.dest.(frameSink); ok {
+		return sink.close()
+	}
+	return nil
+}
+
+// StreamInfo returns the body of the STREAMINFO block as it stands.
+func (fw *flacWriter) StreamInfo() []byte {
+	return encodeStreamInfo(&fw.info)
+}
+
+func (fw *flacWriter) writeBlock(n int) error {
+	block := make([][]int32, len(fw.pending))
+	for ch := range fw.pending {
+		block[ch] = fw.pending[ch][:n:n]
+	}
+	fw.hashBlock(block)
+
+	start := fw.w.n
+	if fw.verifier != nil {
+		fw.w.tee = new(bytes.Buffer)
+	}
+	f := fw.params.buildFrame(block, uint(fw.info.BitsPerSample), fw.info.SampleRate)
+	if fw.info.BitsPerSample > 24 {
+		data, err := encodeFrame(f, fw.frames)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.w.Write(data); err != nil {
+			return err
+		}
+	} else if err := fw.enc.WriteFrame(f); err != nil {
+		return err
+	}
+	if fw.verifier != nil {
+		data := fw.w.tee.Bytes()
+		fw.w.tee = nil
+		if err := fw.verifier.check(fw, data, block); err != nil {
+			return err
+		}
+	}
+	if sink, ok := fw.dest.(frameSink); ok {
+		if err := sink.endFrame(n); err != nil {
+			return err
+		}
+	}
+	fw.addSeekPoint(uint64(start)-uint64(len(fw.header)), n)
+	fw.frames++
+	fw.info.NSamples += uint64(n)
+	size := uint32(fw.w.n - start)
+	if fw.info.FrameSizeMin == 0 || size < fw.info.FrameSizeMin {
+		fw.info.FrameSizeMin = size
+	}
+	if size > fw.info.FrameSizeMax {
+		fw.info.FrameSizeMax = size
+	}
+
+	for ch := range fw.pending {
+		fw.pending[ch] = append(fw.pending[ch][:0:0], fw.pending[ch][n:]...)
+	}
+	return nil
+}
+
+// addSeekPoint adds a seek point for the frame of n samples just written,
+// offset bytes after the metadata, if it holds any of the seek targets.
+func (fw *flacWriter) addSeekPoint(offset uint64, n int) {
+	first := fw.info.NSamples
+	end := first + uint64(n)
+	if fw.seekTable == nil || len(fw.seekTargets) == 0 || fw.seekTargets[0] >= end {
+		return
+	}
+	for len(fw.seekTargets) > 0 && fw.seekTargets[0] < end {
+		fw.seekTargets = fw.seekTargets[1:]
+	}
+	fw.seekTable.Points = append(fw.seekTable.Points, meta.SeekPoint{SampleNum: first, Offset: offset, NSamples: uint16(n)})
+}
+
+// hashBlock adds a block to the MD5 signature of the unencoded audio.
+func (fw *flacWriter) hashBlock(block [][]int32) {
+	hashSamples(fw.md5, block, int(fw.info.BitsPerSample))
+}
+
+// hashSamples adds a block of samples, one slice per channel, to a STREAMINFO
+// MD5 signature: the interleaved samples as little-endian signed integers of
+// the smallest whole number of bytes holding the bit depth.
+func hashSamples(h hash.Hash, block [][]int32, bitsPerSample int) {
+	width := (bitsPerSample + 7) / 8
+	buf := make([]byte, 0, len(block)*len(block[0])*width)
+	for i := range block[0] {
+		for _, samples := range block {
+			s := samples[i]
+			for b := 0; b < width; b++ {
+				buf = append(buf, byte(s>>(8*b)))
+			}
+		}
+	}
+	h.Write(buf)
+}
+
+// streamInfoOffset is the position of the STREAMINFO body, after the FLAC
+// signature and the metadata block header.
+const streamInfoOffset = 8
+
+// encodeStreamInfo returns the 34-byte body of a STREAMINFO block.
+func encodeStreamInfo(info *meta.StreamInfo) []byte {
+	body := make([]byte, 34)
+	binary.BigEndian.PutUint16(body[0:2], info.BlockSizeMin)
+	binary.BigEndian.PutUint16(body[2:4], info.BlockSizeMax)
+	putUint24(body[4:7], info.FrameSizeMin)
+	putUint24(body[7:10], info.FrameSizeMax)
+	packed := uint64(info.SampleRate)<<44 |
+		uint64(info.NChannels-1)<<41 |
+		uint64(info.BitsPerSample-1)<<36 |
+		info.NSamples&(1<<36-1)
+	binary.BigEndian.PutUint64(body[10:18], packed)
+	copy(body[18:34], info.MD5sum[:])
+	return body
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+// rawBlock is the body of a metadata block copied as it is, for block types
+// mewkiz/flac cannot encode.
+type rawBlock []byte
+
+// encodeMetadata returns the FLAC signature, the STREAMINFO block and the
+// given metadata blocks as they start a stream.
+func encodeMetadata(info *meta.StreamInfo, blocks []*meta.Block) ([]byte, error) {
+	var known []*meta.Block
+	for _, block := range blocks {
+		if _, ok := block.Body.(rawBlock); !ok {
+			known = append(known, block)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := flac.NewEncoder(&buf, info, known...); err != nil {
+		return nil, err
+	}
+	encoded, _, err := splitMetadata(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte(flacSignature), encoded[0]...)
+	encoded = encoded[1:]
+	// Only the last block carries the flag that ends the metadata
+	last := len(flacSignature)
+	for _, block := range blocks {
+		data[last] &^= 0x80
+		last = len(data)
+		if raw, ok := block.Body.(rawBlock); ok {
+			data = append(data, byte(block.Type), byte(len(raw)>>16), byte(len(raw)>>8), byte(len(raw)))
+			data = append(data, raw...)
+		} else {
+			data = append(data, encoded[0]...)
+			encoded = encoded[1:]
+		}
+	}
+	data[last] |= 0x80
+	return data, nil
+}
+
+// countingWriter counts the bytes written through it and copies them to tee
+// and copy when they are set.
+type countingWriter struct {
+	w    io.Writer
+	n    int64
+	tee  *bytes.Buffer
+	copy io.Writer
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if cw.tee != nil {
+		cw.tee.Write(p[:n])
+	}
+	if cw.copy != nil {
+		cw.copy.Write(p[:n])
+	}
+	return n, err
+}
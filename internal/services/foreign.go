@@ -0,0 +1,232 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mewkiz/flac/meta"
+
+	"audio-converter/internal/models"
+	"audio-converter/pkg/utils"
+)
+
+// riffApplicationID is the APPLICATION block ID under which the reference
+// encoder keeps foreign RIFF chunks ("riff").
+const riffApplicationID = 0x72696666
+
+// maxApplicationData is the most data an APPLICATION block holds after its
+// ID, given the 24-bit block length.
+const maxApplicationData = 1<<24 - 1 - 4
+
+// foreignMetadata stores the bytes of a WAV file other than its samples in
+// APPLICATION blocks, one per chunk as the reference encoder does: the RIFF
+// header, every chunk up to and including the data chunk header, and then the
+// bytes after the audio. prefix runs up to the first sample and tail holds
+// what follows the data chunk's samples, including its padding byte.
+func foreignMetadata(prefix []byte, header *utils.WAVHeader, tail []byte) []*meta.Block {
+	var blocks []*meta.Block
+	add := func(data []byte) {
+		for len(data) > maxApplicationData {
+			blocks = append(blocks, applicationBlock(data[:maxApplicationData]))
+			data = data[maxApplicationData:]
+		}
+		blocks = append(blocks, applicationBlock(data))
+	}
+
+	add(prefix[:12])
+	for _, chunk := range splitChunks(prefix[12 : header.DataOffset-8]) {
+		add(chunk)
+	}
+	add(prefix[header.DataOffset-8 : header.DataOffset])
+
+	if len(tail) > 0 {
+		// Keep the data chunk's padding byte with the chunk that follows it
+		pad := int(header.DataSize & 1)
+		if pad > len(tail) {
+			pad = len(tail)
+		}
+		chunks := splitChunks(tail[pad:])
+		if len(chunks) == 0 {
+			chunks = [][]byte{tail[:pad]}
+		} else {
+			chunks[0] = tail[:len(chunks[0])+pad]
+		}
+		for _, chunk := range chunks {
+			add(chunk)
+		}
+	}
+	return blocks
+}
+
+// splitChunks divides a run of RIFF chunks into the bytes of each chunk,
+// including its padding byte. Bytes that do not form a whole chunk are
+// returned as the last element.
+func splitChunks(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := int64(len(data))
+		if len(data) >= 8 {
+			size := int64(binary.LittleEndian.Uint32(data[4:8]))
+			if end := 8 + size + size&1; end < n {
+				n = end
+			}
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+func applicationBlock(data []byte) *meta.Block {
+	return &meta.Block{
+		Header: meta.Header{Type: meta.TypeApplication, Length: int64(4 + len(data))},
+		Body:   &meta.Application{ID: riffApplicationID, Data: data},
+	}
+}
+
+// RestoreWAV rebuilds the WAV file a FLAC stream was encoded from, using the
+// chunks stored by the KeepForeignMetadata option and the decoded samples.
+func RestoreWAV(flacData []byte) ([]byte, error) {
+	d, wavData, err := decodeAll(flacData)
+	if err != nil {
+		return nil, err
+	}
+	if !d.restored {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "FLAC stream has no stored RIFF chunks",
+		}
+	}
+	return wavData, nil
+}
+
+// restoreCheck compares the WAV file that RestoreWAV rebuilds from a stream
+// keeping foreign metadata with the input, both as they are produced, so
+// neither is held in full. The native FLAC stream is written to it.
+type restoreCheck struct {
+	decoder *StreamDecoder
+	// pending holds the input not compared yet, which starts at byte pos.
+	pending []byte
+	pos     int64
+	err     error
+}
+
+// newRestoreCheck starts checking a stream whose input so far is input.
+func newRestoreCheck(input []byte) *restoreCheck {
+	return &restoreCheck{decoder: NewStreamDecoder(), pending: append([]byte(nil), input...)}
+}
+
+// input adds the next piece of the WAV input.
+func (c *restoreCheck) input(p []byte) {
+	if c.err == nil {
+		c.pending = append(c.pending, p...)
+	}
+}
+
+// Write decodes the next piece of the FLAC output and compares the WAV bytes
+// it gives back with the input.
+func (c *restoreCheck) Write(p []byte) (int, error) {
+	if c.err == nil {
+		restored, err := c.decoder.Write(p)
+		if err != nil {
+			c.err = err
+		} else {
+			c.compare(restored)
+		}
+	}
+	return len(p), nil
+}
+
+// compare checks the next restored bytes against the pending input.
+func (c *restoreCheck) compare(restored []byte) {
+	if c.err != nil {
+		return
+	}
+	for i, b := range restored {
+		if i == len(c.pending) || c.pending[i] != b {
+			c.fail(c.pos + int64(i))
+			return
+		}
+	}
+	c.pending = c.pending[len(restored):]
+	c.pos += int64(len(restored))
+}
+
+func (c *restoreCheck) fail(pos int64) {
+	c.err = &models.ConversionError{
+		Code:    models.ErrConversionFailed,
+		Message: fmt.Sprintf("Restored WAV differs from the input at byte %d", pos),
+	}
+}
+
+// finish completes the check once the output has ended. first is the
+// metadata written at its start and final the same bytes once HeaderPatch
+// has been applied: the chunks stored after the audio are taken from final,
+// as Close may have written them there, and the ones before must not have
+// changed.
+func (c *restoreCheck) finish(first, final []byte) error {
+	if c.err == nil {
+		rest, err := c.decoder.Close()
+		if err != nil {
+			return err
+		}
+		c.compare(rest[:len(rest)-len(c.decoder.suffix)])
+	}
+	if c.err != nil {
+		return c.err
+	}
+	written, _, err := parseFLACMetadata(first)
+	if err != nil {
+		return err
+	}
+	patched, _, err := parseFLACMetadata(final)
+	if err != nil {
+		return err
+	}
+	before, _, err := splitRIFF(written.riff)
+	if err != nil {
+		return err
+	}
+	prefix, suffix, err := splitRIFF(patched.riff)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(prefix, before) {
+		c.fail(int64(firstDifference(prefix, before)))
+		return c.err
+	}
+	c.compare(suffix)
+	if c.err == nil && len(c.pending) > 0 {
+		c.fail(c.pos)
+	}
+	return c.err
+}
+
+// VerifyRestore checks that RestoreWAV rebuilds wavData exactly from
+// flacData.
+func VerifyRestore(wavData, flacData []byte) error {
+	restored, err := RestoreWAV(flacData)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(restored, wavData) {
+		return nil
+	}
+	return &models.ConversionError{
+		Code:    models.ErrConversionFailed,
+		Message: fmt.Sprintf("Restored WAV differs from the input at byte %d", firstDifference(restored, wavData)),
+	}
+}
+
+// firstDifference returns the position of the first byte at which a and b
+// differ, or the length of the shorter one if it is a prefix of the other.
+func firstDifference(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"fmt"
+
+	"audio-converter/internal/models"
+)
+
+// Limits of the FLAC format.
+const (
+	maxFLACChannels   = 8
+	maxFLACSampleRate = 655350
+)
+
+// validateFormat reports whether format can be stored in a FLAC stream by the
+// native encoder. Every frame header repeats the sample rate and bit depth, so
+// both must be representable there as well as in STREAMINFO.
+func validateFormat(format models.AudioFormat) error {
+	if format.NumChannels < 1 || format.NumChannels > maxFLACChannels {
+		return unsupportedFormat("FLAC supports 1 to %d channels, got %d", maxFLACChannels, format.NumChannels)
+	}
+	if !frameSampleRate(format.SampleRate) {
+		return unsupportedFormat("FLAC cannot represent a sample rate of %d Hz", format.SampleRate)
+	}
+	switch format.BitsPerSample {
+	case 8, 12, 16, 20, 24, 32:
+	default:
+		return unsupportedFormat("FLAC encoding of %d-bit samples is not supported; use 8, 12, 16, 20, 24 or 32 bits", format.BitsPerSample)
+	}
+	return nil
+}
+
+// frameSampleRate reports whether a frame header can encode rate, either as
+// a kHz, Hz or tens-of-Hz value. The common rates all fit one of these.
+func frameSampleRate(rate int) bool {
+	switch {
+	case rate <= 0 || rate > maxFLACSampleRate:
+		return false
+	case rate <= 65535:
+		return true
+	case rate <= 255000 && rate%1000 == 0:
+		return true
+	default:
+		return rate%10 == 0
+	}
+}
+
+func unsupportedFormat(format string, args ...interface{}) error {
+	return &models.ConversionError{
+		Code:    models.ErrInvalidFormat,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
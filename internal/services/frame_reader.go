@@ -0,0 +1,517 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mewkiz/flac/frame"
+)
+
+// errIncompleteFrame is returned by readFrame and decodeFrame when data ends
+// inside the frame. Callers streaming a file should wait for more bytes and
+// try again.
+var errIncompleteFrame = errors.New("incomplete FLAC frame")
+
+// readFrame decodes the FLAC frame at the start of data into one slice of
+// samples per channel and returns the size of the frame in bytes. Frames are
+// decoded by mewkiz/flac, whose v1.0.12 reads at most 24 bits per sample:
+// frames of deeper streams, which the encoder writes for 32-bit input, go
+// through decodeFrame instead. Frame headers that leave the bit depth to
+// STREAMINFO use streamBPS.
+func readFrame(data []byte, streamBPS uint) ([][]int32, int, error) {
+	if streamBPS > 24 {
+		return decodeFrame(data, streamBPS)
+	}
+	r := bytes.NewReader(data)
+	f, err := frame.New(r)
+	if err == nil {
+		if f.BitsPerSample == 0 {
+			f.BitsPerSample = uint8(streamBPS)
+		}
+		err = f.Parse()
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, 0, errIncompleteFrame
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	block := make([][]int32, len(f.Subframes))
+	for ch, subframe := range f.Subframes {
+		block[ch] = subframe.Samples
+	}
+	return block, len(data) - r.Len(), nil
+}
+
+// frameReader decodes the frames of a FLAC stream that arrives in pieces.
+// Once the frame at the start of the input has turned out incomplete, it is
+// only decoded again when a sync code that may start the next frame has
+// arrived, or when the stream has ended: a frame sent in many small messages
+// is not decoded from its first byte for each of them.
+type frameReader struct {
+	bps uint
+	// waiting is set while the frame at the start of the input is
+	// incomplete; scan is where the search for the next sync code resumes.
+	waiting bool
+	scan    int
+}
+
+// next decodes the frame at the start of data like readFrame. final is set
+// once the stream has ended, so the last frame has no sync code after it.
+func (fr *frameReader) next(data []byte, final bool) ([][]int32, int, error) {
+	if fr.waiting && !final {
+		i := syncIndex(data, fr.scan)
+		if i < 0 {
+			// The first byte of a sync code may end the data
+			if len(data)-1 > fr.scan {
+				fr.scan = len(data) - 1
+			}
+			return nil, 0, errIncompleteFrame
+		}
+		fr.scan = i + 1
+	}
+	block, n, err := readFrame(data, fr.bps)
+	if err == errIncompleteFrame {
+		if !fr.waiting {
+			fr.waiting = true
+			fr.scan = max(len(data)-1, 1)
+		}
+		return nil, 0, err
+	}
+	fr.waiting = false
+	return block, n, err
+}
+
+// syncIndex returns the position of the first frame sync code in data at or
+// after from, or -1 if there is none.
+func syncIndex(data []byte, from int) int {
+	for i := from; i+1 < len(data); i++ {
+		j := bytes.IndexByte(data[i:len(data)-1], 0xFF)
+		if j < 0 {
+			return -1
+		}
+		i += j
+		if data[i+1]&0xFE == 0xF8 {
+			return i
+		}
+	}
+	return -1
+}
+
+// bitReader reads big-endian bit fields from a byte slice, reporting
+// errIncompleteFrame when the slice runs out.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (br *bitReader) read(n uint) (uint64, error) {
+	if br.pos+int(n) > len(br.data)*8 {
+		return 0, errIncompleteFrame
+	}
+	var v uint64
+	for n > 0 {
+		avail := 8 - uint(br.pos&7)
+		take := avail
+		if n < take {
+			take = n
+		}
+		b := uint64(br.data[br.pos>>3]>>(avail-take)) & (1<<take - 1)
+		v = v<<take | b
+		n -= take
+		br.pos += int(take)
+	}
+	return v, nil
+}
+
+// readSigned reads an n-bit two's complement value.
+func (br *bitReader) readSigned(n uint) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	v, err := br.read(n)
+	if err != nil {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), nil
+}
+
+// readUnary counts the zero bits before the next one bit.
+func (br *bitReader) readUnary() (uint64, error) {
+	var n uint64
+	for {
+		if br.pos >= len(br.data)*8 {
+			return 0, errIncompleteFrame
+		}
+		// Skip whole zero bytes at once
+		if br.pos&7 == 0 && br.data[br.pos>>3] == 0 {
+			n += 8
+			br.pos += 8
+			continue
+		}
+		bit := br.data[br.pos>>3] >> (7 - uint(br.pos&7)) & 1
+		br.pos++
+		if bit == 1 {
+			return n, nil
+		}
+		n++
+	}
+}
+
+func (br *bitReader) align() {
+	br.pos = (br.pos + 7) &^ 7
+}
+
+// frameHeader holds the fields of a frame header that decoding depends on.
+type frameHeader struct {
+	blockSize     int
+	channels      int
+	assignment    uint64
+	bitsPerSample uint
+}
+
+// decodeFrame is the decoder behind readFrame for streams of more than 24
+// bits per sample, which mewkiz/flac cannot decode. It returns the same
+// results. Checksum mismatches and invalid fields are reported as plain
+// errors.
+func decodeFrame(data []byte, streamBPS uint) ([][]int32, int, error) {
+	if len(data) < 2 {
+		return nil, 0, errIncompleteFrame
+	}
+	if data[0] != 0xFF || data[1]&0xFE != 0xF8 {
+		return nil, 0, errors.New("lost frame sync")
+	}
+	br := &bitReader{data: data}
+	hdr, err := decodeFrameHeader(br, streamBPS)
+	if err != nil {
+		return nil, 0, err
+	}
+	crc, err := br.read(8)
+	if err != nil {
+		return nil, 0, err
+	}
+	if byte(crc) != crc8(data[:br.pos/8-1]) {
+		return nil, 0, errors.New("frame header checksum mismatch")
+	}
+
+	subframes := make([][]int64, hdr.channels)
+	for ch := range subframes {
+		bps := hdr.bitsPerSample
+		// The side channel needs one more bit than the others
+		if (hdr.assignment == 8 && ch == 1) || (hdr.assignment == 9 && ch == 0) || (hdr.assignment == 10 && ch == 1) {
+			bps++
+		}
+		if subframes[ch], err = decodeSubframe(br, bps, hdr.blockSize); err != nil {
+			return nil, 0, err
+		}
+	}
+	br.align()
+	end := br.pos / 8
+	footer, err := br.read(16)
+	if err != nil {
+		return nil, 0, err
+	}
+	if uint16(footer) != crc16(data[:end]) {
+		return nil, 0, errors.New("frame checksum mismatch")
+	}
+	return decorrelate(subframes, hdr.assignment), end + 2, nil
+}
+
+func decodeFrameHeader(br *bitReader, streamBPS uint) (frameHeader, error) {
+	var hdr frameHeader
+	// Sync code, reserved bit and blocking strategy were checked by the caller
+	if _, err := br.read(16); err != nil {
+		return hdr, err
+	}
+	fields, err := br.read(16)
+	if err != nil {
+		return hdr, err
+	}
+	blockCode := fields >> 12
+	rateCode := fields >> 8 & 0xF
+	hdr.assignment = fields >> 4 & 0xF
+	bpsCode := fields >> 1 & 0x7
+	if fields&1 != 0 {
+		return hdr, errors.New("reserved frame header bit is set")
+	}
+
+	switch {
+	case hdr.assignment < 8:
+		hdr.channels = int(hdr.assignment) + 1
+	case hdr.assignment <= 10:
+		hdr.channels = 2
+	default:
+		return hdr, fmt.Errorf("reserved channel assignment %d", hdr.assignment)
+	}
+	depths := [...]uint{0, 8, 12, 0, 16, 20, 24, 32}
+	switch bpsCode {
+	case 0:
+		hdr.bitsPerSample = streamBPS
+	case 3:
+		return hdr, errors.New("reserved bits per sample code")
+	default:
+		hdr.bitsPerSample = depths[bpsCode]
+	}
+
+	// The frame or sample number is coded like a UTF-8 code point
+	first, err := br.read(8)
+	if err != nil {
+		return hdr, err
+	}
+	extra := 0
+	for mask := uint64(0x80); first&mask != 0; mask >>= 1 {
+		extra++
+	}
+	if extra == 1 || extra > 7 {
+		return hdr, errors.New("invalid coded frame number")
+	}
+	if extra > 0 {
+		extra--
+	}
+	for i := 0; i < extra; i++ {
+		b, err := br.read(8)
+		if err != nil {
+			return hdr, err
+		}
+		if b&0xC0 != 0x80 {
+			return hdr, errors.New("invalid coded frame number")
+		}
+	}
+
+	switch {
+	case blockCode == 0:
+		return hdr, errors.New("reserved block size code")
+	case blockCode == 1:
+		hdr.blockSize = 192
+	case blockCode <= 5:
+		hdr.blockSize = 576 << (blockCode - 2)
+	case blockCode == 6 || blockCode == 7:
+		n, err := br.read(uint(8 * (blockCode - 5)))
+		if err != nil {
+			return hdr, err
+		}
+		hdr.blockSize = int(n) + 1
+	default:
+		hdr.blockSize = 256 << (blockCode - 8)
+	}
+
+	switch rateCode {
+	case 12:
+		_, err = br.read(8)
+	case 13, 14:
+		_, err = br.read(16)
+	case 15:
+		err = errors.New("invalid sample rate code")
+	}
+	return hdr, err
+}
+
+// fixedCoeffs are the predictor coefficients of the fixed subframe orders.
+var fixedCoeffs = [...][]int64{
+	{},
+	{1},
+	{2, -1},
+	{3, -3, 1},
+	{4, -6, 4, -1},
+}
+
+func decodeSubframe(br *bitReader, bps uint, n int) ([]int64, error) {
+	hdr, err := br.read(8)
+	if err != nil {
+		return nil, err
+	}
+	if hdr&0x80 != 0 {
+		return nil, errors.New("subframe padding bit is set")
+	}
+	typ := hdr >> 1 & 0x3F
+	var wasted uint
+	if hdr&1 != 0 {
+		k, err := br.readUnary()
+		if err != nil {
+			return nil, err
+		}
+		wasted = uint(k) + 1
+		if wasted >= bps {
+			return nil, errors.New("wasted bits exceed the bit depth")
+		}
+		bps -= wasted
+	}
+
+	samples := make([]int64, n)
+	switch {
+	case typ == 0:
+		v, err := br.readSigned(bps)
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i] = v
+		}
+	case typ == 1:
+		for i := range samples {
+			if samples[i], err = br.readSigned(bps); err != nil {
+				return nil, err
+			}
+		}
+	case typ >= 8 && typ <= 12:
+		order := int(typ - 8)
+		if err := readWarmUp(br, samples, order, bps); err != nil {
+			return nil, err
+		}
+		if err := decodeResiduals(br, samples, order); err != nil {
+			return nil, err
+		}
+		predict(samples, fixedCoeffs[order], 0)
+	case typ >= 32:
+		order := int(typ - 31)
+		if err := readWarmUp(br, samples, order, bps); err != nil {
+			return nil, err
+		}
+		prec, err := br.read(4)
+		if err != nil {
+			return nil, err
+		}
+		if prec == 15 {
+			return nil, errors.New("invalid LPC coefficient precision")
+		}
+		shift, err := br.readSigned(5)
+		if err != nil {
+			return nil, err
+		}
+		if shift < 0 {
+			return nil, errors.New("negative LPC shift")
+		}
+		coeffs := make([]int64, order)
+		for i := range coeffs {
+			if coeffs[i], err = br.readSigned(uint(prec) + 1); err != nil {
+				return nil, err
+			}
+		}
+		if err := decodeResiduals(br, samples, order); err != nil {
+			return nil, err
+		}
+		predict(samples, coeffs, uint(shift))
+	default:
+		return nil, fmt.Errorf("reserved subframe type %d", typ)
+	}
+
+	if wasted > 0 {
+		for i := range samples {
+			samples[i] <<= wasted
+		}
+	}
+	return samples, nil
+}
+
+func readWarmUp(br *bitReader, samples []int64, order int, bps uint) error {
+	if order > len(samples) {
+		return errors.New("predictor order exceeds the block size")
+	}
+	var err error
+	for i := 0; i < order; i++ {
+		if samples[i], err = br.readSigned(bps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeResiduals reads the Rice-coded residuals of a predicted subframe into
+// samples after the warm-up samples.
+func decodeResiduals(br *bitReader, samples []int64, order int) error {
+	method, err := br.read(2)
+	if err != nil {
+		return err
+	}
+	if method > 1 {
+		return fmt.Errorf("reserved residual coding method %d", method)
+	}
+	paramLen, escape := uint(4), uint64(15)
+	if method == 1 {
+		paramLen, escape = 5, 31
+	}
+	partOrder, err := br.read(4)
+	if err != nil {
+		return err
+	}
+	partSize := len(samples) >> partOrder
+	if partSize<<partOrder != len(samples) || partSize < order {
+		return errors.New("invalid residual partition order")
+	}
+
+	pos := order
+	for p := 0; p < 1<<partOrder; p++ {
+		end := (p + 1) * partSize
+		k, err := br.read(paramLen)
+		if err != nil {
+			return err
+		}
+		if k == escape {
+			bits, err := br.read(5)
+			if err != nil {
+				return err
+			}
+			for ; pos < end; pos++ {
+				if samples[pos], err = br.readSigned(uint(bits)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		for ; pos < end; pos++ {
+			q, err := br.readUnary()
+			if err != nil {
+				return err
+			}
+			r, err := br.read(uint(k))
+			if err != nil {
+				return err
+			}
+			u := q<<k | r
+			samples[pos] = int64(u>>1) ^ -int64(u&1)
+		}
+	}
+	return nil
+}
+
+// predict replaces the residuals following the warm-up samples with the
+// samples they encode.
+func predict(samples []int64, coeffs []int64, shift uint) {
+	order := len(coeffs)
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, c := range coeffs {
+			sum += c * samples[i-1-j]
+		}
+		samples[i] += sum >> shift
+	}
+}
+
+// decorrelate undoes the stereo decorrelation of a frame's channels.
+func decorrelate(subframes [][]int64, assignment uint64) [][]int32 {
+	out := make([][]int32, len(subframes))
+	for ch := range out {
+		out[ch] = make([]int32, len(subframes[ch]))
+	}
+	for i := range subframes[0] {
+		switch assignment {
+		case 8: // left, side
+			left, side := subframes[0][i], subframes[1][i]
+			out[0][i], out[1][i] = int32(left), int32(left-side)
+		case 9: // side, right
+			side, right := subframes[0][i], subframes[1][i]
+			out[0][i], out[1][i] = int32(side+right), int32(right)
+		case 10: // mid, side
+			mid, side := subframes[0][i], subframes[1][i]
+			mid = mid<<1 | side&1
+			out[0][i], out[1][i] = int32((mid+side)>>1), int32((mid-side)>>1)
+		default:
+			for ch := range subframes {
+				out[ch][i] = int32(subframes[ch][i])
+			}
+		}
+	}
+	return out
+}
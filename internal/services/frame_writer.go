@@ -0,0 +1,273 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/icza/bitio"
+	"github.com/mewkiz/flac/frame"
+)
+
+// encodeFrame serializes a frame built by buildFrame. mewkiz/flac's frame
+// writer stops at 24 bits per sample, so 32-bit streams are written here,
+// following RFC 9639. Only independently coded channels are supported, which
+// is all buildFrame produces at 32 bits.
+func encodeFrame(f *frame.Frame, num uint64) ([]byte, error) {
+	if f.Channels > frame.ChannelsLRCLfeLsRsSlSr {
+		return nil, errors.New("inter-channel decorrelation is not supported above 24 bits")
+	}
+
+	// Writes to a bytes.Buffer cannot fail, so only errors in the frame
+	// itself are reported below
+	var buf bytes.Buffer
+	bw := bitio.NewWriter(&buf)
+	if err := encodeFrameHeader(bw, f, num); err != nil {
+		return nil, err
+	}
+	if _, err := bw.Align(); err != nil {
+		return nil, err
+	}
+	buf.WriteByte(crc8(buf.Bytes()))
+
+	for _, subframe := range f.Subframes {
+		if err := encodeSubframe(bw, subframe, uint(f.BitsPerSample)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := bw.Align(); err != nil {
+		return nil, err
+	}
+	crc := crc16(buf.Bytes())
+	buf.WriteByte(byte(crc >> 8))
+	buf.WriteByte(byte(crc))
+	return buf.Bytes(), nil
+}
+
+func encodeFrameHeader(bw *bitio.Writer, f *frame.Frame, num uint64) error {
+	blockCode, blockSuffix, blockSuffixLen := blockSizeCode(int(f.BlockSize))
+	rateCode, rateSuffix, rateSuffixLen, err := sampleRateCode(f.SampleRate)
+	if err != nil {
+		return err
+	}
+	bpsCode, err := bitsPerSampleCode(f.BitsPerSample)
+	if err != nil {
+		return err
+	}
+
+	// Sync code, a reserved bit and the fixed blocking strategy
+	bw.WriteBits(0x3FFE<<2, 16)
+	bw.WriteBits(blockCode, 4)
+	bw.WriteBits(rateCode, 4)
+	bw.WriteBits(uint64(f.Channels), 4)
+	bw.WriteBits(bpsCode, 3)
+	bw.WriteBits(0, 1)
+	for _, b := range utf8Number(num) {
+		bw.WriteByte(b)
+	}
+	bw.WriteBits(blockSuffix, blockSuffixLen)
+	return bw.WriteBits(rateSuffix, rateSuffixLen)
+}
+
+// blockSizeCode returns the 4-bit block size code of a frame header and the
+// value that follows the coded number, if any.
+func blockSizeCode(n int) (code, suffix uint64, suffixLen uint8) {
+	switch n {
+	case 192:
+		return 1, 0, 0
+	case 576, 1152, 2304, 4608:
+		return uint64(1 + bits.Len(uint(n/576))), 0, 0
+	case 256, 512, 1024, 2048, 4096, 8192, 16384, 32768:
+		return uint64(7 + bits.Len(uint(n/256))), 0, 0
+	}
+	if n <= 256 {
+		return 6, uint64(n - 1), 8
+	}
+	return 7, uint64(n - 1), 16
+}
+
+// sampleRateCode returns the 4-bit sample rate code of a frame header and the
+// value that follows the block size, if any.
+func sampleRateCode(rate uint32) (code, suffix uint64, suffixLen uint8, err error) {
+	common := map[uint32]uint64{
+		88200: 1, 176400: 2, 192000: 3, 8000: 4, 16000: 5, 22050: 6,
+		24000: 7, 32000: 8, 44100: 9, 48000: 10, 96000: 11,
+	}
+	if code, ok := common[rate]; ok {
+		return code, 0, 0, nil
+	}
+	switch {
+	case rate <= 255000 && rate%1000 == 0:
+		return 12, uint64(rate / 1000), 8, nil
+	case rate <= 65535:
+		return 13, uint64(rate), 16, nil
+	case rate <= maxFLACSampleRate && rate%10 == 0:
+		return 14, uint64(rate / 10), 16, nil
+	}
+	return 0, 0, 0, fmt.Errorf("unable to encode sample rate %d", rate)
+}
+
+func bitsPerSampleCode(bps uint8) (uint64, error) {
+	codes := map[uint8]uint64{8: 1, 12: 2, 16: 4, 20: 5, 24: 6, 32: 7}
+	code, ok := codes[bps]
+	if !ok {
+		return 0, fmt.Errorf("unable to encode %d bits per sample", bps)
+	}
+	return code, nil
+}
+
+// utf8Number encodes a frame number the way UTF-8 encodes code points,
+// extended to 36 bits.
+func utf8Number(n uint64) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	size := 2
+	for n >= 1<<(5*size+1) {
+		size++
+	}
+	out := make([]byte, size)
+	for i := size - 1; i > 0; i-- {
+		out[i] = 0x80 | byte(n&0x3F)
+		n >>= 6
+	}
+	out[0] = byte(0xFF<<(8-size)) | byte(n)
+	return out
+}
+
+func encodeSubframe(bw *bitio.Writer, subframe *frame.Subframe, bps uint) error {
+	hdr := subframe.SubHeader
+	var typ uint64
+	switch hdr.Pred {
+	case frame.PredConstant:
+		typ = 0
+	case frame.PredVerbatim:
+		typ = 1
+	case frame.PredFixed:
+		typ = 0x08 | uint64(hdr.Order)
+	case frame.PredFIR:
+		typ = 0x20 | uint64(hdr.Order-1)
+	default:
+		return fmt.Errorf("unknown prediction method %v", hdr.Pred)
+	}
+	// A zero padding bit precedes the 6-bit type
+	bw.WriteBits(typ, 7)
+	if hdr.Wasted > 0 {
+		bw.WriteBool(true)
+		writeUnary(bw, uint64(hdr.Wasted-1))
+	} else {
+		bw.WriteBool(false)
+	}
+
+	samples := subframe.Samples
+	if hdr.Wasted > 0 {
+		samples = make([]int32, len(subframe.Samples))
+		for i, s := range subframe.Samples {
+			samples[i] = s >> hdr.Wasted
+		}
+	}
+	bps -= hdr.Wasted
+
+	switch hdr.Pred {
+	case frame.PredConstant:
+		return bw.WriteBits(uint64(samples[0]), uint8(bps))
+	case frame.PredVerbatim:
+		for _, s := range samples {
+			bw.WriteBits(uint64(s), uint8(bps))
+		}
+		return nil
+	}
+
+	for _, s := range samples[:hdr.Order] {
+		bw.WriteBits(uint64(s), uint8(bps))
+	}
+	var (
+		coeffs []int32
+		shift  int32
+	)
+	if hdr.Pred == frame.PredFixed {
+		coeffs = frame.FixedCoeffs[hdr.Order]
+	} else {
+		bw.WriteBits(uint64(hdr.CoeffPrec-1), 4)
+		bw.WriteBits(uint64(hdr.CoeffShift), 5)
+		for _, c := range hdr.Coeffs {
+			bw.WriteBits(uint64(c), uint8(hdr.CoeffPrec))
+		}
+		coeffs, shift = hdr.Coeffs, hdr.CoeffShift
+	}
+	residuals := make([]int32, len(samples)-hdr.Order)
+	if !computeResiduals(samples, coeffs, shift, residuals) {
+		return errors.New("residual does not fit in 32 bits")
+	}
+	return encodeResiduals(bw, hdr, residuals, len(samples))
+}
+
+func encodeResiduals(bw *bitio.Writer, hdr frame.SubHeader, residuals []int32, blockSize int) error {
+	paramLen := uint8(4)
+	if hdr.ResidualCodingMethod == frame.ResidualCodingMethodRice2 {
+		paramLen = 5
+	}
+	rice := hdr.RiceSubframe
+	bw.WriteBits(uint64(hdr.ResidualCodingMethod), 2)
+	bw.WriteBits(uint64(rice.PartOrder), 4)
+
+	pos := 0
+	for i, partition := range rice.Partitions {
+		count := blockSize >> uint(rice.PartOrder)
+		if i == 0 {
+			count -= hdr.Order
+		}
+		k := partition.Param
+		bw.WriteBits(uint64(k), paramLen)
+		for _, r := range residuals[pos : pos+count] {
+			u := uint64(zigzag(r))
+			writeUnary(bw, u>>k)
+			bw.WriteBits(u, uint8(k))
+		}
+		pos += count
+	}
+	return nil
+}
+
+// writeUnary writes n zero bits followed by a one bit.
+func writeUnary(bw *bitio.Writer, n uint64) {
+	for ; n >= 64; n -= 64 {
+		bw.WriteBits(0, 64)
+	}
+	bw.WriteBits(1, uint8(n+1))
+}
+
+// crc8 computes the frame header checksum: polynomial x^8 + x^2 + x + 1,
+// initialized with 0.
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crc16 computes the frame checksum: polynomial x^16 + x^15 + x^2 + 1,
+// initialized with 0.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
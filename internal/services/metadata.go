@@ -0,0 +1,245 @@
+package services
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/mewkiz/flac/meta"
+
+	"audio-converter/internal/models"
+	"audio-converter/pkg/utils"
+)
+
+// vendorString identifies the encoder in VORBIS_COMMENT blocks.
+const vendorString = "audio-converter"
+
+// channelMaskTag records a WAV channel mask that FLAC's channel assignment
+// cannot express, using the name the reference encoder reads and writes.
+const channelMaskTag = "WAVEFORMATEXTENSIBLE_CHANNEL_MASK"
+
+// infoTags maps LIST/INFO fields to Vorbis comment names. Fields without a
+// common equivalent are kept as RIFF_INFO_<ID>.
+var infoTags = map[string]string{
+	"IARL": "ARCHIVAL_LOCATION",
+	"IART": "ARTIST",
+	"ICMS": "COMMISSIONED",
+	"ICMT": "COMMENT",
+	"ICOP": "COPYRIGHT",
+	"ICRD": "DATE",
+	"IENG": "ENGINEER",
+	"IGNR": "GENRE",
+	"IKEY": "KEYWORDS",
+	"ILNG": "LANGUAGE",
+	"IMED": "SOURCEMEDIA",
+	"INAM": "TITLE",
+	"IPRD": "ALBUM",
+	"ISBJ": "SUBJECT",
+	"ISFT": "SOFTWARE",
+	"ISRC": "SOURCE",
+	"ITCH": "ENCODED_BY",
+	"ITRK": "TRACKNUMBER",
+}
+
+// bextLoudnessUnset marks a version 2 bext loudness field that was not
+// measured.
+const bextLoudnessUnset = 0x7FFF
+
+// headerMetadata returns the metadata blocks describing a WAV header that
+// STREAMINFO cannot hold. chunks holds the header's chunks and, for a complete
+// file, those after the data chunk.
+func headerMetadata(header *utils.WAVHeader, chunks []utils.Chunk) []*meta.Block {
+	var tags [][2]string
+	for _, chunk := range chunks {
+		tags = append(tags, chunkTags(chunk)...)
+	}
+	if !utils.IsFLACChannelLayout(header.ChannelMask, header.Format.NumChannels) {
+		tags = append(tags, [2]string{channelMaskTag, fmt.Sprintf("0x%04X", header.ChannelMask)})
+	}
+	if header.DSD != nil {
+		tags = append(tags, dsdTags(header)...)
+	}
+
+	var blocks []*meta.Block
+	if len(tags) > 0 {
+		blocks = append(blocks, vorbisCommentBlock(tags))
+	}
+	// The lead-out track needs the length of the audio
+	if header.DataSize != utils.UnknownDataSize {
+		totalSamples := uint64(header.DataSize) / uint64(header.BlockAlign)
+		if block := cueSheetBlock(cuePoints(chunks), totalSamples); block != nil {
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// cuePoints returns the cue points of a WAV file with their labels, in the
+// order of their offsets.
+func cuePoints(chunks []utils.Chunk) []models.CuePoint {
+	var cues []models.CuePoint
+	labels := make(map[uint32]string)
+	for _, chunk := range chunks {
+		switch chunk.ID {
+		case "cue ":
+			cues = append(cues, utils.ParseCueChunk(chunk.Data)...)
+		case "LIST":
+			for id, label := range utils.ParseCueLabels(chunk.Data) {
+				labels[id] = label
+			}
+		}
+	}
+	for i := range cues {
+		cues[i].Label = labels[cues[i].ID]
+	}
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Offset < cues[j].Offset })
+	return cues
+}
+
+// sampleLoops returns the loops of a WAV file's smpl chunks.
+func sampleLoops(chunks []utils.Chunk) []models.SampleLoop {
+	var loops []models.SampleLoop
+	for _, chunk := range chunks {
+		if chunk.ID == "smpl" {
+			loops = append(loops, utils.ParseSamplerChunk(chunk.Data)...)
+		}
+	}
+	return loops
+}
+
+// maxCueSheetTracks is the number of tracks a non-CD CUESHEET numbers, 255
+// being the lead-out.
+const maxCueSheetTracks = 254
+
+// cueSheetBlock builds a non-CD CUESHEET with a track starting at each cue
+// point inside the audio, or returns nil when there are none.
+func cueSheetBlock(cues []models.CuePoint, totalSamples uint64) *meta.Block {
+	var tracks []meta.CueSheetTrack
+	for _, cue := range cues {
+		if cue.Offset >= totalSamples || len(tracks) == maxCueSheetTracks {
+			break
+		}
+		tracks = append(tracks, meta.CueSheetTrack{
+			Offset:   cue.Offset,
+			Num:      uint8(len(tracks) + 1),
+			IsAudio:  true,
+			Indicies: []meta.CueSheetTrackIndex{{Num: 1}},
+		})
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	tracks = append(tracks, meta.CueSheetTrack{Offset: totalSamples, Num: 255, IsAudio: true})
+
+	length := 128 + 8 + 259 + 1
+	for _, track := range tracks {
+		length += 36 + 12*len(track.Indicies)
+	}
+	return &meta.Block{
+		Header: meta.Header{Type: meta.TypeCueSheet, Length: int64(length)},
+		Body:   &meta.CueSheet{Tracks: tracks},
+	}
+}
+
+// vorbisCommentBlock builds a VORBIS_COMMENT block holding tags.
+func vorbisCommentBlock(tags [][2]string) *meta.Block {
+	length := 4 + len(vendorString) + 4
+	for _, tag := range tags {
+		length += 4 + len(tag[0]) + 1 + len(tag[1])
+	}
+	return &meta.Block{
+		Header: meta.Header{Type: meta.TypeVorbisComment, Length: int64(length)},
+		Body:   &meta.VorbisComment{Vendor: vendorString, Tags: tags},
+	}
+}
+
+// chunkTags returns the Vorbis comments for the metadata in a WAV or AIFF
+// chunk.
+func chunkTags(chunk utils.Chunk) [][2]string {
+	var tags [][2]string
+	add := func(name, value string) {
+		if value != "" {
+			tags = append(tags, [2]string{name, value})
+		}
+	}
+	switch chunk.ID {
+	case "LIST":
+		for _, info := range utils.ParseInfoList(chunk.Data) {
+			name, ok := infoTags[info.ID]
+			if !ok {
+				if !validFieldName(info.ID) {
+					continue
+				}
+				name = "RIFF_INFO_" + info.ID
+			}
+			add(name, info.Value)
+		}
+	case "bext":
+		ext := utils.ParseBroadcastExtension(chunk.Data)
+		if ext == nil {
+			return nil
+		}
+		add("BWF_DESCRIPTION", ext.Description)
+		add("BWF_ORIGINATOR", ext.Originator)
+		add("BWF_ORIGINATOR_REFERENCE", ext.OriginatorReference)
+		add("BWF_ORIGINATION_DATE", ext.OriginationDate)
+		add("BWF_ORIGINATION_TIME", ext.OriginationTime)
+		add("BWF_TIME_REFERENCE", strconv.FormatUint(ext.TimeReference, 10))
+		add("BWF_VERSION", strconv.Itoa(int(ext.Version)))
+		if ext.UMID != nil {
+			add("BWF_UMID", hex.EncodeToString(ext.UMID))
+		}
+		if ext.Version >= 2 {
+			for _, field := range []struct {
+				name  string
+				value int16
+			}{
+				{"BWF_LOUDNESS_VALUE", ext.LoudnessValue},
+				{"BWF_LOUDNESS_RANGE", ext.LoudnessRange},
+				{"BWF_MAX_TRUE_PEAK_LEVEL", ext.MaxTruePeakLevel},
+				{"BWF_MAX_MOMENTARY_LOUDNESS", ext.MaxMomentaryLoudness},
+				{"BWF_MAX_SHORT_TERM_LOUDNESS", ext.MaxShortTermLoudness},
+			} {
+				if field.value != bextLoudnessUnset {
+					add(field.name, fmt.Sprintf("%.2f", float64(field.value)/100))
+				}
+			}
+		}
+		add("BWF_CODING_HISTORY", ext.CodingHistory)
+	case "iXML":
+		add("IXML", utils.ParseIXML(chunk.Data))
+	case "NAME":
+		add("TITLE", utils.ParseAIFFText(chunk.Data))
+	case "AUTH":
+		add("ARTIST", utils.ParseAIFFText(chunk.Data))
+	case "ANNO":
+		add("COMMENT", utils.ParseAIFFText(chunk.Data))
+	case "(c) ":
+		add("COPYRIGHT", utils.ParseAIFFText(chunk.Data))
+	case "smpl":
+		for i, loop := range utils.ParseSamplerChunk(chunk.Data) {
+			if i == 0 {
+				add("LOOPSTART", strconv.FormatUint(loop.Start, 10))
+				add("LOOPLENGTH", strconv.FormatUint(loop.End-loop.Start+1, 10))
+			}
+			prefix := fmt.Sprintf("SMPL_LOOP%d_", i+1)
+			add(prefix+"START", strconv.FormatUint(loop.Start, 10))
+			add(prefix+"END", strconv.FormatUint(loop.End, 10))
+			add(prefix+"TYPE", loop.Type)
+			add(prefix+"PLAY_COUNT", strconv.FormatUint(uint64(loop.PlayCount), 10))
+		}
+	}
+	return tags
+}
+
+// validFieldName reports whether name may be used as a Vorbis comment field
+// name: printable ASCII other than '='.
+func validFieldName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < 0x20 || name[i] > 0x7D || name[i] == '=' {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,252 @@
+package services
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+)
+
+// Ogg page header flags.
+const (
+	oggContinued = 0x01
+	oggBOS       = 0x02
+	oggEOS       = 0x04
+)
+
+// oggPageHeaderSize is the size of an Ogg page header before its lacing
+// values.
+const oggPageHeaderSize = 27
+
+// oggNoGranule is the granule position of a page on which no packet ends.
+const oggNoGranule = ^uint64(0)
+
+// oggStreamInfoOffset is the position of the STREAMINFO body in an Ogg FLAC
+// stream: the first page holds the 51-byte mapping header packet in a single
+// segment, and STREAMINFO follows the packet's 13-byte prefix and the metadata
+// block header.
+const oggStreamInfoOffset = oggPageHeaderSize + 1 + 13 + 4
+
+// frameSink is implemented by destinations of a flacWriter that need to know
+// where each frame ends.
+type frameSink interface {
+	// endFrame is called after each frame with the number of samples per
+	// channel it holds.
+	endFrame(samples int) error
+	// close is called once the last frame has been written.
+	close() error
+}
+
+// oggWriter wraps the native FLAC stream written through it in Ogg pages, as
+// described by the Ogg FLAC mapping of RFC 5334. The signature and
+// STREAMINFO become the first header packet, each further metadata block its
+// own header packet, and each frame one audio packet. The last frame is held
+// back until close so that its page can carry the end-of-stream flag.
+type oggWriter struct {
+	dest   io.Writer
+	serial uint32
+	seq    uint32
+	// header buffers the native stream until its last metadata block.
+	header     []byte
+	headerDone bool
+	frame      []byte
+	granule    uint64
+	held       []byte
+	closed     bool
+}
+
+func newOggWriter(dest io.Writer) *oggWriter {
+	return &oggWriter{dest: dest, serial: rand.Uint32()}
+}
+
+// Write consumes bytes of the native FLAC stream.
+func (o *oggWriter) Write(p []byte) (int, error) {
+	if o.headerDone {
+		o.frame = append(o.frame, p...)
+		return len(p), nil
+	}
+	o.header = append(o.header, p...)
+	blocks, rest, err := splitMetadata(o.header)
+	if err != nil || blocks == nil {
+		return len(p), err
+	}
+	o.headerDone = true
+	o.header = nil
+	o.frame = append(o.frame, rest...)
+	if err := o.writeHeaders(blocks); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (o *oggWriter) endFrame(samples int) error {
+	packet := o.frame
+	o.frame = nil
+	if o.held != nil {
+		if err := o.writePacket(o.held, o.granule, 0); err != nil {
+			return err
+		}
+	}
+	o.held = packet
+	o.granule += uint64(samples)
+	return nil
+}
+
+func (o *oggWriter) close() error {
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	if o.held == nil {
+		// A stream without audio ends with an empty page
+		return o.writePage(oggEOS, o.granule, nil, nil)
+	}
+	return o.writePacket(o.held, o.granule, oggEOS)
+}
+
+// writeHeaders writes the header packets, each on pages of its own so that
+// the first audio packet starts a fresh page.
+func (o *oggWriter) writeHeaders(blocks [][]byte) error {
+	// 0x7F "FLAC", mapping version 1.0 and the number of header packets
+	// after this one
+	first := []byte{0x7F, 'F', 'L', 'A', 'C', 1, 0, 0, 0}
+	binary.BigEndian.PutUint16(first[7:9], uint16(len(blocks)-1))
+	first = append(first, flacSignature...)
+	first = append(first, blocks[0]...)
+	if err := o.writePacket(first, 0, oggBOS); err != nil {
+		return err
+	}
+	for _, block := range blocks[1:] {
+		if err := o.writePacket(block, 0, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePacket writes a packet on as many pages as its lacing values need.
+// Only the page on which the packet ends carries its granule position and
+// the end-of-stream flag.
+func (o *oggWriter) writePacket(packet []byte, granule uint64, flags byte) error {
+	// A packet is laced as 255-byte segments and a final shorter one
+	lacing := make([]byte, 0, len(packet)/255+1)
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			lacing = append(lacing, byte(n))
+			break
+		}
+		lacing = append(lacing, 255)
+	}
+	for len(lacing) > 0 {
+		segments := lacing
+		pageFlags := flags &^ oggEOS
+		pageGranule := oggNoGranule
+		if len(segments) > 255 {
+			segments = segments[:255]
+		} else {
+			pageFlags = flags
+			pageGranule = granule
+		}
+		size := 0
+		for _, n := range segments {
+			size += int(n)
+		}
+		if err := o.writePage(pageFlags, pageGranule, segments, packet[:size]); err != nil {
+			return err
+		}
+		packet = packet[size:]
+		lacing = lacing[len(segments):]
+		// Later pages continue the packet and never begin the stream
+		flags = flags&^oggBOS | oggContinued
+	}
+	return nil
+}
+
+func (o *oggWriter) writePage(flags byte, granule uint64, lacing, data []byte) error {
+	page := make([]byte, oggPageHeaderSize, oggPageHeaderSize+len(lacing)+len(data))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:14], granule)
+	binary.LittleEndian.PutUint32(page[14:18], o.serial)
+	binary.LittleEndian.PutUint32(page[18:22], o.seq)
+	page[26] = byte(len(lacing))
+	page = append(page, lacing...)
+	page = append(page, data...)
+	binary.LittleEndian.PutUint32(page[22:26], oggCRC(page))
+	o.seq++
+	_, err := o.dest.Write(page)
+	return err
+}
+
+// splitMetadata splits the signature and metadata blocks at the start of a
+// native FLAC stream into the bytes of each block, header included, and
+// returns the bytes that follow them. It returns nil blocks while the last
+// metadata block is incomplete.
+func splitMetadata(data []byte) ([][]byte, []byte, error) {
+	if len(data) < len(flacSignature) {
+		return nil, nil, nil
+	}
+	if string(data[:len(flacSignature)]) != flacSignature {
+		return nil, nil, errors.New("native stream does not start with the FLAC signature")
+	}
+	var blocks [][]byte
+	pos := len(flacSignature)
+	for pos+4 <= len(data) {
+		length := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		end := pos + 4 + length
+		if end > len(data) {
+			break
+		}
+		blocks = append(blocks, data[pos:end])
+		last := data[pos]&0x80 != 0
+		pos = end
+		if last {
+			return blocks, data[pos:], nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// patchOggStreamInfo writes a STREAMINFO body over the one on the first page
+// of an Ogg FLAC stream and updates the page's checksum.
+func patchOggStreamInfo(data, streamInfo []byte) {
+	copy(data[oggStreamInfoOffset:], streamInfo)
+	page := data[:oggPageSize(data)]
+	binary.LittleEndian.PutUint32(page[22:26], 0)
+	binary.LittleEndian.PutUint32(page[22:26], oggCRC(page))
+}
+
+// oggPageSize returns the size of the Ogg page at the start of data.
+func oggPageSize(data []byte) int {
+	size := oggPageHeaderSize + int(data[26])
+	for _, n := range data[oggPageHeaderSize : oggPageHeaderSize+int(data[26])] {
+		size += int(n)
+	}
+	return size
+}
+
+// oggCRCTable is the lookup table of the Ogg page checksum, a CRC-32 with
+// polynomial 0x04C11DB7, no reflection and a zero initial value.
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for b := 0; b < 8; b++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// oggCRC returns the checksum of a page whose checksum field is zero.
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
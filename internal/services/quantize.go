@@ -0,0 +1,193 @@
+package services
+
+import (
+	"math"
+	"math/rand"
+
+	"audio-converter/pkg/utils"
+)
+
+// Dither types for quantizing floating-point input.
+const (
+	// DitherNone rounds to the nearest integer.
+	DitherNone = "none"
+	// DitherTPDF adds triangular noise of ±1 LSB before rounding.
+	DitherTPDF = "tpdf"
+	// DitherShaped adds TPDF noise and pushes the quantization error towards
+	// high frequencies with second-order error feedback.
+	DitherShaped = "shaped"
+)
+
+// Clipping protection for samples beyond full scale.
+const (
+	// ClippingClip clamps samples to the integer range.
+	ClippingClip = "clip"
+	// ClippingNormalize scales each block of input down when its peak exceeds
+	// full scale, and maps full scale to the largest integer so normalized
+	// peaks do not clip. Streams are normalized one received block at a time.
+	ClippingNormalize = "normalize"
+)
+
+// Defaults for floating-point input.
+const (
+	DefaultFloatBitsPerSample = 24
+	DefaultDither             = DitherTPDF
+	DefaultClipping           = ClippingClip
+)
+
+// FloatOptions control how floating-point input is quantized to the integer
+// samples FLAC stores. Nil fields take their defaults.
+type FloatOptions struct {
+	BitsPerSample *int     `json:"floatBitsPerSample,omitempty"`
+	Dither        *string  `json:"dither,omitempty"`
+	Clipping      *string  `json:"clipping,omitempty"`
+	GainDB        *float64 `json:"gainDb,omitempty"`
+}
+
+// floatParams is the validated form of FloatOptions.
+type floatParams struct {
+	bitsPerSample int
+	dither        string
+	clipping      string
+	gainDB        float64
+}
+
+func defaultFloatParams() floatParams {
+	return floatParams{
+		bitsPerSample: DefaultFloatBitsPerSample,
+		dither:        DefaultDither,
+		clipping:      DefaultClipping,
+	}
+}
+
+// Merge returns a copy of o with every field set in override replacing the
+// corresponding field of o.
+func (o FloatOptions) Merge(override FloatOptions) FloatOptions {
+	if override.BitsPerSample != nil {
+		o.BitsPerSample = override.BitsPerSample
+	}
+	if override.Dither != nil {
+		o.Dither = override.Dither
+	}
+	if override.Clipping != nil {
+		o.Clipping = override.Clipping
+	}
+	if override.GainDB != nil {
+		o.GainDB = override.GainDB
+	}
+	return o
+}
+
+// Resolve validates o and returns it with every field filled in.
+func (o FloatOptions) Resolve() (FloatOptions, error) {
+	p, err := o.params()
+	if err != nil {
+		return o, err
+	}
+	return FloatOptions{
+		BitsPerSample: &p.bitsPerSample,
+		Dither:        &p.dither,
+		Clipping:      &p.clipping,
+		GainDB:        &p.gainDB,
+	}, nil
+}
+
+func (o FloatOptions) params() (floatParams, error) {
+	p := defaultFloatParams()
+	if o.BitsPerSample != nil {
+		switch *o.BitsPerSample {
+		case 16, 20, 24, 32:
+		default:
+			return p, invalidOption("floating-point input can be quantized to 16, 20, 24 or 32 bits")
+		}
+		p.bitsPerSample = *o.BitsPerSample
+	}
+	if o.Dither != nil {
+		switch *o.Dither {
+		case DitherNone, DitherTPDF, DitherShaped:
+		default:
+			return p, invalidOption("dither must be %q, %q or %q", DitherNone, DitherTPDF, DitherShaped)
+		}
+		p.dither = *o.Dither
+	}
+	if o.Clipping != nil {
+		switch *o.Clipping {
+		case ClippingClip, ClippingNormalize:
+		default:
+			return p, invalidOption("clipping must be %q or %q", ClippingClip, ClippingNormalize)
+		}
+		p.clipping = *o.Clipping
+	}
+	if o.GainDB != nil {
+		if math.IsNaN(*o.GainDB) || math.IsInf(*o.GainDB, 0) {
+			return p, invalidOption("gain must be a finite number of dB")
+		}
+		p.gainDB = *o.GainDB
+	}
+	return p, nil
+}
+
+// quantizer converts floating-point samples to integers of the target depth,
+// keeping the noise-shaping state of every channel between blocks.
+type quantizer struct {
+	params   floatParams
+	channels int
+	rng      *rand.Rand
+	// errors holds the last two quantization errors of each channel.
+	errors  [][2]float64
+	clipped uint64
+}
+
+func newQuantizer(params floatParams, channels int) *quantizer {
+	return &quantizer{
+		params:   params,
+		channels: channels,
+		// A fixed seed keeps conversions reproducible
+		rng:    rand.New(rand.NewSource(1)),
+		errors: make([][2]float64, channels),
+	}
+}
+
+// quantize converts a block of interleaved samples, full scale being -1.0 to
+// 1.0. Samples beyond the integer range are clamped; those whose signal, not
+// just the added dither, exceeded it are counted as clipped.
+func (q *quantizer) quantize(samples []float64) []int {
+	if q.params.gainDB != 0 {
+		samples = utils.ApplyGain(samples, q.params.gainDB)
+	}
+	scale := math.Ldexp(1, q.params.bitsPerSample-1)
+	max, min := scale-1, -scale
+	if q.params.clipping == ClippingNormalize {
+		samples = utils.NormalizeSamples(samples)
+		scale = max
+	}
+
+	out := make([]int, len(samples))
+	for i, x := range samples {
+		if math.IsNaN(x) {
+			x = 0
+		}
+		e := &q.errors[i%q.channels]
+		v := x * scale
+		if q.params.dither == DitherShaped {
+			// Error feedback with (1 - z^-1)^2 as noise transfer function
+			v -= 2*e[0] - e[1]
+		}
+		clipped := v >= max+0.5 || v < min-0.5
+
+		y := v
+		if q.params.dither != DitherNone {
+			y += q.rng.Float64() - q.rng.Float64()
+		}
+		y = math.Max(min, math.Min(max, math.Round(y)))
+		if clipped {
+			q.clipped++
+			// Feeding back the clipped amount would make the filter ring
+			e[0], e[1] = 0, 0
+		} else {
+			e[0], e[1] = y-v, e[0]
+		}
+		out[i] = int(y)
+	}
+	return out
+}
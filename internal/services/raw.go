@@ -0,0 +1,116 @@
+package services
+
+import (
+	"audio-converter/internal/models"
+	"audio-converter/pkg/utils"
+)
+
+// Byte orders of raw PCM input.
+const (
+	ByteOrderLittle = "little"
+	ByteOrderBig    = "big"
+)
+
+// RawOptions declare the format of headerless PCM input. Input is read as
+// raw PCM when any field is set; the sample rate, channel count and bit depth
+// are then required. The byte order defaults to little-endian, and samples
+// are signed except for 8-bit ones, as in WAV files.
+type RawOptions struct {
+	SampleRate    *int    `json:"rawSampleRate,omitempty"`
+	Channels      *int    `json:"rawChannels,omitempty"`
+	BitsPerSample *int    `json:"rawBitsPerSample,omitempty"`
+	ByteOrder     *string `json:"rawByteOrder,omitempty"`
+	Signed        *bool   `json:"rawSigned,omitempty"`
+}
+
+// rawParams is the validated form of RawOptions.
+type rawParams struct {
+	format    models.AudioFormat
+	bigEndian bool
+	signed    bool
+}
+
+// Merge returns a copy of o with every field set in override replacing the
+// corresponding field of o.
+func (o RawOptions) Merge(override RawOptions) RawOptions {
+	if override.SampleRate != nil {
+		o.SampleRate = override.SampleRate
+	}
+	if override.Channels != nil {
+		o.Channels = override.Channels
+	}
+	if override.BitsPerSample != nil {
+		o.BitsPerSample = override.BitsPerSample
+	}
+	if override.ByteOrder != nil {
+		o.ByteOrder = override.ByteOrder
+	}
+	if override.Signed != nil {
+		o.Signed = override.Signed
+	}
+	return o
+}
+
+// Resolve validates o and returns it with every field filled in, or empty
+// when the input has a header.
+func (o RawOptions) Resolve() (RawOptions, error) {
+	p, err := o.params()
+	if err != nil || p == nil {
+		return RawOptions{}, err
+	}
+	byteOrder := ByteOrderLittle
+	if p.bigEndian {
+		byteOrder = ByteOrderBig
+	}
+	return RawOptions{
+		SampleRate:    &p.format.SampleRate,
+		Channels:      &p.format.NumChannels,
+		BitsPerSample: &p.format.BitsPerSample,
+		ByteOrder:     &byteOrder,
+		Signed:        &p.signed,
+	}, nil
+}
+
+// params returns nil when no field is set.
+func (o RawOptions) params() (*rawParams, error) {
+	if o == (RawOptions{}) {
+		return nil, nil
+	}
+	if o.SampleRate == nil || o.Channels == nil || o.BitsPerSample == nil {
+		return nil, invalidOption("raw PCM input needs a sample rate, channel count and bit depth")
+	}
+	p := &rawParams{
+		format: models.AudioFormat{
+			SampleRate:    *o.SampleRate,
+			NumChannels:   *o.Channels,
+			BitsPerSample: *o.BitsPerSample,
+		},
+		signed: *o.BitsPerSample > 8,
+	}
+	switch p.format.BitsPerSample {
+	case 8, 16, 24, 32:
+	default:
+		return nil, invalidOption("raw PCM samples must be 8, 16, 24 or 32 bits")
+	}
+	if err := validateFormat(p.format); err != nil {
+		return nil, err
+	}
+	if o.ByteOrder != nil {
+		switch *o.ByteOrder {
+		case ByteOrderLittle, ByteOrderBig:
+		default:
+			return nil, invalidOption("byte order must be %q or %q", ByteOrderLittle, ByteOrderBig)
+		}
+		p.bigEndian = *o.ByteOrder == ByteOrderBig
+	}
+	if o.Signed != nil {
+		p.signed = *o.Signed
+	}
+	return p, nil
+}
+
+// header describes raw input as a file whose data starts at once and runs to
+// the end of the stream.
+func (p *rawParams) header() *utils.WAVHeader {
+	return utils.RawHeader(p.format, p.bigEndian)
+}
@@ -0,0 +1,226 @@
+package services
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sort"
+
+	"github.com/mewkiz/flac/meta"
+
+	"audio-converter/internal/models"
+	"audio-converter/pkg/utils"
+)
+
+// flacSource tracks FLAC input while it is decoded for re-encoding.
+type flacSource struct {
+	info   meta.StreamInfo
+	frames frameReader
+	// md5 is the signature of the decoded input audio.
+	md5     hash.Hash
+	samples uint64
+	// output decodes the re-encoded stream as it is written; outputErr
+	// keeps its first error.
+	output    *StreamDecoder
+	outputErr error
+	// seekTable is the carried SEEKTABLE block, whose seek points are
+	// filled in once the stream is complete.
+	seekTable *meta.Block
+}
+
+// startFLAC begins re-encoding FLAC input whose metadata blocks, signature
+// included, are data. Every block but STREAMINFO is carried over, as the new
+// stream gets its own. The seek points of a SEEKTABLE no longer apply: their
+// target samples get points to the new frames, which Close writes into the
+// metadata through HeaderPatch. Ogg FLAC is sought by granule position and
+// only its first page can be patched, so it gets no SEEKTABLE.
+func (s *StreamEncoder) startFLAC(metadata *flacMetadata, data []byte) error {
+	if s.keepForeign {
+		return unsupportedFormat("Foreign metadata can only be kept for RIFF WAV input")
+	}
+	blocks, seekTargets, err := carriedBlocks(data)
+	if err != nil {
+		return err
+	}
+	var seekTable *meta.Block
+	for i, block := range blocks {
+		if block.Type == meta.TypeSeekTable {
+			if s.container == ContainerOgg {
+				blocks = append(blocks[:i:i], blocks[i+1:]...)
+			} else {
+				seekTable = block
+			}
+			break
+		}
+	}
+	info := metadata.info
+	format := models.AudioFormat{
+		SampleRate:    int(info.SampleRate),
+		NumChannels:   int(info.NChannels),
+		BitsPerSample: int(info.BitsPerSample),
+	}
+	if err := validateFormat(format); err != nil {
+		return err
+	}
+	header := &utils.WAVHeader{
+		Form:          "FLAC",
+		Format:        format,
+		ContainerBits: format.BitsPerSample,
+		BlockAlign:    format.NumChannels * ((format.BitsPerSample + 7) / 8),
+		DataSize:      utils.UnknownDataSize,
+	}
+	s.source = &flacSource{
+		info:      info,
+		frames:    frameReader{bps: uint(info.BitsPerSample)},
+		md5:       md5.New(),
+		output:    NewStreamDecoder(),
+		seekTable: seekTable,
+	}
+	if err := s.open(header, format, blocks); err != nil {
+		return err
+	}
+	// The output is decoded from its metadata on, before it is wrapped in
+	// Ogg pages
+	s.source.Write(s.fw.header)
+	s.fw.w.copy = s.source
+	if seekTable != nil {
+		s.fw.seekTable, s.fw.seekTargets = &meta.SeekTable{}, seekTargets
+	}
+	return nil
+}
+
+// writeFLAC decodes the complete frames of the input with mewkiz/flac, or
+// decodeFrame for 32-bit input, and encodes their samples again. final is set
+// once the input has ended.
+func (s *StreamEncoder) writeFLAC(final bool) error {
+	bps := int(s.source.info.BitsPerSample)
+	for len(s.input) > 0 {
+		block, n, err := s.source.frames.next(s.input, final)
+		if err == errIncompleteFrame {
+			break
+		}
+		if err != nil {
+			return streamCorrupted("Invalid FLAC frame: %v", err)
+		}
+		if len(block) != s.format.NumChannels {
+			return streamCorrupted("FLAC frame has %d channels, STREAMINFO declares %d", len(block), s.format.NumChannels)
+		}
+		s.input = s.input[n:]
+		hashSamples(s.source.md5, block, bps)
+		s.source.samples += uint64(len(block[0]))
+
+		pcm := make([]int, 0, len(block)*len(block[0]))
+		for i := range block[0] {
+			for _, channel := range block {
+				pcm = append(pcm, int(channel[i]))
+			}
+		}
+		if err := s.encode(pcm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check compares the decoded input with the totals and MD5 signature of its
+// STREAMINFO once the input has ended with rest left over.
+func (src *flacSource) check(rest []byte) error {
+	if len(rest) > 0 {
+		return streamCorrupted("Stream ends inside a FLAC frame")
+	}
+	if src.info.NSamples != 0 && src.samples != src.info.NSamples {
+		return streamCorrupted("Decoded %d samples, STREAMINFO declares %d", src.samples, src.info.NSamples)
+	}
+	if src.info.MD5sum != [md5.Size]byte{} && !bytes.Equal(src.md5.Sum(nil), src.info.MD5sum[:]) {
+		return streamCorrupted("MD5 signature mismatch: the FLAC input is corrupted")
+	}
+	return nil
+}
+
+// Write passes the re-encoded stream to the decoder that checks it.
+func (src *flacSource) Write(p []byte) (int, error) {
+	if src.outputErr == nil {
+		_, src.outputErr = src.output.Write(p)
+	}
+	return len(p), nil
+}
+
+// finish checks the re-encoded stream, which the writer has completed, and
+// returns the metadata at its start with the final seek points, or nil when
+// there are none to write. The stream is decoded again and must give back
+// the audio of the input.
+func (src *flacSource) finish(fw *flacWriter, blocks []*meta.Block) ([]byte, error) {
+	if src.outputErr == nil {
+		_, src.outputErr = src.output.Close()
+	}
+	if err := src.outputErr; err != nil {
+		return nil, &models.ConversionError{
+			Code:    models.ErrConversionFailed,
+			Message: fmt.Sprintf("Re-encoded stream does not decode: %v", err),
+		}
+	}
+	if !bytes.Equal(src.output.md5.Sum(nil), src.md5.Sum(nil)) {
+		return nil, &models.ConversionError{
+			Code:    models.ErrConversionFailed,
+			Message: "MD5 signature of the re-encoded stream differs from the input",
+		}
+	}
+	if src.seekTable == nil {
+		return nil, nil
+	}
+	points := src.seekTable.Body.(*meta.SeekTable).Points
+	filled := append([]meta.SeekPoint(nil), fw.seekTable.Points...)
+	for len(filled) < len(points) {
+		filled = append(filled, meta.SeekPoint{SampleNum: meta.PlaceholderPoint})
+	}
+	src.seekTable.Body = &meta.SeekTable{Points: filled}
+	header, err := encodeMetadata(&fw.info, blocks)
+	if err != nil {
+		return nil, conversionFailed(err)
+	}
+	return header, nil
+}
+
+// carriedBlocks returns the metadata blocks of a FLAC stream's header that
+// are kept when it is re-encoded, VORBIS_COMMENT first as Ogg FLAC requires.
+// Blocks are copied as they are, except that the points of a SEEKTABLE become
+// placeholders; their target samples are returned in ascending order.
+func carriedBlocks(data []byte) ([]*meta.Block, []uint64, error) {
+	var comments, others []*meta.Block
+	var seekTargets []uint64
+	for pos := len(flacSignature); pos+4 <= len(data); {
+		typ := meta.Type(data[pos] & 0x7F)
+		length := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		end := pos + 4 + length
+		block := &meta.Block{Header: meta.Header{Type: typ, Length: int64(length)}, Body: rawBlock(data[pos+4 : end])}
+		switch typ {
+		case meta.TypeStreamInfo:
+		case meta.TypeVorbisComment:
+			comments = append(comments, block)
+		case meta.TypeSeekTable:
+			if length == 0 || length%seekPointSize != 0 {
+				return nil, nil, streamCorrupted("Invalid SEEKTABLE metadata block: %d bytes", length)
+			}
+			table := &meta.SeekTable{}
+			for p := pos + 4; p < end; p += seekPointSize {
+				table.Points = append(table.Points, meta.SeekPoint{SampleNum: meta.PlaceholderPoint})
+				if target := binary.BigEndian.Uint64(data[p:]); target != meta.PlaceholderPoint {
+					seekTargets = append(seekTargets, target)
+				}
+			}
+			block.Body = table
+			others = append(others, block)
+		default:
+			others = append(others, block)
+		}
+		pos = end
+	}
+	sort.Slice(seekTargets, func(i, j int) bool { return seekTargets[i] < seekTargets[j] })
+	return append(comments, others...), seekTargets, nil
+}
+
+// seekPointSize is the size of a SEEKTABLE point: sample number, byte offset
+// and sample count.
+const seekPointSize = 18
@@ -0,0 +1,604 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/mewkiz/flac/meta"
+
+	"audio-converter/internal/models"
+	"audio-converter/pkg/utils"
+)
+
+// StreamEncoder converts the WAV, AIFF, DSD or FLAC stream of a single session
+// into one continuous FLAC stream. Joining every slice returned by Write and Close,
+// in order, yields a complete FLAC or Ogg FLAC file.
+type StreamEncoder struct {
+	params    encoderParams
+	float     floatParams
+	dsd       dsdParams
+	raw       *rawParams
+	container Container
+	// source is set when the input is itself FLAC and is being re-encoded.
+	source *flacSource
+	// keepForeign stores the non-audio bytes of the WAV file in APPLICATION
+	// blocks so RestoreWAV can rebuild it.
+	keepForeign bool
+	verifier    *frameVerifier
+	header      *utils.WAVHeader
+	// format is the format of the FLAC stream, which differs from the input
+	// for floating-point and DSD samples.
+	format    models.AudioFormat
+	quant     *quantizer
+	decimator *dsdDecimator
+	fw        *flacWriter
+	// blocks are the metadata blocks written after STREAMINFO. When Close
+	// has to change more than STREAMINFO, rewritten holds the metadata
+	// again, as long as before, from streamInfoOffset to the first frame.
+	blocks    []*meta.Block
+	rewritten []byte
+	out       bytes.Buffer
+	input     []byte
+	// tail holds the bytes after the data chunk when the whole file is known
+	// up front.
+	tail []byte
+	// trailingSize counts the bytes that the header of a streamed file
+	// declares after its data chunk. Their chunks belong in the metadata at
+	// the start of the FLAC stream, which gets padding to make room for
+	// them: Close writes the metadata again with prefix, the bytes before
+	// the audio, and trailing, the bytes received after it.
+	trailingSize int64
+	prefix       []byte
+	trailing     []byte
+	// restore checks that RestoreWAV rebuilds the input when foreign
+	// metadata is kept.
+	restore *restoreCheck
+	// afterData counts the bytes received after the data chunk.
+	afterData int64
+	// remaining counts the bytes of the data chunk not yet consumed.
+	remaining int64
+	// samples counts the sample frames of the FLAC stream.
+	samples uint64
+	// bytesIn and bytesOut count the bytes received and returned.
+	bytesIn  int64
+	bytesOut int64
+	// head holds the first Ogg page, whose checksum covers STREAMINFO.
+	head   []byte
+	closed bool
+	cues   []models.CuePoint
+	loops  []models.SampleLoop
+}
+
+// NewStream starts a streaming conversion using the converter's settings.
+// Streams are always encoded in-process; the ffmpeg backend cannot produce a
+// continuous stream and only applies to ConvertChunk.
+func (c *Converter) NewStream() *StreamEncoder {
+	return &StreamEncoder{params: c.params, float: c.float, dsd: c.dsd, raw: c.raw, container: c.container, keepForeign: c.keepForeign, verifier: c.verifier}
+}
+
+// Format returns the audio format parsed from the WAV header, or nil while the
+// header has not been received yet.
+func (s *StreamEncoder) Format() *models.AudioFormat {
+	if s.header == nil {
+		return nil
+	}
+	return &s.header.Format
+}
+
+// OutputFormat returns the format of the FLAC stream, or nil while the header
+// has not been received yet.
+func (s *StreamEncoder) OutputFormat() *models.AudioFormat {
+	if s.header == nil {
+		return nil
+	}
+	return &s.format
+}
+
+// ClippedSamples returns the number of floating-point or decimated DSD
+// samples clamped to the integer range so far.
+func (s *StreamEncoder) ClippedSamples() uint64 {
+	if s.quant == nil {
+		return 0
+	}
+	return s.quant.clipped
+}
+
+// CuePoints returns the cue points of the WAV file, in the order of their
+// offsets.
+func (s *StreamEncoder) CuePoints() []models.CuePoint {
+	return s.cues
+}
+
+// Loops returns the sampler loops of the WAV file.
+func (s *StreamEncoder) Loops() []models.SampleLoop {
+	return s.loops
+}
+
+// DiscardedBytes returns the number of bytes received after the audio that
+// were not carried over into the FLAC stream. The chunks after the data chunk
+// of a streamed file arrive after its metadata has been written and are lost
+// when its header did not declare them, when they do not fit in the padding
+// reserved for them or when the output is Ogg FLAC, whose metadata pages
+// cannot be patched.
+func (s *StreamEncoder) DiscardedBytes() int64 {
+	if s.afterData == 0 || len(s.tail) > 0 || s.rewritten != nil {
+		return 0
+	}
+	// The padding after the samples holds nothing
+	return max(s.afterData-s.header.DataPadding(), 0)
+}
+
+// Samples returns the number of samples per channel encoded so far.
+func (s *StreamEncoder) Samples() uint64 {
+	return s.samples
+}
+
+// Stats returns the totals of the conversion so far.
+func (s *StreamEncoder) Stats() models.ConversionStats {
+	stats := models.ConversionStats{
+		TotalSamples:   s.samples,
+		ClippedSamples: s.ClippedSamples(),
+		CuePoints:      s.cues,
+		Loops:          s.loops,
+		DiscardedBytes: s.DiscardedBytes(),
+	}
+	stats.Clipped = stats.ClippedSamples > 0
+	if s.source != nil {
+		saved := s.bytesIn - s.bytesOut
+		stats.SizeSaved = &saved
+	}
+	if s.header != nil {
+		stats.InputFormat = s.header.Format
+		stats.OutputFormat = s.format
+	}
+	return stats
+}
+
+// StreamInfo returns the body of the STREAMINFO block with the totals counted
+// so far. The first message carries STREAMINFO before the length is known;
+// after Close this block has the final sample count and MD5 and can be
+// written over it at byte 8 of the FLAC stream.
+func (s *StreamEncoder) StreamInfo() []byte {
+	if s.fw == nil {
+		return nil
+	}
+	return s.fw.StreamInfo()
+}
+
+// HeaderPatch returns the bytes that finalize the start of the stream once
+// Close has returned, and their offset in the stream: the STREAMINFO body for
+// native FLAC, or the whole first page for Ogg FLAC. Writing them over the
+// bytes at that offset gives STREAMINFO the totals, frame sizes and MD5
+// signature of the complete stream. When the metadata after STREAMINFO
+// changes too, with the seek points of re-encoded FLAC or the chunks after a
+// streamed file's audio, the native patch runs up to the first frame.
+func (s *StreamEncoder) HeaderPatch() (int64, []byte) {
+	if s.fw == nil {
+		return 0, nil
+	}
+	if s.container == ContainerOgg {
+		page := append([]byte(nil), s.head...)
+		patchOggStreamInfo(page, s.StreamInfo())
+		return 0, page
+	}
+	if s.rewritten != nil {
+		return streamInfoOffset, s.rewritten
+	}
+	return streamInfoOffset, s.StreamInfo()
+}
+
+// Write consumes the next piece of the WAV stream and returns the FLAC bytes
+// that became available. The first non-empty result starts with the FLAC
+// signature and STREAMINFO; later results contain whole frames only. Ogg
+// output is returned in whole pages, the last frame held back until Close.
+func (s *StreamEncoder) Write(p []byte) ([]byte, error) {
+	if s.closed {
+		return nil, &models.ConversionError{
+			Code:    models.ErrStreamCorrupted,
+			Message: "Stream already closed",
+		}
+	}
+	s.input = append(s.input, p...)
+	s.bytesIn += int64(len(p))
+	if s.restore != nil {
+		s.restore.input(p)
+	}
+
+	if s.fw == nil && s.raw == nil && len(s.input) >= len(flacSignature) && string(s.input[:len(flacSignature)]) == flacSignature {
+		metadata, n, err := parseFLACMetadata(s.input)
+		if err != nil || metadata == nil {
+			return nil, err
+		}
+		if err := s.startFLAC(metadata, s.input[:n]); err != nil {
+			return nil, err
+		}
+		s.input = s.input[n:]
+	}
+	if s.source != nil {
+		if err := s.writeFLAC(false); err != nil {
+			return nil, err
+		}
+		return s.drain(), nil
+	}
+
+	if s.fw == nil {
+		header, err := s.parseHeader()
+		if err == utils.ErrIncompleteHeader {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := s.start(header); err != nil {
+			return nil, err
+		}
+		s.input = s.input[header.DataOffset:]
+	}
+
+	// Only consume whole sample frames; a partial frame waits for the next
+	// message. Anything after the data chunk is not audio.
+	n := int64(len(s.input))
+	if n > s.remaining {
+		n = s.remaining
+	}
+	n -= n % int64(s.header.BlockAlign)
+	if n > 0 {
+		pcm, err := s.decode(s.input[:n])
+		if err != nil {
+			return nil, err
+		}
+		s.input = s.input[n:]
+		s.remaining -= n
+		if err := s.encode(pcm); err != nil {
+			return nil, err
+		}
+	}
+	if s.remaining == 0 && len(s.input) > 0 {
+		s.afterData += int64(len(s.input))
+		if s.afterData <= s.trailingSize {
+			s.trailing = append(s.trailing, s.input...)
+		}
+		s.input = nil
+	}
+	return s.drain(), nil
+}
+
+// encode passes interleaved samples to the FLAC writer.
+func (s *StreamEncoder) encode(pcm []int) error {
+	s.samples += uint64(len(pcm) / s.format.NumChannels)
+	if err := s.fw.WriteInterleaved(pcm); err != nil {
+		return conversionFailed(err)
+	}
+	return nil
+}
+
+// Close encodes any buffered audio as the final frame and returns the
+// remaining FLAC bytes.
+func (s *StreamEncoder) Close() ([]byte, error) {
+	if s.closed {
+		return nil, nil
+	}
+	s.closed = true
+	if s.fw == nil {
+		return nil, &models.ConversionError{
+			Code:    models.ErrStreamCorrupted,
+			Message: "Stream ended before a complete WAV header was received",
+		}
+	}
+	if s.source != nil {
+		// The last frame has no sync code after it
+		if err := s.writeFLAC(true); err != nil {
+			return nil, err
+		}
+		if err := s.source.check(s.input); err != nil {
+			return nil, err
+		}
+	}
+	if s.decimator != nil {
+		// The filter runs half its length behind the DSD input
+		if err := s.encode(s.quant.quantize(s.decimator.flush())); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.fw.Close(); err != nil {
+		return nil, conversionFailed(err)
+	}
+	if s.source != nil {
+		header, err := s.source.finish(s.fw, s.blocks)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			s.rewritten = header[streamInfoOffset:]
+		}
+	}
+	if len(s.tail) == 0 && s.afterData > 0 {
+		if err := s.keepTrailing(); err != nil {
+			return nil, err
+		}
+	}
+	if s.restore != nil {
+		if err := s.restore.finish(s.fw.header, s.patchedHeader()); err != nil {
+			return nil, err
+		}
+	}
+	return s.drain(), nil
+}
+
+// parseHeader reads the header at the start of the input, or describes raw
+// input from its declared format.
+func (s *StreamEncoder) parseHeader() (*utils.WAVHeader, error) {
+	if s.raw != nil {
+		return s.raw.header(), nil
+	}
+	return utils.ParseHeader(s.input)
+}
+
+func (s *StreamEncoder) start(header *utils.WAVHeader) error {
+	format, err := flacFormat(header, s.float, s.dsd)
+	if err != nil {
+		return err
+	}
+	if header.Format.Float {
+		s.quant = newQuantizer(s.float, format.NumChannels)
+	}
+	if header.Format.DSD {
+		if s.decimator, err = newDSDDecimator(header, format.SampleRate); err != nil {
+			return err
+		}
+		// Decimated samples are quantized like floating-point input
+		params := s.float
+		params.bitsPerSample = format.BitsPerSample
+		s.quant = newQuantizer(params, format.NumChannels)
+	}
+	if s.keepForeign {
+		if !header.IsRIFF() {
+			return unsupportedFormat("Foreign metadata can only be kept for RIFF WAV input")
+		}
+		if header.Format.Float {
+			return unsupportedFormat("Foreign metadata can only be kept for integer PCM; floating-point samples are not stored losslessly")
+		}
+	}
+	prefix := s.input[:header.DataOffset]
+	blocks := s.metadata(header, prefix, s.tail)
+	// Only the first page of Ogg FLAC can be patched. Foreign metadata keeps
+	// the padding byte of the data chunk too.
+	if len(s.tail) == 0 && s.container == ContainerFLAC {
+		trailing := declaredTrailing(prefix, header)
+		if trailing > header.DataPadding() || s.keepForeign && trailing > 0 {
+			s.trailingSize = trailing
+			s.prefix = append([]byte(nil), prefix...)
+			blocks = append(blocks, paddingBlock(s.trailingReserve()))
+		}
+	}
+	if err := s.open(header, format, blocks); err != nil {
+		return err
+	}
+	if s.keepForeign {
+		// The check starts with the input so far and the metadata
+		s.restore = newRestoreCheck(s.input)
+		s.restore.Write(s.fw.header)
+		s.fw.w.copy = s.restore
+	}
+	return nil
+}
+
+// metadata returns the metadata blocks for a file whose bytes before the
+// audio are prefix and after it tail, and records its cue points and loops.
+func (s *StreamEncoder) metadata(header *utils.WAVHeader, prefix, tail []byte) []*meta.Block {
+	// Chunks after the data chunk start after its padding
+	var trailing []utils.Chunk
+	if len(tail) > 0 {
+		trailing = header.TrailingChunks(tail)
+	}
+	chunks := append(header.Chunks[:len(header.Chunks):len(header.Chunks)], trailing...)
+	blocks := headerMetadata(header, chunks)
+	s.cues = cuePoints(chunks)
+	s.loops = sampleLoops(chunks)
+	if s.keepForeign {
+		blocks = append(blocks, foreignMetadata(prefix, header, tail)...)
+	}
+	return blocks
+}
+
+// keepTrailing writes the chunks received after the audio into the metadata
+// when they were declared and fit in the padding reserved for them. Chunks
+// that cannot be kept are counted by DiscardedBytes, unless foreign metadata
+// is kept, which needs every byte.
+func (s *StreamEncoder) keepTrailing() error {
+	if s.afterData > s.trailingSize {
+		if s.keepForeign {
+			return &models.ConversionError{
+				Code:    models.ErrConversionFailed,
+				Message: "Chunks after the data chunk were not declared by the RIFF size; foreign metadata cannot be kept",
+			}
+		}
+		return nil
+	}
+	fits, err := s.rewriteMetadata()
+	if err != nil {
+		return err
+	}
+	if !fits && s.keepForeign {
+		return &models.ConversionError{
+			Code:    models.ErrConversionFailed,
+			Message: "Chunks after the data chunk do not fit in the padding reserved for them; foreign metadata cannot be kept",
+		}
+	}
+	return nil
+}
+
+// rewriteMetadata encodes the metadata again with the chunks received after
+// the audio, in the space the first metadata took, for HeaderPatch. It
+// reports whether they fit.
+func (s *StreamEncoder) rewriteMetadata() (bool, error) {
+	cues, loops := s.cues, s.loops
+	blocks := s.metadata(s.header, s.prefix, s.trailing)
+	header, err := encodeMetadata(&s.fw.info, blocks)
+	if err != nil {
+		return false, conversionFailed(err)
+	}
+	if room := len(s.fw.header) - len(header); room >= 4 {
+		blocks = append(blocks, paddingBlock(room-4))
+		if header, err = encodeMetadata(&s.fw.info, blocks); err != nil {
+			return false, conversionFailed(err)
+		}
+	}
+	if len(header) != len(s.fw.header) {
+		s.cues, s.loops = cues, loops
+		return false, nil
+	}
+	s.rewritten = header[streamInfoOffset:]
+	return true, nil
+}
+
+// patchedHeader returns the metadata at the start of the native FLAC stream
+// once HeaderPatch has been applied.
+func (s *StreamEncoder) patchedHeader() []byte {
+	header := append([]byte(nil), s.fw.header...)
+	if s.rewritten != nil {
+		copy(header[streamInfoOffset:], s.rewritten)
+	} else {
+		copy(header[streamInfoOffset:], s.StreamInfo())
+	}
+	return header
+}
+
+// declaredTrailing returns the number of bytes that the RIFF, FORM or Wave64
+// size of a file, whose bytes before the audio are prefix, covers after its
+// data chunk. RF64 files and live recordings, whose size is a placeholder,
+// declare none, nor do DSD files.
+func declaredTrailing(prefix []byte, header *utils.WAVHeader) int64 {
+	if header.DataSize == utils.UnknownDataSize {
+		return 0
+	}
+	var size int64
+	switch {
+	case header.IsRIFF():
+		size = 8 + int64(binary.LittleEndian.Uint32(prefix[4:8]))
+		if size == 8 || size == 8+0xFFFFFFFF {
+			return 0
+		}
+	case header.IsAIFF():
+		size = 8 + int64(binary.BigEndian.Uint32(prefix[4:8]))
+	case header.Form == "W64":
+		size = int64(binary.LittleEndian.Uint64(prefix[16:24]))
+	}
+	return max(size-int64(header.DataOffset)-header.DataSize, 0)
+}
+
+// trailingReserve returns the padding reserved for the chunks declared after
+// the audio: the tags and cue points read from them take up to three times
+// their size, and stored in APPLICATION blocks they take up to twice it.
+func (s *StreamEncoder) trailingReserve() int {
+	reserve := 3*s.trailingSize + 1024
+	if s.keepForeign {
+		reserve += 2 * s.trailingSize
+	}
+	return int(min(reserve, maxPadding))
+}
+
+// maxPadding is the longest PADDING block, given the 24-bit block length.
+const maxPadding = 1<<24 - 1
+
+func paddingBlock(n int) *meta.Block {
+	return &meta.Block{Header: meta.Header{Type: meta.TypePadding, Length: int64(n)}}
+}
+
+// open writes the start of the FLAC stream with the given metadata blocks and
+// prepares to encode the samples described by header in the given format.
+func (s *StreamEncoder) open(header *utils.WAVHeader, format models.AudioFormat, blocks []*meta.Block) error {
+	var dest io.Writer = &s.out
+	if s.container == ContainerOgg {
+		// The mapping requires VORBIS_COMMENT as the second header packet
+		if len(blocks) == 0 || blocks[0].Header.Type != meta.TypeVorbisComment {
+			blocks = append([]*meta.Block{vorbisCommentBlock(nil)}, blocks...)
+		}
+		dest = newOggWriter(&s.out)
+	}
+	fw, err := newFlacWriter(dest, format.SampleRate, format.NumChannels, format.BitsPerSample, s.params, blocks...)
+	if err != nil {
+		return conversionFailed(err)
+	}
+	fw.verifier = s.verifier
+	s.blocks = blocks
+	s.header = header
+	s.format = format
+	s.remaining = header.DataSize
+	if header.DataSize == utils.UnknownDataSize {
+		s.remaining = math.MaxInt64
+	}
+	s.fw = fw
+	return nil
+}
+
+// flacFormat returns the format of the FLAC stream for a WAV header:
+// floating-point samples are quantized to the configured depth, DSD is
+// decimated to 24 bits at the configured rate and integer samples keep their
+// depth. It fails when FLAC cannot represent the result.
+func flacFormat(header *utils.WAVHeader, float floatParams, dsd dsdParams) (models.AudioFormat, error) {
+	format := header.Format
+	if format.DSD {
+		format.SampleRate = dsd.sampleRate
+		format.BitsPerSample = dsdBitsPerSample
+		format.DSD = false
+	} else if format.Float {
+		format.BitsPerSample = float.bitsPerSample
+		format.Float = false
+	} else if err := utils.ValidatePCMDepth(header.ContainerBits); err != nil {
+		return format, err
+	}
+	return format, validateFormat(format)
+}
+
+// decode converts whole sample frames of the data chunk to the integer
+// samples of the FLAC stream.
+func (s *StreamEncoder) decode(data []byte) ([]int, error) {
+	if s.decimator != nil {
+		return s.quant.quantize(s.decimator.write(data)), nil
+	}
+	if s.raw != nil {
+		return utils.DecodeRawPCM(data, s.raw.format.BitsPerSample, s.raw.bigEndian, s.raw.signed)
+	}
+	if s.quant == nil {
+		if s.header.BigEndian {
+			return utils.DecodeBigEndianPCM(data, s.header.ContainerBits, s.header.Format.BitsPerSample)
+		}
+		return utils.DecodePCM(data, s.header.ContainerBits, s.header.Format.BitsPerSample)
+	}
+	samples, err := utils.DecodeFloatPCM(data, s.header.Format.BitsPerSample)
+	if err != nil {
+		return nil, err
+	}
+	return s.quant.quantize(samples), nil
+}
+
+// conversionFailed wraps an encoder error for reporting to clients. Errors
+// that already carry a code, such as failed verification, pass through.
+func conversionFailed(err error) error {
+	var convErr *models.ConversionError
+	if errors.As(err, &convErr) {
+		return err
+	}
+	return &models.ConversionError{
+		Code:    models.ErrConversionFailed,
+		Message: err.Error(),
+	}
+}
+
+// drain hands over everything the encoder has written so far.
+func (s *StreamEncoder) drain() []byte {
+	if s.out.Len() == 0 {
+		return nil
+	}
+	data := append([]byte(nil), s.out.Bytes()...)
+	s.out.Reset()
+	if s.bytesOut == 0 && s.container == ContainerOgg {
+		s.head = append([]byte(nil), data[:oggPageSize(data)]...)
+	}
+	s.bytesOut += int64(len(data))
+	return data
+}
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"audio-converter/internal/models"
+)
+
+// frameVerifier decodes every frame the writer produces and compares it with
+// the samples it was encoded from, as the reference encoder's --verify does.
+// Frames are decoded by readFrame, so up to 24 bits per sample the check does
+// not share code with the encoder.
+type frameVerifier struct {
+	// dir receives a report for the first frame that does not match; the
+	// system temporary directory is used when it is empty.
+	dir string
+}
+
+// verifyReport describes a frame that failed verification.
+type verifyReport struct {
+	Frame         uint64 `json:"frame"`
+	FirstSample   uint64 `json:"firstSample"`
+	SampleRate    uint32 `json:"sampleRate"`
+	BitsPerSample uint8  `json:"bitsPerSample"`
+	Error         string `json:"error"`
+	// Channel and Sample locate the first differing sample, if the frame
+	// decoded at all.
+	Channel *int `json:"channel,omitempty"`
+	Sample  *int `json:"sample,omitempty"`
+	// Expected and Decoded hold the samples of each channel.
+	Expected [][]int32 `json:"expected"`
+	Decoded  [][]int32 `json:"decoded,omitempty"`
+	// Data is the encoded frame, base64 in JSON.
+	Data []byte `json:"data"`
+}
+
+// check decodes an encoded frame and compares it with block, the samples of
+// each channel it was encoded from. A mismatch is saved for debugging and
+// reported as ErrConversionFailed.
+func (v *frameVerifier) check(fw *flacWriter, data []byte, block [][]int32) error {
+	report := verifyReport{
+		Frame:         fw.frames,
+		FirstSample:   fw.info.NSamples,
+		SampleRate:    fw.info.SampleRate,
+		BitsPerSample: fw.info.BitsPerSample,
+		Expected:      block,
+		Data:          data,
+	}
+	decoded, n, err := readFrame(data, uint(fw.info.BitsPerSample))
+	switch {
+	case err != nil:
+		report.Error = err.Error()
+	case n != len(data):
+		report.Error = fmt.Sprintf("frame decoded from %d of its %d bytes", n, len(data))
+	case len(decoded) == 0:
+		report.Error = fmt.Sprintf("frame decoded to no channels, want %d", len(block))
+	case len(decoded) != len(block) || len(decoded[0]) != len(block[0]):
+		report.Error = fmt.Sprintf("frame decoded to %d channels of %d samples, want %d of %d",
+			len(decoded), len(decoded[0]), len(block), len(block[0]))
+	default:
+		for ch := range block {
+			for i := range block[ch] {
+				if decoded[ch][i] != block[ch][i] {
+					report.Error = fmt.Sprintf("sample %d of channel %d decoded as %d, want %d",
+						i, ch, decoded[ch][i], block[ch][i])
+					report.Channel, report.Sample = &ch, &i
+					report.Decoded = decoded
+					return v.fail(report)
+				}
+			}
+		}
+		return nil
+	}
+	report.Decoded = decoded
+	return v.fail(report)
+}
+
+// fail saves report and returns the error that aborts the conversion.
+func (v *frameVerifier) fail(report verifyReport) error {
+	msg := fmt.Sprintf("Verification failed at frame %d (sample %d): %s", report.Frame, report.FirstSample, report.Error)
+	path, err := v.save(report)
+	if err != nil {
+		msg += fmt.Sprintf("; saving details failed: %v", err)
+	} else {
+		msg += "; details saved to " + path
+	}
+	return &models.ConversionError{
+		Code:    models.ErrConversionFailed,
+		Message: msg,
+	}
+}
+
+func (v *frameVerifier) save(report verifyReport) (string, error) {
+	f, err := os.CreateTemp(v.dir, "flac-verify-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
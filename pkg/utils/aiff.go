@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"encoding/binary"
+	"math"
+
+	"audio-converter/internal/models"
+)
+
+// AIFF-C compression types read as integer PCM.
+const (
+	aiffCompressionNone = "NONE"
+	// aiffCompressionSowt is little-endian PCM ("twos" reversed).
+	aiffCompressionSowt = "sowt"
+)
+
+// ParseAIFFHeader walks the chunks of an AIFF or AIFF-C file up to the sample
+// data of the SSND chunk, parsing the COMM chunk on the way. Other chunks are
+// kept like those of a WAV file. The result uses the same description as a
+// WAV file; AIFF has no channel mask.
+func ParseAIFFHeader(data []byte) (*WAVHeader, error) {
+	if len(data) < 12 {
+		return nil, ErrIncompleteHeader
+	}
+	if string(data[0:4]) != "FORM" {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid AIFF header",
+		}
+	}
+	form := string(data[8:12])
+	if form != "AIFF" && form != "AIFC" {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid AIFF form type",
+		}
+	}
+
+	var (
+		header *WAVHeader
+		chunks []Chunk
+		kept   int64
+	)
+	pos := 12
+	for {
+		if len(data) < pos+8 {
+			return nil, ErrIncompleteHeader
+		}
+		id := string(data[pos : pos+4])
+		size := int64(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		body := pos + 8
+
+		switch id {
+		case "COMM":
+			if size > maxWAVHeaderSize {
+				return nil, chunkTooLarge(id)
+			}
+			if int64(len(data)) < int64(body)+size {
+				return nil, ErrIncompleteHeader
+			}
+			commChunk, err := parseCommChunk(data[body:int64(body)+size], form == "AIFC")
+			if err != nil {
+				return nil, err
+			}
+			header = commChunk
+		case "SSND":
+			if header == nil {
+				return nil, &models.ConversionError{
+					Code:    models.ErrInvalidFormat,
+					Message: "SSND chunk precedes COMM chunk",
+				}
+			}
+			if len(data) < body+8 {
+				return nil, ErrIncompleteHeader
+			}
+			// The samples start offset bytes into the chunk's data
+			offset := int64(binary.BigEndian.Uint32(data[body : body+4]))
+			if size < 8+offset {
+				return nil, &models.ConversionError{
+					Code:    models.ErrInvalidChunkSize,
+					Message: "SSND chunk is too short",
+				}
+			}
+			if int64(len(data)) < int64(body)+8+offset {
+				return nil, ErrIncompleteHeader
+			}
+			header.Form = form
+			header.DataOffset = body + 8 + int(offset)
+			header.DataSize = size - 8 - offset
+			header.Chunks = chunks
+			return header, nil
+		default:
+			if kept+size > maxWAVHeaderSize {
+				break
+			}
+			if int64(len(data)) < int64(body)+size {
+				return nil, ErrIncompleteHeader
+			}
+			kept += size
+			chunks = append(chunks, Chunk{ID: id, Data: append([]byte(nil), data[body:int64(body)+size]...)})
+		}
+
+		// Chunks are padded to an even length
+		pos = int(int64(body) + size + size&1)
+	}
+}
+
+// ParseAIFFChunks returns the complete AIFF chunks at the start of data, such
+// as the bytes that follow the SSND chunk of a file.
+func ParseAIFFChunks(data []byte) []Chunk {
+	return parseChunks(data, binary.BigEndian)
+}
+
+// ParseAIFFText decodes the body of an AIFF text chunk such as NAME, AUTH,
+// ANNO or "(c) ".
+func ParseAIFFText(body []byte) string {
+	return riffText(body)
+}
+
+// parseCommChunk validates the body of a COMM chunk. AIFF-C files add a
+// compression type, of which only uncompressed PCM is accepted.
+func parseCommChunk(body []byte, aifc bool) (*WAVHeader, error) {
+	minSize := 18
+	if aifc {
+		minSize = 22
+	}
+	if len(body) < minSize {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidChunkSize,
+			Message: "COMM chunk is too short",
+		}
+	}
+
+	channels := int(int16(binary.BigEndian.Uint16(body[0:2])))
+	bits := int(int16(binary.BigEndian.Uint16(body[6:8])))
+	rate := math.Round(parseExtended(body[8:18]))
+	if channels <= 0 || bits <= 0 || !(rate > 0 && rate <= math.MaxInt32) {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid channel count, sample rate or bit depth",
+		}
+	}
+
+	containerBytes := (bits + 7) / 8
+	header := &WAVHeader{
+		FormatTag:     WAVFormatPCM,
+		ContainerBits: containerBytes * 8,
+		BlockAlign:    channels * containerBytes,
+		BigEndian:     true,
+		Format: models.AudioFormat{
+			NumChannels:   channels,
+			SampleRate:    int(rate),
+			BitsPerSample: bits,
+		},
+	}
+	if aifc {
+		switch string(body[18:22]) {
+		case aiffCompressionNone:
+		case aiffCompressionSowt:
+			// Single bytes have no order and stay signed
+			header.BigEndian = containerBytes == 1
+		default:
+			return nil, &models.ConversionError{
+				Code:    models.ErrInvalidFormat,
+				Message: "Unsupported AIFF-C compression type",
+			}
+		}
+	}
+	return header, nil
+}
+
+// parseExtended reads an 80-bit IEEE 754 extended precision number, as used
+// for the sample rate of AIFF files.
+func parseExtended(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:2]) & 0x7FFF)
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+	// The mantissa has an explicit integer bit
+	v := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if b[0]&0x80 != 0 {
+		v = -v
+	}
+	return v
+}
@@ -1,9 +1,6 @@
 package utils
 
 import (
-	
-	"encoding/binary"
-	
 	"math"
 
 	"audio-converter/internal/models"
@@ -28,29 +25,12 @@ func NewAudioBuffer(size int) *AudioBuffer {
 
 // ValidateWAVHeader checks if the provided data has a valid WAV header
 func ValidateWAVHeader(data []byte) (*models.AudioFormat, error) {
-	if len(data) < 44 { // Minimum WAV header size
-		return nil, &models.ConversionError{
-			Code:    models.ErrInvalidFormat,
-			Message: "Invalid WAV header size",
-		}
-	}
-
-	// Check RIFF header
-	if string(data[0:4]) != "RIFF" {
-		return nil, &models.ConversionError{
-			Code:    models.ErrInvalidFormat,
-			Message: "Invalid RIFF header",
-		}
-	}
-
-	// Parse format
-	format := &models.AudioFormat{
-		NumChannels:   int(binary.LittleEndian.Uint16(data[22:24])),
-		SampleRate:    int(binary.LittleEndian.Uint32(data[24:28])),
-		BitsPerSample: int(binary.LittleEndian.Uint16(data[34:36])),
+	header, err := ParseWAVHeader(data)
+	if err != nil {
+		return nil, err
 	}
 
-	return format, nil
+	return &header.Format, nil
 }
 
 // ConvertSampleRate converts audio samples from one sample rate to another
@@ -0,0 +1,60 @@
+package utils
+
+// Speaker positions of a WAVE_FORMAT_EXTENSIBLE channel mask. Channels are
+// interleaved in the order of their bits, lowest first.
+const (
+	SpeakerFrontLeft    uint32 = 0x1
+	SpeakerFrontRight   uint32 = 0x2
+	SpeakerFrontCenter  uint32 = 0x4
+	SpeakerLowFrequency uint32 = 0x8
+	SpeakerBackLeft     uint32 = 0x10
+	SpeakerBackRight    uint32 = 0x20
+	SpeakerBackCenter   uint32 = 0x100
+	SpeakerSideLeft     uint32 = 0x200
+	SpeakerSideRight    uint32 = 0x400
+)
+
+// flacChannelLayouts lists, for each channel count, the speaker layouts FLAC
+// assigns to its channels without a channel mask tag. FLAC's surround
+// channels may be either back or side speakers, as in the reference encoder.
+var flacChannelLayouts = map[int][]uint32{
+	1: {SpeakerFrontCenter},
+	2: {SpeakerFrontLeft | SpeakerFrontRight},
+	3: {SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter},
+	4: {SpeakerFrontLeft | SpeakerFrontRight | SpeakerBackLeft | SpeakerBackRight},
+	5: {
+		SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerBackLeft | SpeakerBackRight,
+		SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerSideLeft | SpeakerSideRight,
+	},
+	6: {
+		SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerLowFrequency | SpeakerBackLeft | SpeakerBackRight,
+		SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerLowFrequency | SpeakerSideLeft | SpeakerSideRight,
+	},
+	7: {SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerLowFrequency | SpeakerBackCenter | SpeakerSideLeft | SpeakerSideRight},
+	8: {SpeakerFrontLeft | SpeakerFrontRight | SpeakerFrontCenter | SpeakerLowFrequency | SpeakerBackLeft | SpeakerBackRight | SpeakerSideLeft | SpeakerSideRight},
+}
+
+// IsFLACChannelLayout reports whether numChannels channels with the given
+// WAV channel mask are in one of FLAC's default layouts. A zero mask means
+// the default layout. FLAC orders its channels the same way WAV orders the
+// speakers of these layouts, so matching input needs no reordering.
+func IsFLACChannelLayout(mask uint32, numChannels int) bool {
+	if mask == 0 {
+		return true
+	}
+	for _, layout := range flacChannelLayouts[numChannels] {
+		if mask == layout {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultChannelMask returns the speaker mask of FLAC's default layout for
+// numChannels channels, or zero when FLAC defines none.
+func DefaultChannelMask(numChannels int) uint32 {
+	if layouts := flacChannelLayouts[numChannels]; len(layouts) > 0 {
+		return layouts[0]
+	}
+	return 0
+}
@@ -0,0 +1,36 @@
+package utils
+
+import "audio-converter/internal/models"
+
+// ParseHeader detects the container of an audio file from its first bytes
+// and parses its header: RIFF/WAVE, RF64 and BW64 files go to
+// ParseWAVHeader, AIFF and AIFF-C files to ParseAIFFHeader, Wave64 files to
+// ParseW64Header and DSF and DSDIFF files to ParseDSFHeader and
+// ParseDFFHeader.
+func ParseHeader(data []byte) (*WAVHeader, error) {
+	if len(data) < 4 {
+		return nil, ErrIncompleteHeader
+	}
+	switch string(data[0:4]) {
+	case "RIFF", "RF64", "BW64":
+		return ParseWAVHeader(data)
+	case "FORM":
+		return ParseAIFFHeader(data)
+	case "DSD ":
+		return ParseDSFHeader(data)
+	case "FRM8":
+		return ParseDFFHeader(data)
+	case "riff":
+		// Wave64 is told apart by the rest of its GUID
+		if len(data) < 16 {
+			return nil, ErrIncompleteHeader
+		}
+		if isW64(data) {
+			return ParseW64Header(data)
+		}
+	}
+	return nil, &models.ConversionError{
+		Code:    models.ErrInvalidFormat,
+		Message: "Unrecognized audio file format",
+	}
+}
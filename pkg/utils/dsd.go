@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"encoding/binary"
+
+	"audio-converter/internal/models"
+)
+
+// DSDLayout describes how the 1-bit samples of a DSD file are stored.
+type DSDLayout struct {
+	// BlockSize is the number of bytes of one channel stored together before
+	// the next channel's: 4096 in DSF files, 1 in DSDIFF files.
+	BlockSize int
+	// LSBFirst is set when the earliest sample of each byte is its least
+	// significant bit.
+	LSBFirst bool
+	// Samples is the number of 1-bit samples per channel.
+	Samples uint64
+}
+
+// DSDSilence is a byte of DSD silence: as many ones as zeros.
+const DSDSilence = 0x69
+
+// ParseDSFHeader reads the DSD, fmt and data chunks of a DSF file.
+func ParseDSFHeader(data []byte) (*WAVHeader, error) {
+	if len(data) < 28 {
+		return nil, ErrIncompleteHeader
+	}
+	if string(data[0:4]) != "DSD " {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid DSF header",
+		}
+	}
+	pos := int(binary.LittleEndian.Uint64(data[4:12]))
+	if pos != 28 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidChunkSize,
+			Message: "Invalid DSF header size",
+		}
+	}
+	if len(data) < pos+52 {
+		return nil, ErrIncompleteHeader
+	}
+	fmtChunk := data[pos:]
+	fmtSize := binary.LittleEndian.Uint64(fmtChunk[4:12])
+	if string(fmtChunk[0:4]) != "fmt " || fmtSize < 52 || fmtSize > maxWAVHeaderSize {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "DSF file has no fmt chunk",
+		}
+	}
+	if binary.LittleEndian.Uint32(fmtChunk[16:20]) != 0 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Unsupported DSF format ID",
+		}
+	}
+	channels := int(binary.LittleEndian.Uint32(fmtChunk[24:28]))
+	rate := binary.LittleEndian.Uint32(fmtChunk[28:32])
+	bits := binary.LittleEndian.Uint32(fmtChunk[32:36])
+	layout := &DSDLayout{
+		BlockSize: int(binary.LittleEndian.Uint32(fmtChunk[44:48])),
+		LSBFirst:  bits == 1,
+		Samples:   binary.LittleEndian.Uint64(fmtChunk[36:44]),
+	}
+	if bits != 1 && bits != 8 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "DSF bits per sample must be 1 or 8",
+		}
+	}
+	if layout.BlockSize <= 0 || layout.BlockSize > 1<<16 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid DSF block size",
+		}
+	}
+
+	pos += int(fmtSize)
+	if len(data) < pos+12 {
+		return nil, ErrIncompleteHeader
+	}
+	if string(data[pos:pos+4]) != "data" {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "DSF fmt chunk is not followed by a data chunk",
+		}
+	}
+	size := binary.LittleEndian.Uint64(data[pos+4 : pos+12])
+	if size < 12 || size > maxW64ChunkSize {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidChunkSize,
+			Message: "Invalid DSF data chunk size",
+		}
+	}
+	return dsdHeader("DSF", channels, int(rate), layout, pos+12, int64(size)-12)
+}
+
+// ParseDFFHeader walks the chunks of a DSDIFF file up to its sound data,
+// reading the sample rate, channels and compression from the PROP chunk.
+// Only uncompressed DSD is accepted; DST-compressed files are rejected.
+func ParseDFFHeader(data []byte) (*WAVHeader, error) {
+	if len(data) < 16 {
+		return nil, ErrIncompleteHeader
+	}
+	if string(data[0:4]) != "FRM8" || string(data[12:16]) != "DSD " {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid DSDIFF header",
+		}
+	}
+
+	var (
+		channels, rate int
+		prop           bool
+	)
+	pos := 16
+	for {
+		if len(data) < pos+12 {
+			return nil, ErrIncompleteHeader
+		}
+		id := string(data[pos : pos+4])
+		rawSize := binary.BigEndian.Uint64(data[pos+4 : pos+12])
+		if rawSize > maxW64ChunkSize {
+			return nil, &models.ConversionError{
+				Code:    models.ErrInvalidChunkSize,
+				Message: "Invalid DSDIFF chunk size",
+			}
+		}
+		size := int64(rawSize)
+		body := pos + 12
+
+		switch id {
+		case "PROP":
+			if size > maxWAVHeaderSize {
+				return nil, chunkTooLarge(id)
+			}
+			if int64(len(data)) < int64(body)+size {
+				return nil, ErrIncompleteHeader
+			}
+			var err error
+			if channels, rate, err = parseDFFProperties(data[body : int64(body)+size]); err != nil {
+				return nil, err
+			}
+			prop = true
+		case "DST ":
+			return nil, &models.ConversionError{
+				Code:    models.ErrInvalidFormat,
+				Message: "DST-compressed DSDIFF files are not supported",
+			}
+		case "DSD ":
+			if !prop {
+				return nil, &models.ConversionError{
+					Code:    models.ErrInvalidFormat,
+					Message: "DSD sound data precedes PROP chunk",
+				}
+			}
+			layout := &DSDLayout{BlockSize: 1, Samples: uint64(size) * 8 / uint64(channels)}
+			return dsdHeader("DFF", channels, rate, layout, body, size)
+		}
+
+		// Chunks are padded to an even length
+		pos = int(int64(body) + size + size&1)
+	}
+}
+
+// parseDFFProperties reads the sound properties of a DSDIFF PROP chunk.
+func parseDFFProperties(body []byte) (channels, rate int, err error) {
+	if len(body) < 4 || string(body[0:4]) != "SND " {
+		return 0, 0, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "DSDIFF PROP chunk is not of type SND",
+		}
+	}
+	compression := ""
+	pos := 4
+	for pos+12 <= len(body) {
+		id := string(body[pos : pos+4])
+		size := binary.BigEndian.Uint64(body[pos+4 : pos+12])
+		if size > uint64(len(body)-pos-12) {
+			break
+		}
+		chunk := body[pos+12 : pos+12+int(size)]
+		switch id {
+		case "FS  ":
+			if len(chunk) >= 4 {
+				rate = int(binary.BigEndian.Uint32(chunk))
+			}
+		case "CHNL":
+			if len(chunk) >= 2 {
+				channels = int(binary.BigEndian.Uint16(chunk))
+			}
+		case "CMPR":
+			if len(chunk) >= 4 {
+				compression = string(chunk[0:4])
+			}
+		}
+		pos += 12 + int(size) + int(size&1)
+	}
+	if compression != "DSD " {
+		return 0, 0, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Only uncompressed DSDIFF files are supported",
+		}
+	}
+	return channels, rate, nil
+}
+
+// dsdHeader describes the sound data of a DSD file. A block is one
+// BlockSize run of every channel.
+func dsdHeader(form string, channels, rate int, layout *DSDLayout, offset int, size int64) (*WAVHeader, error) {
+	if channels <= 0 || rate <= 0 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid channel count or sample rate",
+		}
+	}
+	return &WAVHeader{
+		Form: form,
+		Format: models.AudioFormat{
+			SampleRate:    rate,
+			NumChannels:   channels,
+			BitsPerSample: 1,
+			DSD:           true,
+		},
+		ContainerBits: 1,
+		BlockAlign:    layout.BlockSize * channels,
+		DataOffset:    offset,
+		DataSize:      size,
+		DSD:           layout,
+	}, nil
+}
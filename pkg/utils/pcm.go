@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"audio-converter/internal/models"
+)
+
+// ValidatePCMDepth reports whether DecodePCM can read samples stored in
+// containers of the given size in bits.
+func ValidatePCMDepth(containerBits int) error {
+	switch (containerBits + 7) / 8 {
+	case 1, 2, 3, 4:
+		return nil
+	default:
+		return &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: fmt.Sprintf("Unsupported bit depth: %d", containerBits),
+		}
+	}
+}
+
+// DecodePCM converts little-endian integer PCM to interleaved samples. Each
+// sample occupies a containerBits-bit container holding bitsPerSample valid
+// bits, left-justified. 8-bit samples are unsigned, wider ones signed. The
+// length of data must be a whole number of samples.
+func DecodePCM(data []byte, containerBits, bitsPerSample int) ([]int, error) {
+	width := (containerBits + 7) / 8
+	if len(data)%width != 0 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidChunkSize,
+			Message: fmt.Sprintf("PCM data is not a whole number of %d-byte samples", width),
+		}
+	}
+
+	samples := make([]int, len(data)/width)
+	switch width {
+	case 1:
+		for i := range samples {
+			samples[i] = int(data[i]) - 128
+		}
+	case 2:
+		for i := range samples {
+			samples[i] = int(int16(uint16(data[2*i]) | uint16(data[2*i+1])<<8))
+		}
+	case 3:
+		for i := range samples {
+			b := data[3*i:]
+			// Shift the 24-bit value into the top of an int32 to sign-extend it
+			samples[i] = int(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)
+		}
+	case 4:
+		for i := range samples {
+			b := data[4*i:]
+			samples[i] = int(int32(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24))
+		}
+	default:
+		return nil, ValidatePCMDepth(containerBits)
+	}
+	justify(samples, width, bitsPerSample)
+	return samples, nil
+}
+
+// DecodeBigEndianPCM converts big-endian integer PCM, as stored in AIFF
+// files, to interleaved samples. Unlike DecodePCM, 8-bit samples are signed.
+func DecodeBigEndianPCM(data []byte, containerBits, bitsPerSample int) ([]int, error) {
+	width := (containerBits + 7) / 8
+	if len(data)%width != 0 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidChunkSize,
+			Message: fmt.Sprintf("PCM data is not a whole number of %d-byte samples", width),
+		}
+	}
+
+	samples := make([]int, len(data)/width)
+	switch width {
+	case 1:
+		for i := range samples {
+			samples[i] = int(int8(data[i]))
+		}
+	case 2:
+		for i := range samples {
+			samples[i] = int(int16(binary.BigEndian.Uint16(data[2*i:])))
+		}
+	case 3:
+		for i := range samples {
+			b := data[3*i:]
+			samples[i] = int(int32(uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8) >> 8)
+		}
+	case 4:
+		for i := range samples {
+			samples[i] = int(int32(binary.BigEndian.Uint32(data[4*i:])))
+		}
+	default:
+		return nil, ValidatePCMDepth(containerBits)
+	}
+	justify(samples, width, bitsPerSample)
+	return samples, nil
+}
+
+// justify shifts samples of bitsPerSample bits down from the top of their
+// width-byte containers, where they are left-justified.
+func justify(samples []int, width, bitsPerSample int) {
+	if shift := width*8 - bitsPerSample; shift > 0 {
+		for i := range samples {
+			samples[i] >>= shift
+		}
+	}
+}
+
+// EncodePCM is the inverse of DecodePCM: it stores interleaved samples of
+// bitsPerSample bits left-justified in little-endian containerBits-bit
+// containers, with the unused low bits zero.
+func EncodePCM(samples []int, containerBits, bitsPerSample int) ([]byte, error) {
+	if err := ValidatePCMDepth(containerBits); err != nil {
+		return nil, err
+	}
+	width := (containerBits + 7) / 8
+	shift := uint(width*8 - bitsPerSample)
+	data := make([]byte, len(samples)*width)
+	for i, s := range samples {
+		v := uint32(s) << shift
+		if width == 1 {
+			v += 0x80
+		}
+		for b := 0; b < width; b++ {
+			data[i*width+b] = byte(v >> (8 * uint(b)))
+		}
+	}
+	return data, nil
+}
+
+// DecodeFloatPCM converts little-endian IEEE floating-point PCM of 32 or 64
+// bits to interleaved samples, full scale being -1.0 to 1.0. The length of
+// data must be a whole number of samples.
+func DecodeFloatPCM(data []byte, bitsPerSample int) ([]float64, error) {
+	width := bitsPerSample / 8
+	if width != 4 && width != 8 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: fmt.Sprintf("Unsupported floating-point bit depth: %d", bitsPerSample),
+		}
+	}
+	if len(data)%width != 0 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidChunkSize,
+			Message: fmt.Sprintf("PCM data is not a whole number of %d-byte samples", width),
+		}
+	}
+
+	samples := make([]float64, len(data)/width)
+	for i := range samples {
+		if width == 4 {
+			samples[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+		} else {
+			samples[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:]))
+		}
+	}
+	return samples, nil
+}
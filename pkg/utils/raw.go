@@ -0,0 +1,41 @@
+package utils
+
+import "audio-converter/internal/models"
+
+// RawHeader describes headerless integer PCM of the given format. The samples
+// start at the first byte and run until the stream ends.
+func RawHeader(format models.AudioFormat, bigEndian bool) *WAVHeader {
+	return &WAVHeader{
+		Form:          "RAW",
+		Format:        format,
+		FormatTag:     WAVFormatPCM,
+		ContainerBits: format.BitsPerSample,
+		BlockAlign:    format.NumChannels * ((format.BitsPerSample + 7) / 8),
+		BigEndian:     bigEndian,
+		DataSize:      UnknownDataSize,
+	}
+}
+
+// DecodeRawPCM converts headerless integer PCM of the given byte order and
+// signedness to interleaved samples. Unsigned samples are stored offset by
+// half their range, as 8-bit WAV samples are.
+func DecodeRawPCM(data []byte, bitsPerSample int, bigEndian, signed bool) ([]int, error) {
+	decode, stored := DecodePCM, bitsPerSample > 8
+	if bigEndian {
+		decode, stored = DecodeBigEndianPCM, true
+	}
+	samples, err := decode(data, bitsPerSample, bitsPerSample)
+	if err != nil || signed == stored {
+		return samples, err
+	}
+	// Flipping the sign bit converts between the two representations
+	half := 1 << uint(bitsPerSample-1)
+	for i, s := range samples {
+		if s < 0 {
+			samples[i] = s + half
+		} else {
+			samples[i] = s - half
+		}
+	}
+	return samples, nil
+}
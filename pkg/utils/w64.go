@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"audio-converter/internal/models"
+)
+
+// Wave64 identifies chunks by GUID. The GUIDs of the RIFF chunks it carries
+// over are their FourCC followed by one of these suffixes.
+var (
+	w64RIFFSuffix = []byte{0x2E, 0x91, 0xCF, 0x11, 0xA5, 0xD6, 0x28, 0xDB, 0x04, 0xC1, 0x00, 0x00}
+	w64ListSuffix = []byte{0x2F, 0x91, 0xCF, 0x11, 0xA5, 0xD6, 0x28, 0xDB, 0x04, 0xC1, 0x00, 0x00}
+	w64WAVESuffix = []byte{0xF3, 0xAC, 0xD3, 0x11, 0x8C, 0xD1, 0x00, 0xC0, 0x4F, 0x8E, 0xDB, 0x8A}
+)
+
+// w64HeaderSize is the size of a Wave64 chunk header: a 16-byte GUID and a
+// 64-bit size that includes the header itself.
+const w64HeaderSize = 24
+
+// maxW64ChunkSize bounds chunk sizes so that offsets stay within an int64.
+const maxW64ChunkSize = 1 << 62
+
+// isW64 reports whether data starts with the GUID of a Wave64 file.
+func isW64(data []byte) bool {
+	return len(data) >= 16 && string(data[0:4]) == "riff" && bytes.Equal(data[4:16], w64RIFFSuffix)
+}
+
+// ParseW64Header walks the chunks of a Sony Wave64 file up to the data chunk,
+// parsing the fmt chunk on the way. Chunks whose GUIDs derive from RIFF
+// FourCCs are kept under those IDs, "list" as "LIST"; others are skipped.
+func ParseW64Header(data []byte) (*WAVHeader, error) {
+	if len(data) < 40 {
+		return nil, ErrIncompleteHeader
+	}
+	if !isW64(data) {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid Wave64 header",
+		}
+	}
+	if id, ok := w64ChunkID(data[24:40]); !ok || id != "wave" {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid Wave64 form type",
+		}
+	}
+
+	var (
+		header *WAVHeader
+		chunks []Chunk
+		kept   int64
+	)
+	pos := 40
+	for {
+		if len(data) < pos+w64HeaderSize {
+			return nil, ErrIncompleteHeader
+		}
+		id, known := w64ChunkID(data[pos : pos+16])
+		rawSize := binary.LittleEndian.Uint64(data[pos+16 : pos+24])
+		if rawSize < w64HeaderSize || rawSize > maxW64ChunkSize {
+			return nil, &models.ConversionError{
+				Code:    models.ErrInvalidChunkSize,
+				Message: "Invalid Wave64 chunk size",
+			}
+		}
+		size := int64(rawSize) - w64HeaderSize
+		body := pos + w64HeaderSize
+
+		switch {
+		case !known:
+		case id == "fmt ":
+			if size > maxWAVHeaderSize {
+				return nil, chunkTooLarge(id)
+			}
+			if int64(len(data)) < int64(body)+size {
+				return nil, ErrIncompleteHeader
+			}
+			fmtChunk, err := parseFmtChunk(data[body : int64(body)+size])
+			if err != nil {
+				return nil, err
+			}
+			header = fmtChunk
+		case id == "data":
+			if header == nil {
+				return nil, &models.ConversionError{
+					Code:    models.ErrInvalidFormat,
+					Message: "Data chunk precedes fmt chunk",
+				}
+			}
+			header.Form = "W64"
+			header.DataOffset = body
+			header.DataSize = size
+			header.Chunks = chunks
+			return header, nil
+		default:
+			if kept+size > maxWAVHeaderSize {
+				break
+			}
+			if int64(len(data)) < int64(body)+size {
+				return nil, ErrIncompleteHeader
+			}
+			kept += size
+			chunks = append(chunks, Chunk{ID: id, Data: append([]byte(nil), data[body:int64(body)+size]...)})
+		}
+
+		// Chunks are aligned to 8 bytes
+		pos = int((int64(body) + size + 7) &^ 7)
+	}
+}
+
+// parseW64Chunks returns the complete chunks with RIFF IDs at the start of
+// data, which must be 8-byte aligned.
+func parseW64Chunks(data []byte) []Chunk {
+	var chunks []Chunk
+	pos := int64(0)
+	for pos+w64HeaderSize <= int64(len(data)) {
+		rawSize := binary.LittleEndian.Uint64(data[pos+16 : pos+24])
+		if rawSize < w64HeaderSize || rawSize > uint64(int64(len(data))-pos) {
+			break
+		}
+		if id, ok := w64ChunkID(data[pos : pos+16]); ok {
+			chunks = append(chunks, Chunk{ID: id, Data: append([]byte(nil), data[pos+w64HeaderSize:pos+int64(rawSize)]...)})
+		}
+		pos = (pos + int64(rawSize) + 7) &^ 7
+	}
+	return chunks
+}
+
+// w64ChunkID returns the RIFF ID a Wave64 chunk GUID derives from.
+func w64ChunkID(guid []byte) (string, bool) {
+	id := string(guid[0:4])
+	switch {
+	case bytes.Equal(guid[4:16], w64WAVESuffix):
+		return id, true
+	case id == "list" && bytes.Equal(guid[4:16], w64ListSuffix):
+		return "LIST", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,415 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"audio-converter/internal/models"
+)
+
+// WAV format tags understood by the parser.
+const (
+	WAVFormatPCM        uint16 = 0x0001
+	WAVFormatIEEEFloat  uint16 = 0x0003
+	WAVFormatExtensible uint16 = 0xFFFE
+)
+
+// wavSubFormatSuffix is the part of a WAVE_FORMAT_EXTENSIBLE sub-format GUID
+// that follows the format tag, shared by every KSDATAFORMAT_SUBTYPE_* GUID
+// derived from a tag.
+var wavSubFormatSuffix = []byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71}
+
+// ErrIncompleteHeader is returned by ParseWAVHeader when data ends before
+// the start of the data chunk. Callers streaming a file should wait for more
+// bytes and try again.
+var ErrIncompleteHeader = &models.ConversionError{
+	Code:    models.ErrInvalidFormat,
+	Message: "Incomplete WAV header",
+}
+
+// maxWAVHeaderSize bounds the chunks before the data chunk that are read
+// into memory: the format chunk and the metadata chunks kept in
+// WAVHeader.Chunks. Other chunks, such as large artwork, are skipped by their
+// declared size.
+const maxWAVHeaderSize = 1 << 20
+
+// chunkTooLarge reports a chunk the parser has to read that exceeds
+// maxWAVHeaderSize.
+func chunkTooLarge(id string) error {
+	return &models.ConversionError{
+		Code:    models.ErrInvalidChunkSize,
+		Message: id + " chunk is too large",
+	}
+}
+
+// WAVHeader describes the chunks of a RIFF/WAVE, RF64 or BW64 file that
+// precede the sample data. Format.BitsPerSample is the number of valid bits in each sample,
+// which may be less than the size of the container it is stored in.
+// ParseAIFFHeader, ParseW64Header, ParseDSFHeader and ParseDFFHeader describe
+// AIFF, Wave64 and DSD files the same way.
+type WAVHeader struct {
+	// Form is the file's magic: "RIFF", or "RF64" or "BW64" for files whose
+	// sizes are in a ds64 chunk. AIFF files have their form type, "AIFF" or
+	// "AIFC", Wave64 files "W64", DSD files "DSF" or "DFF" and headerless
+	// PCM described by RawHeader "RAW".
+	Form   string
+	Format models.AudioFormat
+	// FormatTag is the format of the samples; for WAVE_FORMAT_EXTENSIBLE
+	// files it is taken from the sub-format GUID.
+	FormatTag     uint16
+	Extensible    bool
+	ContainerBits int
+	// ChannelMask assigns speakers to channels, or is zero when the file
+	// does not say.
+	ChannelMask uint32
+	BlockAlign  int
+	// BigEndian is set for signed big-endian samples, as stored in AIFF
+	// files. 8-bit AIFF samples are signed whatever their byte order.
+	BigEndian bool
+	// DSD describes the storage of the 1-bit samples of a DSD file, whose
+	// Format has DSD set and the DSD sample rate.
+	DSD *DSDLayout
+	// DataOffset is the position of the first sample byte in the file.
+	DataOffset int
+	// DataSize is the length of the data chunk in bytes, as declared, or
+	// UnknownDataSize when the data runs to the end of the stream.
+	DataSize int64
+	// Chunks holds the chunks other than ds64, fmt and data that precede the
+	// sample data, in file order.
+	Chunks []Chunk
+}
+
+// Chunk is a RIFF chunk kept for its metadata.
+type Chunk struct {
+	ID   string
+	Data []byte
+}
+
+// IsAIFF reports whether the header was read from an AIFF or AIFF-C file,
+// whose chunks have big-endian sizes.
+func (h *WAVHeader) IsAIFF() bool {
+	return h.Form == "AIFF" || h.Form == "AIFC"
+}
+
+// IsRIFF reports whether the header was read from a RIFF/WAVE, RF64 or BW64
+// file.
+func (h *WAVHeader) IsRIFF() bool {
+	return h.Form == "RIFF" || h.Form == "RF64" || h.Form == "BW64"
+}
+
+// TrailingChunks returns the complete chunks in tail, the bytes that follow
+// the sample data of the file, skipping the padding after the samples.
+func (h *WAVHeader) TrailingChunks(tail []byte) []Chunk {
+	if h.DSD != nil {
+		// DSD files carry no RIFF-style metadata after the samples
+		return nil
+	}
+	pad := h.DataPadding()
+	if pad > int64(len(tail)) {
+		return nil
+	}
+	switch {
+	case h.Form == "W64":
+		return parseW64Chunks(tail[pad:])
+	case h.IsAIFF():
+		return ParseAIFFChunks(tail[pad:])
+	default:
+		return ParseChunks(tail[pad:])
+	}
+}
+
+// DataPadding returns the number of padding bytes between the samples and
+// the next chunk.
+func (h *WAVHeader) DataPadding() int64 {
+	switch {
+	case h.Form == "W64":
+		return -(int64(h.DataOffset) + h.DataSize) & 7
+	case h.IsAIFF():
+		// The SSND chunk also holds the offset before the samples, so its
+		// padding depends on where the samples end
+		return (int64(h.DataOffset) + h.DataSize) & 1
+	default:
+		return h.DataSize & 1
+	}
+}
+
+// UnknownDataSize is the DataSize of a header written before the length of
+// the recording was known. Live recorders leave the data size at 0 or
+// 0xFFFFFFFF; the audio then continues until the stream ends. A data size of
+// 0 in a file whose RIFF size declares chunks after the data chunk is an
+// empty data chunk instead.
+const UnknownDataSize = -1
+
+// rf64SizePlaceholder replaces a 32-bit size in an RF64 or BW64 file whose
+// real value is in the ds64 chunk.
+const rf64SizePlaceholder = 0xFFFFFFFF
+
+// ds64Chunk holds the 64-bit sizes of an RF64 or BW64 file.
+type ds64Chunk struct {
+	dataSize int64
+	// table holds the sizes of other chunks larger than 4 GB.
+	table map[string]int64
+}
+
+// ParseWAVHeader walks the RIFF chunks at the start of data up to the data
+// chunk, parsing the fmt chunk on the way. Other chunks are kept in Chunks
+// while they fit in maxWAVHeaderSize and skipped otherwise. RF64 and BW64
+// files take their sizes from the ds64 chunk.
+func ParseWAVHeader(data []byte) (*WAVHeader, error) {
+	if len(data) < 12 {
+		return nil, ErrIncompleteHeader
+	}
+	form := string(data[0:4])
+	if form != "RIFF" && form != "RF64" && form != "BW64" {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid RIFF header",
+		}
+	}
+	if string(data[8:12]) != "WAVE" {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid WAVE form type",
+		}
+	}
+
+	var (
+		header *WAVHeader
+		ds64   *ds64Chunk
+		chunks []Chunk
+		// kept counts the bytes of the chunks in chunks
+		kept int64
+	)
+	pos := 12
+	for {
+		if len(data) < pos+8 {
+			return nil, ErrIncompleteHeader
+		}
+		id := string(data[pos : pos+4])
+		size := int64(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := pos + 8
+
+		if form != "RIFF" {
+			if ds64 == nil && id != "ds64" {
+				return nil, &models.ConversionError{
+					Code:    models.ErrInvalidFormat,
+					Message: form + " file does not start with a ds64 chunk",
+				}
+			}
+			if size == rf64SizePlaceholder && ds64 != nil {
+				if id == "data" {
+					size = ds64.dataSize
+				} else if tableSize, ok := ds64.table[id]; ok {
+					size = tableSize
+				}
+			}
+		}
+
+		if (id == "ds64" || id == "fmt ") && size > maxWAVHeaderSize {
+			return nil, chunkTooLarge(id)
+		}
+		switch id {
+		case "ds64":
+			if int64(len(data)) < int64(body)+size {
+				return nil, ErrIncompleteHeader
+			}
+			chunk, err := parseDS64Chunk(data[body : int64(body)+size])
+			if err != nil {
+				return nil, err
+			}
+			ds64 = chunk
+		case "fmt ":
+			if int64(len(data)) < int64(body)+size {
+				return nil, ErrIncompleteHeader
+			}
+			fmtChunk, err := parseFmtChunk(data[body : int64(body)+size])
+			if err != nil {
+				return nil, err
+			}
+			header = fmtChunk
+		case "data":
+			if header == nil {
+				return nil, &models.ConversionError{
+					Code:    models.ErrInvalidFormat,
+					Message: "Data chunk precedes fmt chunk",
+				}
+			}
+			if (size == 0 && !riffHasChunksAfter(data, body)) || (form == "RIFF" && size == rf64SizePlaceholder) {
+				size = UnknownDataSize
+			}
+			header.Form = form
+			header.DataOffset = body
+			header.DataSize = size
+			header.Chunks = chunks
+			return header, nil
+		default:
+			if kept+size > maxWAVHeaderSize {
+				break
+			}
+			if int64(len(data)) < int64(body)+size {
+				return nil, ErrIncompleteHeader
+			}
+			kept += size
+			chunks = append(chunks, Chunk{ID: id, Data: append([]byte(nil), data[body:int64(body)+size]...)})
+		}
+
+		// Chunks are padded to an even length
+		pos = int(int64(body) + size + size&1)
+	}
+}
+
+// riffHasChunksAfter reports whether the RIFF size of a file declares bytes
+// after offset, where an empty data chunk ends. A data size of 0 then really
+// means no audio; otherwise it is a live recorder's placeholder, as is a RIFF
+// size of 0 or 0xFFFFFFFF.
+func riffHasChunksAfter(data []byte, offset int) bool {
+	riffSize := int64(binary.LittleEndian.Uint32(data[4:8]))
+	if riffSize == 0 || riffSize == rf64SizePlaceholder {
+		return false
+	}
+	return 8+riffSize > int64(offset)
+}
+
+// ParseChunks returns the complete RIFF chunks at the start of data, such as
+// the bytes that follow the data chunk of a file.
+func ParseChunks(data []byte) []Chunk {
+	return parseChunks(data, binary.LittleEndian)
+}
+
+func parseChunks(data []byte, order binary.ByteOrder) []Chunk {
+	var chunks []Chunk
+	pos := int64(0)
+	for pos+8 <= int64(len(data)) {
+		id := string(data[pos : pos+4])
+		size := int64(order.Uint32(data[pos+4 : pos+8]))
+		body := pos + 8
+		if body+size > int64(len(data)) {
+			break
+		}
+		chunks = append(chunks, Chunk{ID: id, Data: append([]byte(nil), data[body:body+size]...)})
+		pos = body + size + size&1
+	}
+	return chunks
+}
+
+// parseDS64Chunk reads the 64-bit RIFF and data sizes of an RF64 or BW64
+// file and the table of other large chunks.
+func parseDS64Chunk(body []byte) (*ds64Chunk, error) {
+	if len(body) < 28 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidChunkSize,
+			Message: "ds64 chunk is too short",
+		}
+	}
+	chunk := &ds64Chunk{
+		dataSize: int64(binary.LittleEndian.Uint64(body[8:16])),
+		table:    make(map[string]int64),
+	}
+	if chunk.dataSize < 0 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "ds64 data size is out of range",
+		}
+	}
+	entries := int(binary.LittleEndian.Uint32(body[24:28]))
+	for i, pos := 0, 28; i < entries && pos+12 <= len(body); i, pos = i+1, pos+12 {
+		chunk.table[string(body[pos:pos+4])] = int64(binary.LittleEndian.Uint64(body[pos+4 : pos+12]))
+	}
+	return chunk, nil
+}
+
+// parseFmtChunk validates the body of a fmt chunk, including the
+// WAVE_FORMAT_EXTENSIBLE extension.
+func parseFmtChunk(body []byte) (*WAVHeader, error) {
+	if len(body) < 16 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidChunkSize,
+			Message: "fmt chunk is too short",
+		}
+	}
+
+	header := &WAVHeader{
+		FormatTag:     binary.LittleEndian.Uint16(body[0:2]),
+		BlockAlign:    int(binary.LittleEndian.Uint16(body[12:14])),
+		ContainerBits: int(binary.LittleEndian.Uint16(body[14:16])),
+		Format: models.AudioFormat{
+			NumChannels: int(binary.LittleEndian.Uint16(body[2:4])),
+			SampleRate:  int(binary.LittleEndian.Uint32(body[4:8])),
+		},
+	}
+	header.Format.BitsPerSample = header.ContainerBits
+
+	if header.FormatTag == WAVFormatExtensible {
+		if err := parseFmtExtension(header, body); err != nil {
+			return nil, err
+		}
+	}
+	switch header.FormatTag {
+	case WAVFormatPCM:
+	case WAVFormatIEEEFloat:
+		if header.Format.BitsPerSample != 32 && header.Format.BitsPerSample != 64 {
+			return nil, &models.ConversionError{
+				Code:    models.ErrInvalidFormat,
+				Message: "Floating-point samples must be 32 or 64 bits",
+			}
+		}
+		header.Format.Float = true
+	default:
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Unsupported WAV format tag",
+		}
+	}
+	format := header.Format
+	if format.NumChannels <= 0 || format.SampleRate <= 0 || format.BitsPerSample <= 0 {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Invalid channel count, sample rate or bit depth",
+		}
+	}
+	// Samples are stored in whole bytes
+	containerBytes := (header.ContainerBits + 7) / 8
+	if header.BlockAlign != format.NumChannels*containerBytes {
+		return nil, &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Block alignment does not match channels and bit depth",
+		}
+	}
+	header.ContainerBits = containerBytes * 8
+
+	return header, nil
+}
+
+// parseFmtExtension reads the valid bits per sample, channel mask and
+// sub-format of a WAVE_FORMAT_EXTENSIBLE fmt chunk. The sub-format replaces
+// the format tag.
+func parseFmtExtension(header *WAVHeader, body []byte) error {
+	if len(body) < 40 || binary.LittleEndian.Uint16(body[16:18]) < 22 {
+		return &models.ConversionError{
+			Code:    models.ErrInvalidChunkSize,
+			Message: "WAVE_FORMAT_EXTENSIBLE fmt chunk is too short",
+		}
+	}
+	guid := body[24:40]
+	if !bytes.Equal(guid[2:], wavSubFormatSuffix) {
+		return &models.ConversionError{
+			Code:    models.ErrInvalidFormat,
+			Message: "Unsupported WAVE_FORMAT_EXTENSIBLE sub-format",
+		}
+	}
+
+	header.Extensible = true
+	header.FormatTag = binary.LittleEndian.Uint16(guid[0:2])
+	header.ChannelMask = binary.LittleEndian.Uint32(body[20:24])
+	// Zero valid bits means every bit of the container is used
+	if validBits := int(binary.LittleEndian.Uint16(body[18:20])); validBits != 0 {
+		if validBits > header.ContainerBits {
+			return &models.ConversionError{
+				Code:    models.ErrInvalidFormat,
+				Message: "Valid bits per sample exceed the container size",
+			}
+		}
+		header.Format.BitsPerSample = validBits
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"audio-converter/internal/models"
+)
+
+// InfoTag is a text field of a LIST/INFO chunk, such as INAM or IART.
+type InfoTag struct {
+	ID    string
+	Value string
+}
+
+// ParseInfoList returns the text fields of a LIST chunk body with the INFO
+// list type. Other list types and empty fields yield nothing.
+func ParseInfoList(body []byte) []InfoTag {
+	if len(body) < 4 || string(body[:4]) != "INFO" {
+		return nil
+	}
+	var tags []InfoTag
+	for pos := 4; pos+8 <= len(body); {
+		id := string(body[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(body[pos+4 : pos+8]))
+		pos += 8
+		if size > len(body)-pos {
+			size = len(body) - pos
+		}
+		if value := riffText(body[pos : pos+size]); value != "" {
+			tags = append(tags, InfoTag{ID: id, Value: value})
+		}
+		pos += size + size&1
+	}
+	return tags
+}
+
+// BroadcastExtension holds the fields of a Broadcast WAV bext chunk, as
+// defined by EBU Tech 3285.
+type BroadcastExtension struct {
+	Description         string
+	Originator          string
+	OriginatorReference string
+	OriginationDate     string
+	OriginationTime     string
+	TimeReference       uint64
+	Version             uint16
+	UMID                []byte
+	// The loudness fields are in hundredths of LU or dB and were added in
+	// version 2.
+	LoudnessValue        int16
+	LoudnessRange        int16
+	MaxTruePeakLevel     int16
+	MaxMomentaryLoudness int16
+	MaxShortTermLoudness int16
+	CodingHistory        string
+}
+
+// bextFixedSize is the length of a bext chunk up to the coding history.
+const bextFixedSize = 602
+
+// ParseBroadcastExtension decodes a bext chunk body, or returns nil when it
+// is too short to be one. UMID is nil when the chunk has none.
+func ParseBroadcastExtension(body []byte) *BroadcastExtension {
+	if len(body) < bextFixedSize {
+		return nil
+	}
+	ext := &BroadcastExtension{
+		Description:         riffText(body[0:256]),
+		Originator:          riffText(body[256:288]),
+		OriginatorReference: riffText(body[288:320]),
+		OriginationDate:     riffText(body[320:330]),
+		OriginationTime:     riffText(body[330:338]),
+		TimeReference:       binary.LittleEndian.Uint64(body[338:346]),
+		Version:             binary.LittleEndian.Uint16(body[346:348]),
+		CodingHistory:       riffText(body[bextFixedSize:]),
+	}
+	if umid := body[348:412]; !isZero(umid) {
+		ext.UMID = append([]byte(nil), umid...)
+	}
+	if ext.Version >= 2 {
+		loudness := body[412:422]
+		ext.LoudnessValue = int16(binary.LittleEndian.Uint16(loudness[0:2]))
+		ext.LoudnessRange = int16(binary.LittleEndian.Uint16(loudness[2:4]))
+		ext.MaxTruePeakLevel = int16(binary.LittleEndian.Uint16(loudness[4:6]))
+		ext.MaxMomentaryLoudness = int16(binary.LittleEndian.Uint16(loudness[6:8]))
+		ext.MaxShortTermLoudness = int16(binary.LittleEndian.Uint16(loudness[8:10]))
+	}
+	return ext
+}
+
+// ParseIXML returns the XML document of an iXML chunk.
+func ParseIXML(body []byte) string {
+	return riffText(body)
+}
+
+// ParseCueChunk returns the cue points of a cue chunk body. Offsets are the
+// sample offsets into the data chunk; labels are kept in a separate adtl
+// list, see ParseCueLabels.
+func ParseCueChunk(body []byte) []models.CuePoint {
+	if len(body) < 4 {
+		return nil
+	}
+	n := int(binary.LittleEndian.Uint32(body[0:4]))
+	var cues []models.CuePoint
+	for i, pos := 0, 4; i < n && pos+24 <= len(body); i, pos = i+1, pos+24 {
+		cues = append(cues, models.CuePoint{
+			ID:     binary.LittleEndian.Uint32(body[pos : pos+4]),
+			Offset: uint64(binary.LittleEndian.Uint32(body[pos+20 : pos+24])),
+		})
+	}
+	return cues
+}
+
+// ParseCueLabels returns the labl texts of a LIST chunk body with the adtl
+// list type, by cue point ID.
+func ParseCueLabels(body []byte) map[uint32]string {
+	if len(body) < 4 || string(body[:4]) != "adtl" {
+		return nil
+	}
+	labels := make(map[uint32]string)
+	for _, chunk := range ParseChunks(body[4:]) {
+		if chunk.ID == "labl" && len(chunk.Data) >= 4 {
+			labels[binary.LittleEndian.Uint32(chunk.Data[:4])] = riffText(chunk.Data[4:])
+		}
+	}
+	return labels
+}
+
+// sampleLoopTypes names the loop types of a smpl chunk.
+var sampleLoopTypes = map[uint32]string{0: "forward", 1: "alternating", 2: "backward"}
+
+// ParseSamplerChunk returns the loops of a smpl chunk body. Malformed loops
+// that end before they start are skipped.
+func ParseSamplerChunk(body []byte) []models.SampleLoop {
+	if len(body) < 36 {
+		return nil
+	}
+	n := int(binary.LittleEndian.Uint32(body[28:32]))
+	var loops []models.SampleLoop
+	for i, pos := 0, 36; i < n && pos+24 <= len(body); i, pos = i+1, pos+24 {
+		typ := binary.LittleEndian.Uint32(body[pos+4 : pos+8])
+		name, ok := sampleLoopTypes[typ]
+		if !ok {
+			name = strconv.FormatUint(uint64(typ), 10)
+		}
+		start := uint64(binary.LittleEndian.Uint32(body[pos+8 : pos+12]))
+		end := uint64(binary.LittleEndian.Uint32(body[pos+12 : pos+16]))
+		if end < start {
+			continue
+		}
+		loops = append(loops, models.SampleLoop{
+			CuePointID: binary.LittleEndian.Uint32(body[pos : pos+4]),
+			Type:       name,
+			Start:      start,
+			End:        end,
+			PlayCount:  binary.LittleEndian.Uint32(body[pos+20 : pos+24]),
+		})
+	}
+	return loops
+}
+
+// riffText decodes a NUL-terminated or NUL-padded text field. RIFF text has
+// no declared encoding; anything that is not valid UTF-8 is read as Latin-1.
+func riffText(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	if !utf8.Valid(b) {
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return strings.TrimSpace(string(runes))
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Encode returns the bytes of a WAV file up to its first sample: the RIFF
+// header, the fmt chunk and the data chunk header. Data too large for 32-bit
+// sizes is described by a ds64 chunk in an RF64 file, and an UnknownDataSize
+// is written as 0xFFFFFFFF, as live recorders do. Chunks and DataOffset are
+// ignored.
+func (h *WAVHeader) Encode() []byte {
+	fmtChunk := new(bytes.Buffer)
+	tag := h.FormatTag
+	if h.Extensible {
+		tag = WAVFormatExtensible
+	}
+	containerBytes := (h.ContainerBits + 7) / 8
+	binary.Write(fmtChunk, binary.LittleEndian, tag)
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(h.Format.NumChannels))
+	binary.Write(fmtChunk, binary.LittleEndian, uint32(h.Format.SampleRate))
+	binary.Write(fmtChunk, binary.LittleEndian, uint32(h.Format.SampleRate*h.Format.NumChannels*containerBytes))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(h.Format.NumChannels*containerBytes))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(containerBytes*8))
+	if h.Extensible {
+		binary.Write(fmtChunk, binary.LittleEndian, uint16(22))
+		binary.Write(fmtChunk, binary.LittleEndian, uint16(h.Format.BitsPerSample))
+		binary.Write(fmtChunk, binary.LittleEndian, h.ChannelMask)
+		binary.Write(fmtChunk, binary.LittleEndian, h.FormatTag)
+		fmtChunk.Write(wavSubFormatSuffix)
+	}
+
+	// Everything after the RIFF size field
+	riffSize := int64(4+8+fmtChunk.Len()+8) + h.DataSize + h.DataSize&1
+	rf64 := riffSize > rf64SizePlaceholder
+	if rf64 {
+		riffSize += 8 + 28
+	}
+
+	buf := new(bytes.Buffer)
+	switch {
+	case rf64:
+		buf.WriteString("RF64")
+		binary.Write(buf, binary.LittleEndian, uint32(rf64SizePlaceholder))
+	case h.DataSize == UnknownDataSize:
+		buf.WriteString("RIFF")
+		binary.Write(buf, binary.LittleEndian, uint32(rf64SizePlaceholder))
+	default:
+		buf.WriteString("RIFF")
+		binary.Write(buf, binary.LittleEndian, uint32(riffSize))
+	}
+	buf.WriteString("WAVE")
+	if rf64 {
+		buf.WriteString("ds64")
+		binary.Write(buf, binary.LittleEndian, uint32(28))
+		binary.Write(buf, binary.LittleEndian, uint64(riffSize))
+		binary.Write(buf, binary.LittleEndian, uint64(h.DataSize))
+		binary.Write(buf, binary.LittleEndian, uint64(h.DataSize/int64(h.Format.NumChannels*containerBytes)))
+		binary.Write(buf, binary.LittleEndian, uint32(0))
+	}
+	buf.WriteString("fmt ")
+	binary.Write(buf, binary.LittleEndian, uint32(fmtChunk.Len()))
+	buf.Write(fmtChunk.Bytes())
+	buf.WriteString("data")
+	if rf64 || h.DataSize == UnknownDataSize {
+		binary.Write(buf, binary.LittleEndian, uint32(rf64SizePlaceholder))
+	} else {
+		binary.Write(buf, binary.LittleEndian, uint32(h.DataSize))
+	}
+	return buf.Bytes()
+}
@@ -2,17 +2,22 @@ package integration
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	
+	"io"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
 	"github.com/stretchr/testify/assert"
-	
 )
 
 // TestConfig holds test configuration
@@ -198,21 +203,32 @@ func TestErrorHandling(t *testing.T) {
 		name string
 		data []byte
 		expectedError bool
+		expectedCode string
+		expectedFatal bool
+		expectedCloseCode int
 	}{
 		{
 			name: "Invalid WAV header",
 			data: []byte("NOT A WAV FILE"),
 			expectedError: true,
+			expectedCode: "INVALID_FORMAT",
+			expectedFatal: true,
+			expectedCloseCode: websocket.CloseUnsupportedData,
 		},
 		{
 			name: "Empty data",
 			data: []byte{},
 			expectedError: true,
+			expectedCode: "INVALID_CHUNK_SIZE",
+			expectedFatal: false,
 		},
 		{
 			name: "Corrupted WAV data",
 			data: createCorruptedWAVData(),
 			expectedError: true,
+			expectedCode: "INVALID_FORMAT",
+			expectedFatal: true,
+			expectedCloseCode: websocket.CloseUnsupportedData,
 		},
 	}
 	
@@ -226,26 +242,720 @@ func TestErrorHandling(t *testing.T) {
 			
 			err = ws.WriteMessage(websocket.BinaryMessage, tt.data)
 			if err != nil {
-				if !tt.expectedError {
-					t.Errorf("Unexpected error: %v", err)
-				}
+				t.Fatalf("Failed to send data: %v", err)
+			}
+			
+			ws.SetReadDeadline(time.Now().Add(time.Duration(testConfig.TimeoutSeconds) * time.Second))
+			mt, response, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if !tt.expectedError {
+				assert.Equal(t, websocket.BinaryMessage, mt, "Expected FLAC data")
 				return
 			}
 			
-			// _, response, err := ws.ReadMessage()
-			if tt.expectedError {
-				if err == nil {
-					t.Error("Expected error but got none")
-				}
-			} else if err != nil {
-				t.Errorf("Unexpected error: %v", err)
+			var event struct {
+				Type    string `json:"type"`
+				Code    string `json:"code"`
+				Message string `json:"message"`
+				Fatal   bool   `json:"fatal"`
+			}
+			assert.Equal(t, websocket.TextMessage, mt, "Expected an error event")
+			if err := json.Unmarshal(response, &event); err != nil {
+				t.Fatalf("Invalid error event %q: %v", response, err)
+			}
+			assert.Equal(t, "error", event.Type)
+			assert.Equal(t, tt.expectedCode, event.Code)
+			assert.Equal(t, tt.expectedFatal, event.Fatal)
+			assert.NotEmpty(t, event.Message)
+			
+			if tt.expectedFatal {
+				_, _, err = ws.ReadMessage()
+				assert.True(t, websocket.IsCloseError(err, tt.expectedCloseCode), "Expected close code %d, got %v", tt.expectedCloseCode, err)
 			}
 		})
 	}
 }
 
+func TestFinishFlushesTrailingAudio(t *testing.T) {
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	// Far less audio than one FLAC block
+	wavData := createTestWAVData(44100, 2, 16)
+	if err := ws.WriteMessage(websocket.BinaryMessage, wavData); err != nil {
+		t.Fatalf("Failed to send WAV data: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+		t.Fatalf("Failed to send finish: %v", err)
+	}
+
+	flacData, done := readUntilDone(t, ws)
+	assert.True(t, done, "Server should send a done event")
+	assert.Equal(t, 256*2, countFLACSamples(t, flacData), "All samples should be encoded")
+
+	// The server hangs up after the done event
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "Expected a normal closure, got %v", err)
+}
+
+func TestNormalCloseFlushesTrailingAudio(t *testing.T) {
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	wavData := createTestWAVData(44100, 2, 16)
+	if err := ws.WriteMessage(websocket.BinaryMessage, wavData); err != nil {
+		t.Fatalf("Failed to send WAV data: %v", err)
+	}
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Failed to send close: %v", err)
+	}
+
+	flacData, done := readUntilDone(t, ws)
+	assert.True(t, done, "Server should send a done event before closing")
+	assert.Equal(t, 256*2, countFLACSamples(t, flacData), "All samples should be encoded")
+}
+
+func TestControlProtocol(t *testing.T) {
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(time.Duration(testConfig.TimeoutSeconds) * time.Second))
+
+	send := func(msg string) {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("Failed to send %s: %v", msg, err)
+		}
+	}
+	next := func() map[string]interface{} {
+		for {
+			mt, message, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("Failed to read event: %v", err)
+			}
+			if mt != websocket.TextMessage {
+				continue
+			}
+			var event map[string]interface{}
+			if err := json.Unmarshal(message, &event); err != nil {
+				t.Fatalf("Invalid event %q: %v", message, err)
+			}
+			return event
+		}
+	}
+
+	send(`{"version":1,"type":"start","options":{"progressInterval":0,"compressionLevel":9}}`)
+	rejected := next()
+	assert.Equal(t, "error", rejected["type"])
+	assert.Equal(t, "INVALID_FORMAT", rejected["code"])
+	assert.Equal(t, false, rejected["fatal"])
+
+	send(`{"version":1,"type":"start","options":{"progressInterval":0,"compressionLevel":8,"blockSize":1024}}`)
+	ready := next()
+	assert.Equal(t, "ready", ready["type"])
+	assert.Equal(t, float64(1), ready["version"])
+	options := ready["options"].(map[string]interface{})
+	assert.Equal(t, float64(8), options["compressionLevel"])
+	assert.Equal(t, float64(1024), options["blockSize"])
+	assert.Equal(t, float64(12), options["maxLpcOrder"])
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, createTestWAVData(44100, 2, 16)); err != nil {
+		t.Fatalf("Failed to send WAV data: %v", err)
+	}
+	format := next()
+	assert.Equal(t, "format", format["type"])
+	assert.Equal(t, map[string]interface{}{
+		"sampleRate":    float64(44100),
+		"channels":      float64(2),
+		"bitsPerSample": float64(16),
+	}, format["format"])
+
+	send(`{"type":"ping"}`)
+	progress := next()
+	assert.Equal(t, "progress", progress["type"])
+	assert.Equal(t, float64(256), progress["samplesEncoded"])
+
+	send(`{"type":"bogus"}`)
+	assert.Equal(t, "error", next()["type"])
+
+	send(`{"type":"finish"}`)
+	header := next()
+	assert.Equal(t, "header", header["type"])
+	assert.Equal(t, float64(8), header["offset"])
+	stats := next()
+	assert.Equal(t, "stats", stats["type"])
+	assert.Equal(t, float64(256), stats["stats"].(map[string]interface{})["totalSamples"])
+	assert.Equal(t, "done", next()["type"])
+}
+
+func TestCancel(t *testing.T) {
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, createTestWAVData(44100, 2, 16)); err != nil {
+		t.Fatalf("Failed to send WAV data: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"cancel"}`)); err != nil {
+		t.Fatalf("Failed to send cancel: %v", err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Duration(testConfig.TimeoutSeconds) * time.Second))
+	for {
+		mt, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Connection closed before the done event: %v", err)
+		}
+		if mt == websocket.TextMessage && bytes.Contains(message, []byte(`"done"`)) {
+			assert.Contains(t, string(message), `"cancelled":true`)
+			return
+		}
+	}
+}
+
+func TestFloatInputReportsClipping(t *testing.T) {
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(time.Duration(testConfig.TimeoutSeconds) * time.Second))
+
+	start := `{"type":"start","options":{"floatBitsPerSample":16,"dither":"tpdf"}}`
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(start)); err != nil {
+		t.Fatalf("Failed to send start: %v", err)
+	}
+	samples := make([]float32, 512)
+	for i := range samples {
+		samples[i] = float32(i%100) / 80 // peaks at 1.2375
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, createFloatWAVData(44100, 2, samples)); err != nil {
+		t.Fatalf("Failed to send WAV data: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+		t.Fatalf("Failed to send finish: %v", err)
+	}
+
+	for {
+		mt, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Connection ended before stats: %v", err)
+		}
+		if mt != websocket.TextMessage {
+			continue
+		}
+		var event struct {
+			Type  string `json:"type"`
+			Stats struct {
+				Clipped        bool `json:"clipped"`
+				ClippedSamples int  `json:"clippedSamples"`
+				InputFormat    struct {
+					BitsPerSample int  `json:"bitsPerSample"`
+					Float         bool `json:"float"`
+				} `json:"inputFormat"`
+				OutputFormat struct {
+					BitsPerSample int `json:"bitsPerSample"`
+				} `json:"outputFormat"`
+			} `json:"stats"`
+		}
+		if err := json.Unmarshal(message, &event); err != nil {
+			t.Fatalf("Invalid event %q: %v", message, err)
+		}
+		if event.Type != "stats" {
+			continue
+		}
+		assert.True(t, event.Stats.Clipped)
+		// Values from 80/80 to 99/80 are beyond the largest integer in each
+		// of 5 periods
+		assert.Equal(t, 5*20, event.Stats.ClippedSamples)
+		assert.True(t, event.Stats.InputFormat.Float)
+		assert.Equal(t, 32, event.Stats.InputFormat.BitsPerSample)
+		assert.Equal(t, 16, event.Stats.OutputFormat.BitsPerSample)
+		return
+	}
+}
+
 // Helper functions
 
+// readUntilDone collects binary messages until the server sends its done
+// event or the connection closes.
+func TestOggContainer(t *testing.T) {
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"start","options":{"container":"ogg"}}`)); err != nil {
+		t.Fatalf("Failed to send start: %v", err)
+	}
+	_, message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read ready: %v", err)
+	}
+	var ready struct {
+		Type    string `json:"type"`
+		Options struct {
+			Container string `json:"container"`
+		} `json:"options"`
+	}
+	json.Unmarshal(message, &ready)
+	assert.Equal(t, "ready", ready.Type)
+	assert.Equal(t, "ogg", ready.Options.Container)
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, createTestWAVData(44100, 2, 16)); err != nil {
+		t.Fatalf("Failed to send WAV data: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+		t.Fatalf("Failed to send finish: %v", err)
+	}
+	oggData, done := readUntilDone(t, ws)
+	assert.True(t, done, "Server should send a done event")
+	if assert.Greater(t, len(oggData), 32, "Server should send Ogg pages") {
+		assert.Equal(t, "OggS", string(oggData[:4]))
+		assert.Equal(t, "\x7fFLAC", string(oggData[28:33]), "First packet should carry the FLAC mapping header")
+	}
+}
+
+func TestDecodeOverWebSocket(t *testing.T) {
+	wavData := createTestWAVData(44100, 2, 16)
+	flacData := convertOverWebSocket(t, wavData)
+
+	ws, _, err := websocket.DefaultDialer.Dial(strings.Replace(testConfig.ServerURL, "/ws/convert", "/ws/decode", 1), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	// Feed the stream in pieces that split frames
+	for pos := 0; pos < len(flacData); pos += 100 {
+		end := pos + 100
+		if end > len(flacData) {
+			end = len(flacData)
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, flacData[pos:end]); err != nil {
+			t.Fatalf("Failed to send FLAC data: %v", err)
+		}
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+		t.Fatalf("Failed to send finish: %v", err)
+	}
+
+	decoded, done := readUntilDone(t, ws)
+	assert.True(t, done, "Server should send a done event")
+	if assert.Greater(t, len(decoded), 44, "Server should send a WAV file") {
+		assert.Equal(t, "RIFF", string(decoded[:4]))
+		assert.Equal(t, wavData[44:], decoded[44:], "Decoded samples should match the original")
+	}
+}
+
+func TestDecodeOverHTTP(t *testing.T) {
+	wavData := createTestWAVData(44100, 2, 16)
+	flacData := convertOverWebSocket(t, wavData)
+	decodeURL := strings.Replace(strings.Replace(testConfig.ServerURL, "ws://", "http://", 1), "/ws/convert", "/decode", 1)
+
+	resp, err := http.Post(decodeURL, "audio/flac", bytes.NewReader(flacData))
+	if err != nil {
+		t.Fatalf("Failed to post FLAC data: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "audio/wav", resp.Header.Get("Content-Type"))
+	if assert.Equal(t, len(wavData), len(body), "Decoded file should have the original length") {
+		assert.Equal(t, uint32(len(wavData)-8), binary.LittleEndian.Uint32(body[4:8]), "RIFF size should be filled in")
+		assert.Equal(t, wavData[44:], body[44:], "Decoded samples should match the original")
+	}
+
+	// Anything but FLAC is rejected with a JSON error
+	resp, err = http.Post(decodeURL, "audio/flac", bytes.NewReader(wavData))
+	if err != nil {
+		t.Fatalf("Failed to post WAV data: %v", err)
+	}
+	var apiErr struct {
+		Code string `json:"code"`
+	}
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	assert.Equal(t, "INVALID_FORMAT", apiErr.Code)
+}
+
+func TestRawPCMOverWebSocket(t *testing.T) {
+	wavData := createTestWAVData(44100, 2, 16)
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	start := `{"type":"start","options":{"rawSampleRate":44100,"rawChannels":2,"rawBitsPerSample":16}}`
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(start)); err != nil {
+		t.Fatalf("Failed to send start: %v", err)
+	}
+	_, message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read ready: %v", err)
+	}
+	var ready struct {
+		Type    string `json:"type"`
+		Options struct {
+			ByteOrder string `json:"rawByteOrder"`
+			Signed    *bool  `json:"rawSigned"`
+		} `json:"options"`
+	}
+	json.Unmarshal(message, &ready)
+	assert.Equal(t, "ready", ready.Type)
+	assert.Equal(t, "little", ready.Options.ByteOrder, "Ready event should echo the resolved byte order")
+	if assert.NotNil(t, ready.Options.Signed) {
+		assert.True(t, *ready.Options.Signed)
+	}
+
+	// Send the samples without the 44-byte header
+	if err := ws.WriteMessage(websocket.BinaryMessage, wavData[44:]); err != nil {
+		t.Fatalf("Failed to send PCM data: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+		t.Fatalf("Failed to send finish: %v", err)
+	}
+	flacData, done := readUntilDone(t, ws)
+	assert.True(t, done, "Server should send a done event")
+	assert.Equal(t, convertOverWebSocket(t, wavData)[42:], flacData[42:], "Raw PCM should encode like the WAV file")
+}
+
+func TestConvertOverHTTP(t *testing.T) {
+	wavData := createTestWAVData(44100, 2, 16)
+	convertURL := strings.Replace(strings.Replace(testConfig.ServerURL, "ws://", "http://", 1), "/ws/convert", "/convert", 1)
+
+	resp, err := http.Post(convertURL, "audio/wav", bytes.NewReader(wavData))
+	if err != nil {
+		t.Fatalf("Failed to post WAV data: %v", err)
+	}
+	flacData, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "audio/flac", resp.Header.Get("Content-Type"))
+
+	resp, err = http.Post(convertURL+"?rawSampleRate=44100&rawChannels=2&rawBitsPerSample=16", "application/octet-stream", bytes.NewReader(wavData[44:]))
+	if err != nil {
+		t.Fatalf("Failed to post PCM data: %v", err)
+	}
+	rawFLAC, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	if assert.Equal(t, len(flacData), len(rawFLAC)) {
+		assert.Equal(t, flacData[42:], rawFLAC[42:], "Raw PCM should encode like the WAV file")
+	}
+
+	// An incomplete declaration is rejected with a JSON error
+	resp, err = http.Post(convertURL+"?rawSampleRate=44100", "application/octet-stream", bytes.NewReader(wavData[44:]))
+	if err != nil {
+		t.Fatalf("Failed to post PCM data: %v", err)
+	}
+	var apiErr struct {
+		Code string `json:"code"`
+	}
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	assert.Equal(t, "INVALID_FORMAT", apiErr.Code)
+}
+
+func TestReencodeOverWebSocket(t *testing.T) {
+	wavData := createTestWAVData(44100, 2, 16)
+	level0 := convertWithOptions(t, `{"compressionLevel":0}`, wavData)
+
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, level0); err != nil {
+		t.Fatalf("Failed to send FLAC data: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+		t.Fatalf("Failed to send finish: %v", err)
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Duration(testConfig.TimeoutSeconds) * time.Second))
+	var sizeSaved *int64
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read events: %v", err)
+		}
+		var event struct {
+			Type  string `json:"type"`
+			Stats struct {
+				SizeSaved *int64 `json:"sizeSaved"`
+			} `json:"stats"`
+		}
+		if json.Unmarshal(message, &event) != nil {
+			continue
+		}
+		if event.Type == "stats" {
+			sizeSaved = event.Stats.SizeSaved
+		}
+		if event.Type == "done" {
+			break
+		}
+	}
+	if assert.NotNil(t, sizeSaved, "Stats should report the size saved") {
+		assert.Greater(t, *sizeSaved, int64(0))
+	}
+}
+
+func TestVerifyOverWebSocket(t *testing.T) {
+	wavData := createTestWAVData(44100, 2, 16)
+	verified := convertWithOptions(t, `{"verify":true}`, wavData)
+	assert.Equal(t, convertOverWebSocket(t, wavData), verified, "Verification should not change the stream")
+}
+
+func TestFinalStreamInfo(t *testing.T) {
+	// Several frames, sent in messages that split them
+	pcm := new(bytes.Buffer)
+	for i := 0; i < 2*10000; i++ {
+		binary.Write(pcm, binary.LittleEndian, int16(i*7%2000-1000))
+	}
+	wavData := createTestWAVData(44100, 2, 16)[:40]
+	wavData = binary.LittleEndian.AppendUint32(wavData, uint32(pcm.Len()))
+	wavData = append(wavData, pcm.Bytes()...)
+
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+	for pos := 0; pos < len(wavData); pos += 3000 {
+		end := pos + 3000
+		if end > len(wavData) {
+			end = len(wavData)
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, wavData[pos:end]); err != nil {
+			t.Fatalf("Failed to send WAV data: %v", err)
+		}
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+		t.Fatalf("Failed to send finish: %v", err)
+	}
+	// readUntilDone applies the header event
+	flacData, done := readUntilDone(t, ws)
+	if !done {
+		t.Fatal("Conversion did not finish")
+	}
+
+	stream, err := flac.Parse(bytes.NewReader(flacData))
+	if err != nil {
+		t.Fatalf("Failed to parse FLAC stream: %v", err)
+	}
+	info := stream.Info
+	assert.Equal(t, uint64(10000), info.NSamples)
+	assert.Equal(t, md5.Sum(pcm.Bytes()), info.MD5sum, "STREAMINFO should carry the MD5 of the input audio")
+	assert.Equal(t, uint16(4096), info.BlockSizeMin)
+	assert.Equal(t, uint16(4096), info.BlockSizeMax)
+	assert.NotZero(t, info.FrameSizeMin)
+	assert.GreaterOrEqual(t, info.FrameSizeMax, info.FrameSizeMin)
+}
+
+func TestTrailingChunksKept(t *testing.T) {
+	// A LIST/INFO chunk after the audio arrives after the metadata was sent
+	list := []byte("INFOINAM\x06\x00\x00\x00Title\x00")
+	wavData := createTestWAVData(44100, 2, 16)
+	wavData = append(wavData, "LIST"...)
+	wavData = binary.LittleEndian.AppendUint32(wavData, uint32(len(list)))
+	wavData = append(wavData, list...)
+	binary.LittleEndian.PutUint32(wavData[4:], uint32(len(wavData)-8))
+
+	for _, container := range []string{"flac", "ogg"} {
+		ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect to WebSocket: %v", err)
+		}
+		defer ws.Close()
+		ws.SetReadDeadline(time.Now().Add(time.Duration(testConfig.TimeoutSeconds) * time.Second))
+
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"start","options":{"container":"`+container+`"}}`)); err != nil {
+			t.Fatalf("Failed to send start: %v", err)
+		}
+		if err := ws.WriteMessage(websocket.BinaryMessage, wavData); err != nil {
+			t.Fatalf("Failed to send WAV data: %v", err)
+		}
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+			t.Fatalf("Failed to send finish: %v", err)
+		}
+		var types []string
+		var output []byte
+		var stats map[string]interface{}
+		for len(types) == 0 || types[len(types)-1] != "done" {
+			mt, message, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("Failed to read event: %v", err)
+			}
+			if mt == websocket.BinaryMessage {
+				output = append(output, message...)
+				continue
+			}
+			var event struct {
+				Type   string                 `json:"type"`
+				Offset int                    `json:"offset"`
+				Data   []byte                 `json:"data"`
+				Stats  map[string]interface{} `json:"stats"`
+			}
+			if err := json.Unmarshal(message, &event); err != nil {
+				t.Fatalf("Invalid event %q: %v", message, err)
+			}
+			switch event.Type {
+			case "ready", "progress":
+				continue
+			case "header":
+				copy(output[event.Offset:], event.Data)
+			case "stats":
+				stats = event.Stats
+			}
+			types = append(types, event.Type)
+		}
+		assert.Equal(t, []string{"format", "header", "stats", "done"}, types, container)
+
+		if container == "ogg" {
+			// Only the first Ogg page is patched, so the tags are lost
+			assert.Equal(t, float64(8+len(list)), stats["discardedBytes"], container)
+			continue
+		}
+		assert.NotContains(t, stats, "discardedBytes", container)
+		stream, err := flac.Parse(bytes.NewReader(output))
+		if err != nil {
+			t.Fatalf("Failed to parse FLAC stream: %v", err)
+		}
+		var title string
+		for _, block := range stream.Blocks {
+			if comment, ok := block.Body.(*meta.VorbisComment); ok {
+				for _, tag := range comment.Tags {
+					if tag[0] == "TITLE" {
+						title = tag[1]
+					}
+				}
+			}
+		}
+		assert.Equal(t, "Title", title)
+	}
+}
+
+// convertWithOptions converts a whole file with the given start options.
+func convertWithOptions(t *testing.T, options string, data []byte) []byte {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"start","options":`+options+`}`)); err != nil {
+		t.Fatalf("Failed to send start: %v", err)
+	}
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatalf("Failed to read ready: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatalf("Failed to send data: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+		t.Fatalf("Failed to send finish: %v", err)
+	}
+	flacData, done := readUntilDone(t, ws)
+	if !done {
+		t.Fatal("Conversion did not finish")
+	}
+	return flacData
+}
+
+// convertOverWebSocket converts a whole WAV file on the conversion endpoint.
+func convertOverWebSocket(t *testing.T, wavData []byte) []byte {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(testConfig.ServerURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, wavData); err != nil {
+		t.Fatalf("Failed to send WAV data: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"finish"}`)); err != nil {
+		t.Fatalf("Failed to send finish: %v", err)
+	}
+	flacData, done := readUntilDone(t, ws)
+	if !done {
+		t.Fatal("Conversion did not finish")
+	}
+	return flacData
+}
+
+func readUntilDone(t *testing.T, ws *websocket.Conn) ([]byte, bool) {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(time.Duration(testConfig.TimeoutSeconds) * time.Second))
+	defer ws.SetReadDeadline(time.Time{})
+
+	var flacData []byte
+	for {
+		mt, message, err := ws.ReadMessage()
+		if err != nil {
+			return flacData, false
+		}
+		switch mt {
+		case websocket.BinaryMessage:
+			flacData = append(flacData, message...)
+		case websocket.TextMessage:
+			var event struct {
+				Type   string `json:"type"`
+				Offset int    `json:"offset"`
+				Data   []byte `json:"data"`
+			}
+			if err := json.Unmarshal(message, &event); err != nil {
+				t.Fatalf("Invalid event %q: %v", message, err)
+			}
+			switch event.Type {
+			case "header":
+				copy(flacData[event.Offset:], event.Data)
+			case "done":
+				return flacData, true
+			}
+		}
+	}
+}
+
+// countFLACSamples decodes a FLAC stream and returns its total sample count
+// across all channels.
+func countFLACSamples(t *testing.T, data []byte) int {
+	t.Helper()
+	stream, err := flac.New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse FLAC stream: %v", err)
+	}
+	var n int
+	for {
+		f, err := stream.ParseNext()
+		if err == io.EOF {
+			return n
+		}
+		if err != nil {
+			t.Fatalf("Failed to decode FLAC frame: %v", err)
+		}
+		n += int(f.BlockSize) * len(f.Subframes)
+	}
+}
+
 func createTestWAVData(sampleRate, channels, bitsPerSample int) []byte {
 	buf := new(bytes.Buffer)
 	
@@ -275,6 +985,26 @@ func createTestWAVData(sampleRate, channels, bitsPerSample int) []byte {
 	return buf.Bytes()
 }
 
+// createFloatWAVData builds a 32-bit IEEE floating-point WAV file.
+func createFloatWAVData(sampleRate, channels int, samples []float32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []byte("RIFF"))
+	binary.Write(buf, binary.LittleEndian, uint32(36+4*len(samples)))
+	binary.Write(buf, binary.LittleEndian, []byte("WAVE"))
+	binary.Write(buf, binary.LittleEndian, []byte("fmt "))
+	binary.Write(buf, binary.LittleEndian, uint32(16))
+	binary.Write(buf, binary.LittleEndian, uint16(3)) // WAVE_FORMAT_IEEE_FLOAT
+	binary.Write(buf, binary.LittleEndian, uint16(channels))
+	binary.Write(buf, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(buf, binary.LittleEndian, uint32(sampleRate*channels*4))
+	binary.Write(buf, binary.LittleEndian, uint16(channels*4))
+	binary.Write(buf, binary.LittleEndian, uint16(32))
+	binary.Write(buf, binary.LittleEndian, []byte("data"))
+	binary.Write(buf, binary.LittleEndian, uint32(4*len(samples)))
+	binary.Write(buf, binary.LittleEndian, samples)
+	return buf.Bytes()
+}
+
 func createCorruptedWAVData() []byte {
 	data := createTestWAVData(44100, 2, 16)
 	// Corrupt the format chunk
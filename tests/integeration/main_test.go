@@ -0,0 +1,64 @@
+package integration
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"audio-converter/internal/config"
+	"audio-converter/internal/handlers"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestMain runs the suite against the server at testConfig.ServerURL,
+// starting one in-process when nothing is listening there yet.
+func TestMain(m *testing.M) {
+	u, err := url.Parse(testConfig.ServerURL)
+	if err != nil {
+		log.Fatalf("Invalid server URL: %v", err)
+	}
+
+	var app *fiber.App
+	if !reachable(u.Host) {
+		cfg := config.New()
+		cfg.ServerPort = u.Host
+
+		app = fiber.New(fiber.Config{DisableStartupMessage: true})
+		if err := handlers.RegisterRoutes(app, cfg); err != nil {
+			log.Fatalf("Failed to register routes: %v", err)
+		}
+		go func() {
+			if err := app.Listen(cfg.ServerPort); err != nil {
+				log.Fatalf("Failed to start server: %v", err)
+			}
+		}()
+
+		deadline := time.Now().Add(time.Duration(testConfig.TimeoutSeconds) * time.Second)
+		for !reachable(u.Host) {
+			if time.Now().After(deadline) {
+				log.Fatalf("Server did not start on %s", u.Host)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	code := m.Run()
+
+	if app != nil {
+		app.Shutdown()
+	}
+	os.Exit(code)
+}
+
+func reachable(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
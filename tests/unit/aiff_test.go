@@ -0,0 +1,299 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"reflect"
+	"testing"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+	"audio-converter/pkg/utils"
+)
+
+func TestParseAIFFHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		aiff      []byte
+		format    models.AudioFormat
+		container int
+		bigEndian bool
+		dataSize  int64
+	}{
+		{"AIFF 16-bit", createAIFF(44100, 2, 16, "", make([]int32, 20)), models.AudioFormat{SampleRate: 44100, NumChannels: 2, BitsPerSample: 16}, 16, true, 40},
+		{"AIFF 20 bits in 24", createAIFF(96000, 1, 20, "", make([]int32, 5)), models.AudioFormat{SampleRate: 96000, NumChannels: 1, BitsPerSample: 20}, 24, true, 15},
+		{"AIFF-C NONE", createAIFF(8000, 1, 8, "NONE", make([]int32, 7)), models.AudioFormat{SampleRate: 8000, NumChannels: 1, BitsPerSample: 8}, 8, true, 7},
+		{"AIFF-C sowt", createAIFF(48000, 2, 24, "sowt", make([]int32, 8)), models.AudioFormat{SampleRate: 48000, NumChannels: 2, BitsPerSample: 24}, 24, false, 24},
+		{"AIFF-C sowt 8-bit", createAIFF(48000, 1, 8, "sowt", make([]int32, 8)), models.AudioFormat{SampleRate: 48000, NumChannels: 1, BitsPerSample: 8}, 8, true, 8},
+	}
+	for _, tt := range tests {
+		header, err := utils.ParseHeader(tt.aiff)
+		if err != nil {
+			t.Fatalf("%s: ParseHeader() error = %v", tt.name, err)
+		}
+		if header.Format != tt.format || header.ContainerBits != tt.container || header.BigEndian != tt.bigEndian {
+			t.Errorf("%s: got %+v in %d bits (big-endian %v)", tt.name, header.Format, header.ContainerBits, header.BigEndian)
+		}
+		if header.DataSize != tt.dataSize {
+			t.Errorf("%s: DataSize = %d, want %d", tt.name, header.DataSize, tt.dataSize)
+		}
+	}
+}
+
+func TestParseAIFFHeader_SSNDOffset(t *testing.T) {
+	// Eight bytes of block alignment precede the samples
+	ssnd := make([]byte, 8+8+4)
+	binary.BigEndian.PutUint32(ssnd[0:4], 8)
+	copy(ssnd[16:], []byte{0x12, 0x34, 0x56, 0x78})
+	aiff := buildAIFF("AIFF", commChunk(1, 2, 16, 22050, ""), aiffChunk("SSND", ssnd))
+
+	header, err := utils.ParseAIFFHeader(aiff)
+	if err != nil {
+		t.Fatalf("ParseAIFFHeader() error = %v", err)
+	}
+	if header.DataSize != 4 || !bytes.Equal(aiff[header.DataOffset:], []byte{0x12, 0x34, 0x56, 0x78}) {
+		t.Errorf("Samples at %d with size %d, want the last 4 bytes", header.DataOffset, header.DataSize)
+	}
+}
+
+func TestParseAIFFHeader_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		aiff []byte
+		code string
+	}{
+		{"float compression", createAIFF(44100, 1, 32, "fl32", make([]int32, 4)), models.ErrInvalidFormat},
+		{"SSND before COMM", buildAIFF("AIFF", aiffChunk("SSND", make([]byte, 12)), commChunk(1, 2, 16, 44100, "")), models.ErrInvalidFormat},
+		{"short COMM", buildAIFF("AIFF", aiffChunk("COMM", make([]byte, 10)), aiffChunk("SSND", make([]byte, 8))), models.ErrInvalidChunkSize},
+		{"zero sample rate", buildAIFF("AIFF", commChunk(1, 0, 16, 0, ""), aiffChunk("SSND", make([]byte, 8))), models.ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		_, err := utils.ParseHeader(tt.aiff)
+		var convErr *models.ConversionError
+		if !errors.As(err, &convErr) || convErr.Code != tt.code {
+			t.Errorf("%s: ParseHeader() error = %v, want %s", tt.name, err, tt.code)
+		}
+	}
+
+	aiff := createAIFF(44100, 1, 16, "", make([]int32, 4))
+	if _, err := utils.ParseHeader(aiff[:30]); err != utils.ErrIncompleteHeader {
+		t.Errorf("ParseHeader() of a partial header error = %v, want ErrIncompleteHeader", err)
+	}
+}
+
+func TestParseHeader_Detection(t *testing.T) {
+	if header, err := utils.ParseHeader(createWAV(44100, 1, 16, make([]int32, 4))); err != nil || header.Form != "RIFF" {
+		t.Errorf("WAV detected as %v, %v", header, err)
+	}
+	if header, err := utils.ParseHeader(createAIFF(44100, 1, 16, "sowt", make([]int32, 4))); err != nil || header.Form != "AIFC" {
+		t.Errorf("AIFF-C detected as %v, %v", header, err)
+	}
+	if _, err := utils.ParseHeader([]byte("Rl")); err != utils.ErrIncompleteHeader {
+		t.Errorf("ParseHeader() of two bytes error = %v, want ErrIncompleteHeader", err)
+	}
+	if _, err := utils.ParseHeader([]byte("OggS\x00\x02")); err == nil {
+		t.Error("ParseHeader() accepted an Ogg stream")
+	}
+}
+
+func TestDecodeBigEndianPCM(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		containerBits int
+		bitsPerSample int
+		want          []int
+	}{
+		{"8-bit signed", []byte{0x80, 0x00, 0x7F}, 8, 8, []int{-128, 0, 127}},
+		{"16-bit", []byte{0x80, 0x00, 0x00, 0x01}, 16, 16, []int{-32768, 1}},
+		{"24-bit", []byte{0xFF, 0xFF, 0xFE, 0x12, 0x34, 0x56}, 24, 24, []int{-2, 0x123456}},
+		{"20 bits in 24", []byte{0xFF, 0xFF, 0xF0}, 24, 20, []int{-1}},
+		{"32-bit", []byte{0x80, 0x00, 0x00, 0x00}, 32, 32, []int{-1 << 31}},
+	}
+	for _, tt := range tests {
+		got, err := utils.DecodeBigEndianPCM(tt.data, tt.containerBits, tt.bitsPerSample)
+		if err != nil {
+			t.Fatalf("%s: DecodeBigEndianPCM() error = %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: DecodeBigEndianPCM() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConverter_AIFF(t *testing.T) {
+	tests := []struct {
+		name        string
+		bits        int
+		channels    int
+		compression string
+	}{
+		{"AIFF 16-bit stereo", 16, 2, ""},
+		{"AIFF 8-bit", 8, 1, ""},
+		{"AIFF 20-bit", 20, 2, ""},
+		{"AIFF-C NONE 24-bit", 24, 2, "NONE"},
+		{"AIFF-C sowt 16-bit", 16, 2, "sowt"},
+		{"AIFF-C sowt 32-bit", 32, 1, "sowt"},
+	}
+	for _, tt := range tests {
+		samples := toneSamples(3000, tt.channels, tt.bits)
+		flacData, err := services.NewConverter().ConvertChunk(createAIFF(44100, tt.channels, tt.bits, tt.compression, samples))
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.name, err)
+		}
+		// mewkiz/flac cannot decode 32-bit frames
+		wavData, err := services.DecodeFLAC(flacData)
+		if err != nil {
+			t.Fatalf("%s: DecodeFLAC() error = %v", tt.name, err)
+		}
+		header, _ := utils.ParseWAVHeader(wavData)
+		got, _ := utils.DecodePCM(wavData[header.DataOffset:], header.ContainerBits, header.Format.BitsPerSample)
+		if len(got) != len(samples) {
+			t.Fatalf("%s: decoded %d samples, want %d", tt.name, len(got), len(samples))
+		}
+		for i := range samples {
+			if got[i] != int(samples[i]) {
+				t.Fatalf("%s: sample %d = %d, want %d", tt.name, i, got[i], samples[i])
+			}
+		}
+	}
+}
+
+func TestConverter_AIFFTags(t *testing.T) {
+	aiff := createAIFF(44100, 1, 16, "", make([]int32, 100),
+		aiffChunk("NAME", []byte("Loop 7")),
+		aiffChunk("AUTH", []byte("Sampler")),
+		aiffChunk("ANNO", []byte("Recorded at 96 kHz")),
+		aiffChunk("(c) ", []byte("2024 Example")))
+	// Text chunks may also follow the sound data
+	aiff = append(aiff, aiffChunk("ANNO", []byte("Trimmed"))...)
+	binary.BigEndian.PutUint32(aiff[4:8], uint32(len(aiff)-8))
+
+	flacData, err := services.NewConverter().ConvertChunk(aiff)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	for name, want := range map[string]string{
+		"TITLE":     "Loop 7",
+		"ARTIST":    "Sampler",
+		"COMMENT":   "Recorded at 96 kHz",
+		"COPYRIGHT": "2024 Example",
+	} {
+		if got := flacTag(t, flacData, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if !bytes.Contains(flacData, []byte("COMMENT=Trimmed")) {
+		t.Error("ANNO chunk after the sound data was not tagged")
+	}
+
+	// The foreign chunks of AIFF files cannot be stored
+	if _, err := keepForeignConverter(t).ConvertChunk(aiff); err == nil {
+		t.Error("ConvertChunk() kept foreign metadata of an AIFF file")
+	}
+}
+
+func TestConverter_AIFFTrailingChunksAfterOddOffset(t *testing.T) {
+	// One byte of offset before 100 16-bit samples leaves the SSND chunk odd
+	ssnd := make([]byte, 8+1+200)
+	binary.BigEndian.PutUint32(ssnd[0:4], 1)
+	aiff := buildAIFF("AIFF", commChunk(1, 100, 16, 44100, ""), aiffChunk("SSND", ssnd), aiffChunk("NAME", []byte("After")))
+
+	flacData, err := services.NewConverter().ConvertChunk(aiff)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	if got := flacTag(t, flacData, "TITLE"); got != "After" {
+		t.Errorf("TITLE = %q, want %q", got, "After")
+	}
+
+	// A stream gets the chunk through its header patch
+	stream := services.NewConverter().NewStream()
+	streamed, err := stream.Write(aiff)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	streamed = append(streamed, tail...)
+	offset, header := stream.HeaderPatch()
+	copy(streamed[offset:], header)
+	if got := flacTag(t, streamed, "TITLE"); got != "After" {
+		t.Errorf("Streamed TITLE = %q, want %q", got, "After")
+	}
+}
+
+// createAIFF builds an AIFF file, or an AIFF-C file with the given
+// compression type, of interleaved samples. Extra chunks are placed between
+// the COMM and SSND chunks.
+func createAIFF(sampleRate, channels, bitsPerSample int, compression string, samples []int32, extra ...[]byte) []byte {
+	width := (bitsPerSample + 7) / 8
+	data := new(bytes.Buffer)
+	for _, s := range samples {
+		v := uint32(s) << uint(width*8-bitsPerSample)
+		for b := width - 1; b >= 0; b-- {
+			shift := 8 * b
+			if compression == "sowt" {
+				shift = 8 * (width - 1 - b)
+			}
+			data.WriteByte(byte(v >> shift))
+		}
+	}
+	form := "AIFF"
+	if compression != "" {
+		form = "AIFC"
+	}
+	chunks := [][]byte{commChunk(channels, len(samples)/channels, bitsPerSample, sampleRate, compression)}
+	chunks = append(chunks, extra...)
+	chunks = append(chunks, aiffChunk("SSND", append(make([]byte, 8), data.Bytes()...)))
+	return buildAIFF(form, chunks...)
+}
+
+// commChunk builds a COMM chunk, with a compression type for AIFF-C.
+func commChunk(channels, frames, bitsPerSample, sampleRate int, compression string) []byte {
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.BigEndian, int16(channels))
+	binary.Write(body, binary.BigEndian, uint32(frames))
+	binary.Write(body, binary.BigEndian, int16(bitsPerSample))
+	// 80-bit extended sample rate with an explicit integer bit
+	var exponent uint16
+	var mantissa uint64
+	if sampleRate > 0 {
+		shift := bits.LeadingZeros64(uint64(sampleRate))
+		exponent = uint16(16383 + 63 - shift)
+		mantissa = uint64(sampleRate) << uint(shift)
+	}
+	binary.Write(body, binary.BigEndian, exponent)
+	binary.Write(body, binary.BigEndian, mantissa)
+	if compression != "" {
+		body.WriteString(compression)
+		body.Write([]byte{0, 0})
+	}
+	return aiffChunk("COMM", body.Bytes())
+}
+
+func aiffChunk(id string, body []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(id)
+	binary.Write(buf, binary.BigEndian, uint32(len(body)))
+	buf.Write(body)
+	if len(body)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func buildAIFF(form string, chunks ...[]byte) []byte {
+	body := bytes.NewBufferString(form)
+	for _, chunk := range chunks {
+		body.Write(chunk)
+	}
+	buf := bytes.NewBufferString("FORM")
+	binary.Write(buf, binary.BigEndian, uint32(body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
@@ -2,9 +2,16 @@ package unit
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
 	"testing"
 
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+
 	"audio-converter/internal/models"
 	"audio-converter/internal/services"
 	"audio-converter/pkg/utils"
@@ -34,6 +41,474 @@ func TestConverter_ConvertChunk(t *testing.T) {
 	}
 }
 
+func TestConverter_NativeRoundTrip(t *testing.T) {
+	// Two seconds of a stereo tone with a phase offset between channels, plus
+	// a little noise so the encoder has to pick real predictors.
+	const frames = 88200
+	samples := make([]int16, 0, frames*2)
+	seed := uint32(1)
+	for i := 0; i < frames; i++ {
+		seed = seed*1664525 + 1013904223
+		noise := int(seed>>28) - 8
+		l := 8000*math.Sin(2*math.Pi*440*float64(i)/44100) + float64(noise)
+		r := 6000*math.Sin(2*math.Pi*440*float64(i)/44100+0.3) + float64(noise)
+		samples = append(samples, int16(l), int16(r))
+	}
+	wavData := createPCM16WAV(44100, 2, samples)
+
+	flacData, err := services.NewConverter().ConvertChunk(wavData)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	if len(flacData) >= len(wavData) {
+		t.Errorf("FLAC output (%d bytes) is not smaller than the input (%d bytes)", len(flacData), len(wavData))
+	}
+
+	decoded := decodeFLAC(t, flacData)
+	if len(decoded) != len(samples) {
+		t.Fatalf("Decoded %d samples, want %d", len(decoded), len(samples))
+	}
+	for i := range samples {
+		if decoded[i] != int32(samples[i]) {
+			t.Fatalf("Sample %d differs: got %d, want %d", i, decoded[i], samples[i])
+		}
+	}
+}
+
+func TestConverter_CompressionLevels(t *testing.T) {
+	const frames = 44100
+	samples := make([]int16, 0, frames*2)
+	for i := 0; i < frames; i++ {
+		l := 8000 * math.Sin(2*math.Pi*440*float64(i)/44100)
+		r := 8000 * math.Sin(2*math.Pi*660*float64(i)/44100)
+		samples = append(samples, int16(l), int16(r))
+	}
+	wavData := createPCM16WAV(44100, 2, samples)
+
+	sizes := make(map[int]int)
+	for _, level := range []int{0, 8} {
+		level := level
+		converter, err := services.NewConverterWithOptions(services.Options{
+			Encoder: services.EncoderOptions{CompressionLevel: &level},
+		})
+		if err != nil {
+			t.Fatalf("Level %d: %v", level, err)
+		}
+		flacData, err := converter.ConvertChunk(wavData)
+		if err != nil {
+			t.Fatalf("Level %d: failed to convert: %v", level, err)
+		}
+		decoded := decodeFLAC(t, flacData)
+		for i := range samples {
+			if decoded[i] != int32(samples[i]) {
+				t.Fatalf("Level %d: sample %d differs: got %d, want %d", level, i, decoded[i], samples[i])
+			}
+		}
+		sizes[level] = len(flacData)
+	}
+	if sizes[8] > sizes[0] {
+		t.Errorf("Level 8 output (%d bytes) is larger than level 0 (%d bytes)", sizes[8], sizes[0])
+	}
+}
+
+func TestEncoderOptions_Invalid(t *testing.T) {
+	level, blockSize, order := 9, 8, 33
+	cases := map[string]services.EncoderOptions{
+		"compression level": {CompressionLevel: &level},
+		"block size":        {BlockSize: &blockSize},
+		"LPC order":         {MaxLPCOrder: &order},
+	}
+	for name, opts := range cases {
+		_, err := services.NewConverterWithOptions(services.Options{Encoder: opts})
+		convErr, ok := err.(*models.ConversionError)
+		if !ok || convErr.Code != models.ErrInvalidFormat {
+			t.Errorf("%s: got %v, want an %s error", name, err, models.ErrInvalidFormat)
+		}
+	}
+}
+
+func TestConverter_InputFormat(t *testing.T) {
+	formats := []models.AudioFormat{
+		{SampleRate: 48000, NumChannels: 1, BitsPerSample: 16},
+		{SampleRate: 96000, NumChannels: 2, BitsPerSample: 24},
+		{SampleRate: 22050, NumChannels: 6, BitsPerSample: 20},
+	}
+	for _, format := range formats {
+		frames := format.SampleRate / 10
+		limit := float64(int(1)<<uint(format.BitsPerSample-1) - 1)
+		samples := make([]int32, 0, frames*format.NumChannels)
+		for i := 0; i < frames; i++ {
+			for ch := 0; ch < format.NumChannels; ch++ {
+				v := 0.5 * limit * math.Sin(2*math.Pi*float64(440+110*ch)*float64(i)/float64(format.SampleRate))
+				samples = append(samples, int32(v))
+			}
+		}
+		wavData := createWAV(format.SampleRate, format.NumChannels, format.BitsPerSample, samples)
+
+		flacData, err := services.NewConverter().ConvertChunk(wavData)
+		if err != nil {
+			t.Fatalf("%+v: failed to convert: %v", format, err)
+		}
+		stream, err := flac.New(bytes.NewReader(flacData))
+		if err != nil {
+			t.Fatalf("%+v: failed to parse FLAC stream: %v", format, err)
+		}
+		info := stream.Info
+		if int(info.SampleRate) != format.SampleRate || int(info.NChannels) != format.NumChannels || int(info.BitsPerSample) != format.BitsPerSample {
+			t.Errorf("%+v: STREAMINFO has %d Hz, %d channels, %d bits", format, info.SampleRate, info.NChannels, info.BitsPerSample)
+		}
+		if info.NSamples != uint64(frames) {
+			t.Errorf("%+v: STREAMINFO has %d samples, want %d", format, info.NSamples, frames)
+		}
+
+		decoded := decodeFLAC(t, flacData)
+		if len(decoded) != len(samples) {
+			t.Fatalf("%+v: decoded %d samples, want %d", format, len(decoded), len(samples))
+		}
+		for i := range samples {
+			if decoded[i] != samples[i] {
+				t.Fatalf("%+v: sample %d differs: got %d, want %d", format, i, decoded[i], samples[i])
+			}
+		}
+	}
+}
+
+func TestConverter_IntegerDepths(t *testing.T) {
+	tests := []struct {
+		name                     string
+		containerBits, validBits int
+	}{
+		{"8-bit unsigned", 8, 8},
+		{"24-bit packed", 24, 24},
+		{"24-bit in 32", 32, 24},
+		{"32-bit", 32, 32},
+	}
+	for _, tt := range tests {
+		const frames = 5000
+		limit := float64(int64(1)<<uint(tt.validBits-1) - 1)
+		samples := make([]int32, 0, frames*2)
+		for i := 0; i < frames; i++ {
+			l := 0.9 * limit * math.Sin(2*math.Pi*440*float64(i)/48000)
+			r := -0.9 * limit * math.Sin(2*math.Pi*330*float64(i)/48000)
+			samples = append(samples, int32(l), int32(r))
+		}
+		// Include both extremes of the range
+		samples[0], samples[1] = int32(-limit-1), int32(limit)
+		wavData := createExtensibleWAV(48000, 2, tt.containerBits, tt.validBits, 0x3, samples)
+		if tt.containerBits == tt.validBits {
+			wavData = createWAV(48000, 2, tt.validBits, samples)
+		}
+
+		flacData, err := services.NewConverter().ConvertChunk(wavData)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.name, err)
+		}
+		stream, err := flac.New(bytes.NewReader(flacData))
+		if err != nil {
+			t.Fatalf("%s: failed to parse FLAC stream: %v", tt.name, err)
+		}
+		if int(stream.Info.BitsPerSample) != tt.validBits {
+			t.Errorf("%s: STREAMINFO has %d bits per sample, want %d", tt.name, stream.Info.BitsPerSample, tt.validBits)
+		}
+		if stream.Info.NSamples != frames {
+			t.Errorf("%s: STREAMINFO has %d samples, want %d", tt.name, stream.Info.NSamples, frames)
+		}
+		if stream.Info.MD5sum != pcmMD5(samples, tt.validBits) {
+			t.Errorf("%s: STREAMINFO MD5 does not match the input", tt.name)
+		}
+
+		// mewkiz/flac cannot decode 32-bit frames
+		if tt.validBits > 24 {
+			continue
+		}
+		decoded := decodeFLAC(t, flacData)
+		for i := range samples {
+			if decoded[i] != samples[i] {
+				t.Fatalf("%s: sample %d differs: got %d, want %d", tt.name, i, decoded[i], samples[i])
+			}
+		}
+	}
+}
+
+func TestConverter_FloatInput(t *testing.T) {
+	const frames = 10000
+	samples := make([]float64, 0, frames*2)
+	for i := 0; i < frames; i++ {
+		samples = append(samples, 0.8*math.Sin(2*math.Pi*440*float64(i)/48000), 0.5*math.Cos(2*math.Pi*1000*float64(i)/48000))
+	}
+
+	tests := []struct {
+		dither   string
+		bits     int
+		maxError float64
+	}{
+		{services.DitherNone, 16, 0.5},
+		{services.DitherTPDF, 24, 1.5},
+		{services.DitherShaped, 16, 6},
+	}
+	for _, floatBits := range []int{32, 64} {
+		wavData := createFloatWAV(48000, 2, floatBits, samples)
+		for _, tt := range tests {
+			dither, bits := tt.dither, tt.bits
+			converter, err := services.NewConverterWithOptions(services.Options{
+				Float: services.FloatOptions{BitsPerSample: &bits, Dither: &dither},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			flacData, err := converter.ConvertChunk(wavData)
+			if err != nil {
+				t.Fatalf("%s: failed to convert: %v", dither, err)
+			}
+			stream, err := flac.New(bytes.NewReader(flacData))
+			if err != nil {
+				t.Fatalf("%s: failed to parse FLAC stream: %v", dither, err)
+			}
+			if int(stream.Info.BitsPerSample) != bits {
+				t.Errorf("%s: STREAMINFO has %d bits per sample, want %d", dither, stream.Info.BitsPerSample, bits)
+			}
+
+			scale := math.Ldexp(1, bits-1)
+			decoded := decodeFLAC(t, flacData)
+			for i, x := range samples {
+				// float32 input carries its own rounding error at 24 bits
+				if diff := math.Abs(float64(decoded[i]) - x*scale); diff > tt.maxError+scale/(1<<23) {
+					t.Fatalf("%d-bit float, %s: sample %d is %d, want %.1f", floatBits, dither, i, decoded[i], x*scale)
+				}
+			}
+		}
+	}
+}
+
+func TestConverter_FloatRejectsBadOptions(t *testing.T) {
+	bits, dither, clipping := 12, "triangular", "wrap"
+	cases := map[string]services.FloatOptions{
+		"bit depth": {BitsPerSample: &bits},
+		"dither":    {Dither: &dither},
+		"clipping":  {Clipping: &clipping},
+	}
+	for name, opts := range cases {
+		_, err := services.NewConverterWithOptions(services.Options{Float: opts})
+		convErr, ok := err.(*models.ConversionError)
+		if !ok || convErr.Code != models.ErrInvalidFormat {
+			t.Errorf("%s: got %v, want an %s error", name, err, models.ErrInvalidFormat)
+		}
+	}
+}
+
+func TestConverter_UnrepresentableFormat(t *testing.T) {
+	cases := map[string][]byte{
+		"nine channels":        createWAV(44100, 9, 16, make([]int32, 9)),
+		"sample rate too high": createWAV(700000, 1, 16, make([]int32, 1)),
+		"odd high sample rate": createWAV(96001, 1, 16, make([]int32, 1)),
+		"10-bit samples":       createWAV(44100, 1, 10, make([]int32, 1)),
+	}
+	for name, wavData := range cases {
+		_, err := services.NewConverter().ConvertChunk(wavData)
+		convErr, ok := err.(*models.ConversionError)
+		if !ok || convErr.Code != models.ErrInvalidFormat {
+			t.Errorf("%s: got %v, want an %s error", name, err, models.ErrInvalidFormat)
+		}
+		if _, err := services.NewConverter().NewStream().Write(wavData); err == nil {
+			t.Errorf("%s: stream accepted the format", name)
+		}
+	}
+}
+
+func TestConverter_ChannelMask(t *testing.T) {
+	tests := []struct {
+		name     string
+		channels int
+		mask     uint32
+		want     string
+	}{
+		{"5.1", 6, 0x3F, ""},
+		{"5.1 side", 6, 0x60F, ""},
+		{"7.1", 8, 0x63F, ""},
+		{"7.1 wide", 8, 0xFF, "0x00FF"},
+		{"rear pair", 2, 0x30, "0x0030"},
+	}
+	for _, tt := range tests {
+		samples := make([]int32, 100*tt.channels)
+		for i := range samples {
+			samples[i] = int32(i%tt.channels*1000 + i/tt.channels)
+		}
+		wavData := createExtensibleWAV(48000, tt.channels, 24, 24, tt.mask, samples)
+
+		flacData, err := services.NewConverter().ConvertChunk(wavData)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.name, err)
+		}
+		if got := flacTag(t, flacData, "WAVEFORMATEXTENSIBLE_CHANNEL_MASK"); got != tt.want {
+			t.Errorf("%s: channel mask tag = %q, want %q", tt.name, got, tt.want)
+		}
+		// Channels keep their WAV order, which is FLAC's order for the
+		// standard layouts
+		decoded := decodeFLAC(t, flacData)
+		for i := range samples {
+			if decoded[i] != samples[i] {
+				t.Fatalf("%s: sample %d differs: got %d, want %d", tt.name, i, decoded[i], samples[i])
+			}
+		}
+	}
+}
+
+func TestConverter_WAVMetadata(t *testing.T) {
+	bext := make([]byte, 602)
+	copy(bext[0:], "Interview, take 3")
+	copy(bext[256:], "Studio 2")
+	copy(bext[320:], "2024-03-01")
+	copy(bext[330:], "10:15:00")
+	binary.LittleEndian.PutUint64(bext[338:], 172800000)
+	binary.LittleEndian.PutUint16(bext[346:], 2)
+	binary.LittleEndian.PutUint16(bext[412:], uint16(0xF8D0)) // -18.40 LUFS
+	binary.LittleEndian.PutUint16(bext[414:], 0x7FFF)
+	bext = append(bext, "A=PCM,F=48000,W=24,M=mono\r\n"...)
+
+	wavData := createWAV(48000, 1, 24, make([]int32, 480),
+		riffChunk("LIST", infoList("INAM", "Archive tape 12", "IART", "Caf\xe9 Orchestra", "IXYZ", "custom")),
+		riffChunk("bext", bext),
+		riffChunk("iXML", []byte("<BWFXML><PROJECT>Archive</PROJECT></BWFXML>\x00")))
+	// Some recorders write their tags after the audio
+	wavData = append(wavData, riffChunk("LIST", infoList("ICMT", "Digitized 2024"))...)
+
+	flacData, err := services.NewConverter().ConvertChunk(wavData)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	want := map[string]string{
+		"TITLE":                    "Archive tape 12",
+		"ARTIST":                   "Café Orchestra",
+		"RIFF_INFO_IXYZ":           "custom",
+		"COMMENT":                  "Digitized 2024",
+		"BWF_DESCRIPTION":          "Interview, take 3",
+		"BWF_ORIGINATOR":           "Studio 2",
+		"BWF_ORIGINATOR_REFERENCE": "",
+		"BWF_ORIGINATION_DATE":     "2024-03-01",
+		"BWF_ORIGINATION_TIME":     "10:15:00",
+		"BWF_TIME_REFERENCE":       "172800000",
+		"BWF_VERSION":              "2",
+		"BWF_LOUDNESS_VALUE":       "-18.40",
+		"BWF_LOUDNESS_RANGE":       "",
+		"BWF_CODING_HISTORY":       "A=PCM,F=48000,W=24,M=mono",
+		"IXML":                     "<BWFXML><PROJECT>Archive</PROJECT></BWFXML>",
+	}
+	for name, value := range want {
+		if got := flacTag(t, flacData, name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if got := len(decodeFLAC(t, flacData)); got != 480 {
+		t.Errorf("Decoded %d samples, want 480", got)
+	}
+}
+
+func TestConverter_CuePointsAndLoops(t *testing.T) {
+	labels := bytes.NewBufferString("adtl")
+	labels.Write(riffChunk("labl", append([]byte{2, 0, 0, 0}, "Chorus\x00"...)))
+	smpl := make([]byte, 36+24)
+	binary.LittleEndian.PutUint32(smpl[28:], 1)
+	// One forward loop over samples 1000 to 2999, at cue point 2
+	binary.LittleEndian.PutUint32(smpl[36:], 2)
+	binary.LittleEndian.PutUint32(smpl[36+8:], 1000)
+	binary.LittleEndian.PutUint32(smpl[36+12:], 2999)
+	wavData := createWAV(44100, 1, 16, make([]int32, 4000),
+		riffChunk("cue ", cueChunk(2, 1000, 1, 0, 3, 5000)),
+		riffChunk("LIST", labels.Bytes()),
+		riffChunk("smpl", smpl))
+
+	stream := services.NewConverter().NewStream()
+	flacData, err := stream.Write(wavData)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	flacData = append(flacData, tail...)
+
+	wantCues := []models.CuePoint{{ID: 1, Offset: 0}, {ID: 2, Offset: 1000, Label: "Chorus"}, {ID: 3, Offset: 5000}}
+	if got := stream.CuePoints(); !reflect.DeepEqual(got, wantCues) {
+		t.Errorf("CuePoints() = %+v, want %+v", got, wantCues)
+	}
+	wantLoops := []models.SampleLoop{{CuePointID: 2, Type: "forward", Start: 1000, End: 2999}}
+	if got := stream.Loops(); !reflect.DeepEqual(got, wantLoops) {
+		t.Errorf("Loops() = %+v, want %+v", got, wantLoops)
+	}
+
+	// The cue point past the end of the audio has no track
+	parsed, err := flac.Parse(bytes.NewReader(flacData))
+	if err != nil {
+		t.Fatalf("Failed to parse FLAC stream: %v", err)
+	}
+	var cueSheet *meta.CueSheet
+	for _, block := range parsed.Blocks {
+		if cs, ok := block.Body.(*meta.CueSheet); ok {
+			cueSheet = cs
+		}
+	}
+	if cueSheet == nil {
+		t.Fatal("No CUESHEET block")
+	}
+	var offsets []uint64
+	for _, track := range cueSheet.Tracks {
+		offsets = append(offsets, track.Offset)
+	}
+	if want := []uint64{0, 1000, 4000}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("Track offsets = %v, want %v", offsets, want)
+	}
+
+	for name, value := range map[string]string{
+		"LOOPSTART":             "1000",
+		"LOOPLENGTH":            "2000",
+		"SMPL_LOOP1_END":        "2999",
+		"SMPL_LOOP1_TYPE":       "forward",
+		"SMPL_LOOP1_PLAY_COUNT": "0",
+	} {
+		if got := flacTag(t, flacData, name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestConverter_MalformedLoop(t *testing.T) {
+	smpl := make([]byte, 36+2*24)
+	binary.LittleEndian.PutUint32(smpl[28:], 2)
+	// The first loop ends before it starts
+	binary.LittleEndian.PutUint32(smpl[36+8:], 3000)
+	binary.LittleEndian.PutUint32(smpl[36+12:], 1000)
+	binary.LittleEndian.PutUint32(smpl[60+8:], 100)
+	binary.LittleEndian.PutUint32(smpl[60+12:], 199)
+	wavData := createWAV(44100, 1, 16, make([]int32, 4000), riffChunk("smpl", smpl))
+
+	stream := services.NewConverter().NewStream()
+	flacData, err := stream.Write(wavData)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	flacData = append(flacData, tail...)
+
+	wantLoops := []models.SampleLoop{{Type: "forward", Start: 100, End: 199}}
+	if got := stream.Loops(); !reflect.DeepEqual(got, wantLoops) {
+		t.Errorf("Loops() = %+v, want %+v", got, wantLoops)
+	}
+	for name, value := range map[string]string{
+		"LOOPSTART":        "100",
+		"LOOPLENGTH":       "100",
+		"SMPL_LOOP1_START": "100",
+		"SMPL_LOOP2_START": "",
+	} {
+		if got := flacTag(t, flacData, name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
 func TestAudioFormat_Validation(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -81,6 +556,8 @@ func createTestWAVChunk(t *testing.T) []byte {
 		0x10, 0xB1, 0x02, 0x00, // ByteRate
 		0x04, 0x00, // BlockAlign
 		0x10, 0x00, // BitsPerSample
+		'd', 'a', 't', 'a', // Subchunk2ID
+		0x10, 0x00, 0x00, 0x00, // Subchunk2Size
 	}
 	
 	buf.Write(header)
@@ -94,6 +571,107 @@ func createTestWAVChunk(t *testing.T) []byte {
 	return buf.Bytes()
 }
 
+func createPCM16WAV(sampleRate, channels int, samples []int16) []byte {
+	buf := new(bytes.Buffer)
+	dataSize := len(samples) * 2
+	binary.Write(buf, binary.LittleEndian, []byte("RIFF"))
+	binary.Write(buf, binary.LittleEndian, uint32(36+dataSize))
+	binary.Write(buf, binary.LittleEndian, []byte("WAVE"))
+	binary.Write(buf, binary.LittleEndian, []byte("fmt "))
+	binary.Write(buf, binary.LittleEndian, uint32(16))
+	binary.Write(buf, binary.LittleEndian, uint16(1))
+	binary.Write(buf, binary.LittleEndian, uint16(channels))
+	binary.Write(buf, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(buf, binary.LittleEndian, uint32(sampleRate*channels*2))
+	binary.Write(buf, binary.LittleEndian, uint16(channels*2))
+	binary.Write(buf, binary.LittleEndian, uint16(16))
+	binary.Write(buf, binary.LittleEndian, []byte("data"))
+	binary.Write(buf, binary.LittleEndian, uint32(dataSize))
+	binary.Write(buf, binary.LittleEndian, samples)
+	return buf.Bytes()
+}
+
+// decodeFLAC decodes a FLAC stream and returns its samples interleaved.
+func decodeFLAC(t *testing.T, data []byte) []int32 {
+	t.Helper()
+	stream, err := flac.New(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse FLAC stream: %v", err)
+	}
+	var samples []int32
+	for {
+		f, err := stream.ParseNext()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to decode FLAC frame: %v", err)
+		}
+		for i := 0; i < int(f.BlockSize); i++ {
+			for _, sub := range f.Subframes {
+				samples = append(samples, sub.Samples[i])
+			}
+		}
+	}
+	return samples
+}
+
+// pcmMD5 computes the MD5 signature FLAC stores for interleaved samples of
+// the given bit depth.
+func pcmMD5(samples []int32, bitsPerSample int) [md5.Size]byte {
+	width := (bitsPerSample + 7) / 8
+	var data []byte
+	for _, s := range samples {
+		for b := 0; b < width; b++ {
+			data = append(data, byte(s>>(8*uint(b))))
+		}
+	}
+	return md5.Sum(data)
+}
+
+// flacTag returns the value of a VORBIS_COMMENT tag, or "" when the stream
+// has no such tag.
+func flacTag(t *testing.T, data []byte, name string) string {
+	t.Helper()
+	stream, err := flac.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse FLAC stream: %v", err)
+	}
+	for _, block := range stream.Blocks {
+		if comment, ok := block.Body.(*meta.VorbisComment); ok {
+			for _, tag := range comment.Tags {
+				if tag[0] == name {
+					return tag[1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// cueChunk builds a cue chunk body from ID, sample offset pairs.
+func cueChunk(points ...uint32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(points)/2))
+	for i := 0; i < len(points); i += 2 {
+		binary.Write(buf, binary.LittleEndian, points[i])
+		binary.Write(buf, binary.LittleEndian, points[i+1])
+		buf.WriteString("data")
+		binary.Write(buf, binary.LittleEndian, [2]uint32{})
+		binary.Write(buf, binary.LittleEndian, points[i+1])
+	}
+	return buf.Bytes()
+}
+
+// infoList builds a LIST chunk body of INFO fields from ID, value pairs.
+func infoList(fields ...string) []byte {
+	buf := bytes.NewBufferString("INFO")
+	for i := 0; i < len(fields); i += 2 {
+		buf.Write(riffChunk(fields[i], append([]byte(fields[i+1]), 0)))
+	}
+	return buf.Bytes()
+}
+
 func createWAVHeader(format *models.AudioFormat) []byte {
 	buf := new(bytes.Buffer)
 	// Write minimal WAV header for testing
@@ -108,5 +686,7 @@ func createWAVHeader(format *models.AudioFormat) []byte {
 	binary.Write(buf, binary.LittleEndian, uint32(format.SampleRate*format.NumChannels*format.BitsPerSample/8))
 	binary.Write(buf, binary.LittleEndian, uint16(format.NumChannels*format.BitsPerSample/8))
 	binary.Write(buf, binary.LittleEndian, uint16(format.BitsPerSample))
+	binary.Write(buf, binary.LittleEndian, []byte("data"))
+	binary.Write(buf, binary.LittleEndian, uint32(0)) // Subchunk2Size
 	return buf.Bytes()
 }
\ No newline at end of file
@@ -0,0 +1,212 @@
+package unit
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+	"audio-converter/pkg/utils"
+)
+
+func TestDecodeFLAC_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name          string
+		wav           []byte
+		containerBits int
+		extensible    bool
+		mask          uint32
+	}{
+		{"16-bit stereo", createWAV(44100, 2, 16, toneSamples(4000, 2, 16)), 16, false, 0x3},
+		{"8-bit mono", createWAV(8000, 1, 8, toneSamples(3001, 1, 8)), 8, false, 0x4},
+		{"24-bit stereo", createWAV(96000, 2, 24, toneSamples(5000, 2, 24)), 24, true, 0x3},
+		{"32-bit stereo", createWAV(48000, 2, 32, toneSamples(5000, 2, 32)), 32, true, 0x3},
+		{"20 bits in 24, 5.1 side", createExtensibleWAV(48000, 6, 24, 20, 0x60F, toneSamples(2000, 6, 20)), 24, true, 0x3F},
+		{"rear pair", createExtensibleWAV(48000, 2, 16, 16, 0x30, toneSamples(2000, 2, 16)), 16, true, 0x30},
+	}
+	for _, tt := range tests {
+		flacData, err := services.NewConverter().ConvertChunk(tt.wav)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.name, err)
+		}
+		wavData, err := services.DecodeFLAC(flacData)
+		if err != nil {
+			t.Fatalf("%s: DecodeFLAC() error = %v", tt.name, err)
+		}
+
+		want, _ := utils.ParseWAVHeader(tt.wav)
+		got, err := utils.ParseWAVHeader(wavData)
+		if err != nil {
+			t.Fatalf("%s: decoded WAV header: %v", tt.name, err)
+		}
+		if got.Format != want.Format || got.ContainerBits != tt.containerBits {
+			t.Errorf("%s: format %+v in %d bits, want %+v in %d bits", tt.name, got.Format, got.ContainerBits, want.Format, tt.containerBits)
+		}
+		if got.Extensible != tt.extensible || (tt.extensible && got.ChannelMask != tt.mask) {
+			t.Errorf("%s: Extensible = %v, ChannelMask = %#x", tt.name, got.Extensible, got.ChannelMask)
+		}
+		if got.DataSize != want.DataSize {
+			t.Errorf("%s: DataSize = %d, want %d", tt.name, got.DataSize, want.DataSize)
+		}
+		gotPCM, _ := utils.DecodePCM(wavData[got.DataOffset:got.DataOffset+int(got.DataSize)], got.ContainerBits, got.Format.BitsPerSample)
+		wantPCM, _ := utils.DecodePCM(tt.wav[want.DataOffset:want.DataOffset+int(want.DataSize)], want.ContainerBits, want.Format.BitsPerSample)
+		if len(gotPCM) != len(wantPCM) {
+			t.Fatalf("%s: decoded %d samples, want %d", tt.name, len(gotPCM), len(wantPCM))
+		}
+		for i := range wantPCM {
+			if gotPCM[i] != wantPCM[i] {
+				t.Fatalf("%s: sample %d differs: got %d, want %d", tt.name, i, gotPCM[i], wantPCM[i])
+			}
+		}
+	}
+}
+
+func TestStreamDecoder_UnknownLength(t *testing.T) {
+	wavData := createWAV(44100, 2, 16, toneSamples(6000, 2, 16))
+	// A streamed FLAC file never got its STREAMINFO totals
+	encoder := services.NewConverter().NewStream()
+	flacData, err := encoder.Write(wavData)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	tail, err := encoder.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	flacData = append(flacData, tail...)
+
+	decoder := services.NewStreamDecoder()
+	var out bytes.Buffer
+	for pos := 0; pos < len(flacData); pos += 777 {
+		end := pos + 777
+		if end > len(flacData) {
+			end = len(flacData)
+		}
+		data, err := decoder.Write(flacData[pos:end])
+		if err != nil {
+			t.Fatalf("Decoder Write failed: %v", err)
+		}
+		out.Write(data)
+	}
+	data, err := decoder.Close()
+	if err != nil {
+		t.Fatalf("Decoder Close failed: %v", err)
+	}
+	out.Write(data)
+
+	header, err := utils.ParseWAVHeader(out.Bytes())
+	if err != nil {
+		t.Fatalf("Decoded WAV header: %v", err)
+	}
+	if header.DataSize != utils.UnknownDataSize {
+		t.Errorf("Streamed DataSize = %d, want UnknownDataSize", header.DataSize)
+	}
+	if decoder.Samples() != 6000 || !bytes.Equal(out.Bytes()[header.DataOffset:], wavData[44:]) {
+		t.Errorf("Decoded %d samples that differ from the original", decoder.Samples())
+	}
+
+	// A whole file gets its real sizes
+	file, err := services.DecodeFLAC(flacData)
+	if err != nil {
+		t.Fatalf("DecodeFLAC() error = %v", err)
+	}
+	if !bytes.Equal(file, wavData) {
+		t.Error("DecodeFLAC() output differs from the original file")
+	}
+}
+
+func TestStreamDecoder_SmallMessages(t *testing.T) {
+	for _, bits := range []int{16, 32} {
+		flacData, err := services.NewConverter().ConvertChunk(createWAV(44100, 2, bits, toneSamples(20000, 2, bits)))
+		if err != nil {
+			t.Fatalf("%d-bit: failed to convert: %v", bits, err)
+		}
+		want, err := services.DecodeFLAC(flacData)
+		if err != nil {
+			t.Fatalf("%d-bit: DecodeFLAC() error = %v", bits, err)
+		}
+
+		// Every frame arrives in many messages
+		decoder := services.NewStreamDecoder()
+		var out bytes.Buffer
+		for pos := 0; pos < len(flacData); pos += 13 {
+			end := min(pos+13, len(flacData))
+			data, err := decoder.Write(flacData[pos:end])
+			if err != nil {
+				t.Fatalf("%d-bit: Write failed: %v", bits, err)
+			}
+			out.Write(data)
+		}
+		if decoder.Samples() == 0 {
+			t.Errorf("%d-bit: no frame was decoded before Close", bits)
+		}
+		data, err := decoder.Close()
+		if err != nil {
+			t.Fatalf("%d-bit: Close failed: %v", bits, err)
+		}
+		out.Write(data)
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("%d-bit: streamed output differs from DecodeFLAC()", bits)
+		}
+
+		decoder = services.NewStreamDecoder()
+		truncated := flacData[:len(flacData)-5]
+		for pos := 0; pos < len(truncated); pos += 13 {
+			if _, err := decoder.Write(truncated[pos:min(pos+13, len(truncated))]); err != nil {
+				t.Fatalf("%d-bit: Write failed: %v", bits, err)
+			}
+		}
+		var convErr *models.ConversionError
+		if _, err := decoder.Close(); !errors.As(err, &convErr) || convErr.Code != models.ErrStreamCorrupted {
+			t.Errorf("%d-bit: Close() of a truncated stream error = %v, want %s", bits, err, models.ErrStreamCorrupted)
+		}
+	}
+}
+
+func TestDecodeFLAC_Corruption(t *testing.T) {
+	flacData, err := services.NewConverter().ConvertChunk(createWAV(44100, 1, 16, toneSamples(5000, 1, 16)))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	badMD5 := append([]byte(nil), flacData...)
+	badMD5[8+18] ^= 0xFF
+	badFrame := append([]byte(nil), flacData...)
+	badFrame[len(badFrame)-10] ^= 0x10
+
+	tests := []struct {
+		name string
+		data []byte
+		code string
+	}{
+		{"MD5 mismatch", badMD5, models.ErrStreamCorrupted},
+		{"frame checksum", badFrame, models.ErrStreamCorrupted},
+		{"truncated", flacData[:len(flacData)-5], models.ErrStreamCorrupted},
+		{"not FLAC", createWAV(44100, 1, 16, make([]int32, 10)), models.ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		_, err := services.DecodeFLAC(tt.data)
+		var convErr *models.ConversionError
+		if !errors.As(err, &convErr) || convErr.Code != tt.code {
+			t.Errorf("%s: DecodeFLAC() error = %v, want %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+// toneSamples returns frames of interleaved samples of a sine tone with a
+// little noise, scaled to bitsPerSample and different in every channel.
+func toneSamples(frames, channels, bitsPerSample int) []int32 {
+	amplitude := math.Ldexp(0.7, bitsPerSample-1)
+	samples := make([]int32, 0, frames*channels)
+	seed := uint32(7)
+	for i := 0; i < frames; i++ {
+		for ch := 0; ch < channels; ch++ {
+			seed = seed*1664525 + 1013904223
+			noise := float64(int(seed>>29) - 4)
+			v := amplitude*math.Sin(2*math.Pi*float64(i)/(50+7*float64(ch))) + noise
+			samples = append(samples, int32(v))
+		}
+	}
+	return samples
+}
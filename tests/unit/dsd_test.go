@@ -0,0 +1,339 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"testing"
+
+	"github.com/mewkiz/flac"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+	"audio-converter/pkg/utils"
+)
+
+// dsd64Rate is the sample rate of single-rate DSD, 64 times 44.1 kHz.
+const dsd64Rate = 2822400
+
+func TestParseDSDHeaders(t *testing.T) {
+	channels := dsdTone(10000, 2, 0.5)
+
+	dsf, err := utils.ParseHeader(createDSF(dsd64Rate, channels, 10000))
+	if err != nil {
+		t.Fatalf("ParseHeader() of DSF error = %v", err)
+	}
+	want := models.AudioFormat{SampleRate: dsd64Rate, NumChannels: 2, BitsPerSample: 1, DSD: true}
+	if dsf.Form != "DSF" || dsf.Format != want || dsf.BlockAlign != 2*4096 {
+		t.Errorf("DSF: got %s %+v with block align %d", dsf.Form, dsf.Format, dsf.BlockAlign)
+	}
+	if dsf.DSD == nil || *dsf.DSD != (utils.DSDLayout{BlockSize: 4096, LSBFirst: true, Samples: 10000}) {
+		t.Errorf("DSF layout = %+v", dsf.DSD)
+	}
+	if dsf.DataOffset != 92 || dsf.DataSize != 2*4096 {
+		t.Errorf("DSF data at %d with size %d, want 92 and %d", dsf.DataOffset, dsf.DataSize, 2*4096)
+	}
+
+	dffData := createDFF(dsd64Rate, channels, "DSD ")
+	dff, err := utils.ParseHeader(dffData)
+	if err != nil {
+		t.Fatalf("ParseHeader() of DSDIFF error = %v", err)
+	}
+	if dff.Form != "DFF" || dff.Format != want || dff.BlockAlign != 2 {
+		t.Errorf("DSDIFF: got %s %+v with block align %d", dff.Form, dff.Format, dff.BlockAlign)
+	}
+	if dff.DSD == nil || *dff.DSD != (utils.DSDLayout{BlockSize: 1, Samples: 10000}) {
+		t.Errorf("DSDIFF layout = %+v", dff.DSD)
+	}
+	if dff.DataSize != 2*1250 || dff.DataOffset+int(dff.DataSize) != len(dffData) {
+		t.Errorf("DSDIFF data at %d with size %d", dff.DataOffset, dff.DataSize)
+	}
+
+	if _, err := utils.ParseHeader(dffData[:40]); err != utils.ErrIncompleteHeader {
+		t.Errorf("ParseHeader() of a partial DSDIFF header error = %v, want ErrIncompleteHeader", err)
+	}
+}
+
+func TestParseDSDHeaders_Errors(t *testing.T) {
+	channels := dsdTone(800, 1, 0.5)
+	badBits := createDSF(dsd64Rate, channels, 800)
+	binary.LittleEndian.PutUint32(badBits[28+32:], 4)
+	badSize := createDSF(dsd64Rate, channels, 800)
+	binary.LittleEndian.PutUint64(badSize[4:], 32)
+
+	tests := []struct {
+		name string
+		data []byte
+		code string
+	}{
+		{"DSF bits per sample", badBits, models.ErrInvalidFormat},
+		{"DSF header size", badSize, models.ErrInvalidChunkSize},
+		{"DST compression", createDFF(dsd64Rate, channels, "DST "), models.ErrInvalidFormat},
+		{"sound data before PROP", buildDFF(dffChunk("DSD ", make([]byte, 100))), models.ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		_, err := utils.ParseHeader(tt.data)
+		var convErr *models.ConversionError
+		if !errors.As(err, &convErr) || convErr.Code != tt.code {
+			t.Errorf("%s: ParseHeader() error = %v, want %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+func TestConverter_DSD(t *testing.T) {
+	const (
+		samples   = 100000
+		amplitude = 0.5
+	)
+	channels := dsdTone(samples, 2, amplitude)
+
+	dsfFLAC, err := services.NewConverter().ConvertChunk(createDSF(dsd64Rate, channels, samples))
+	if err != nil {
+		t.Fatalf("Failed to convert DSF: %v", err)
+	}
+	stream, err := flac.New(bytes.NewReader(dsfFLAC))
+	if err != nil {
+		t.Fatalf("Failed to parse FLAC stream: %v", err)
+	}
+	info := stream.Info
+	if info.SampleRate != 88200 || info.BitsPerSample != 24 || info.NSamples != samples/32 {
+		t.Errorf("Got %d samples at %d Hz in %d bits, want %d at 88200 Hz in 24 bits",
+			info.NSamples, info.SampleRate, info.BitsPerSample, samples/32)
+	}
+
+	// The decimated signal follows the tone; the inverted right channel
+	// tells the channels apart
+	pcm := decodeFLAC(t, dsfFLAC)
+	var sumSquares float64
+	count := 0
+	for i := 100; i < len(pcm)/2-100; i++ {
+		want := amplitude * dsdToneAt(float64(i)*32)
+		for c, sign := range []float64{1, -1} {
+			diff := float64(pcm[2*i+c])/(1<<23) - sign*want
+			sumSquares += diff * diff
+			count++
+		}
+	}
+	if rms := math.Sqrt(sumSquares / float64(count)); rms > 0.002 {
+		t.Errorf("RMS error against the tone = %f", rms)
+	}
+
+	// DSDIFF stores the same samples most significant bit first
+	dffFLAC, err := services.NewConverter().ConvertChunk(createDFF(dsd64Rate, channels, "DSD "))
+	if err != nil {
+		t.Fatalf("Failed to convert DSDIFF: %v", err)
+	}
+	dffPCM := decodeFLAC(t, dffFLAC)
+	if len(dffPCM) != len(pcm) {
+		t.Fatalf("DSDIFF decoded %d samples, want %d", len(dffPCM), len(pcm))
+	}
+	for i := range pcm {
+		if d := dffPCM[i] - pcm[i]; d > 1 || d < -1 {
+			t.Fatalf("DSDIFF sample %d = %d, DSF gave %d", i, dffPCM[i], pcm[i])
+		}
+	}
+
+	for _, tag := range []struct{ name, dsf, dff string }{
+		{"DSD_SAMPLE_RATE", "2822400", "2822400"},
+		{"DSD_RATE", "DSD64", "DSD64"},
+		{"DSD_CONTAINER", "DSF", "DSDIFF"},
+	} {
+		if got := flacTag(t, dsfFLAC, tag.name); got != tag.dsf {
+			t.Errorf("DSF %s = %q, want %q", tag.name, got, tag.dsf)
+		}
+		if got := flacTag(t, dffFLAC, tag.name); got != tag.dff {
+			t.Errorf("DSDIFF %s = %q, want %q", tag.name, got, tag.dff)
+		}
+	}
+}
+
+func TestConverter_DSDSampleRate(t *testing.T) {
+	const samples = 50000
+	dsf := createDSF(dsd64Rate, dsdTone(samples, 1, 0.5), samples)
+
+	rate := services.DSDRate176400
+	c, err := services.NewConverterWithOptions(services.Options{DSD: services.DSDOptions{SampleRate: &rate}})
+	if err != nil {
+		t.Fatalf("NewConverterWithOptions() error = %v", err)
+	}
+	flacData, err := c.ConvertChunk(dsf)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+
+	// A stream delivered in pieces yields the same audio
+	stream := c.NewStream()
+	var out bytes.Buffer
+	for pos := 0; pos < len(dsf); pos += 3001 {
+		end := pos + 3001
+		if end > len(dsf) {
+			end = len(dsf)
+		}
+		data, err := stream.Write(dsf[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		out.Write(data)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+	if format := stream.OutputFormat(); format.SampleRate != rate || format.BitsPerSample != 24 {
+		t.Errorf("OutputFormat() = %+v", format)
+	}
+	if stream.Samples() != samples/16 {
+		t.Errorf("Samples() = %d, want %d", stream.Samples(), samples/16)
+	}
+
+	got, want := decodeFLAC(t, out.Bytes()), decodeFLAC(t, flacData)
+	if len(got) != samples/16 || len(want) != len(got) {
+		t.Fatalf("Decoded %d and %d samples, want %d", len(got), len(want), samples/16)
+	}
+	for i := range want {
+		if d := got[i] - want[i]; d > 1 || d < -1 {
+			t.Fatalf("Streamed sample %d = %d, want %d", i, got[i], want[i])
+		}
+	}
+}
+
+func TestConverter_DSDRejected(t *testing.T) {
+	dsf := createDSF(dsd64Rate, dsdTone(8000, 1, 0.5), 8000)
+
+	for _, rate := range []int{44100, 96000, 352800} {
+		_, err := services.NewConverterWithOptions(services.Options{DSD: services.DSDOptions{SampleRate: &rate}})
+		var convErr *models.ConversionError
+		if !errors.As(err, &convErr) || convErr.Code != models.ErrInvalidFormat {
+			t.Errorf("NewConverterWithOptions() with %d Hz error = %v, want %s", rate, err, models.ErrInvalidFormat)
+		}
+	}
+
+	// 48 kHz-based DSD does not divide down to 88.2 kHz
+	if _, err := services.NewConverter().ConvertChunk(createDSF(3072000, dsdTone(8000, 1, 0.5), 8000)); err == nil {
+		t.Error("ConvertChunk() accepted DSD at 3072000 Hz")
+	}
+	if _, err := keepForeignConverter(t).ConvertChunk(dsf); err == nil {
+		t.Error("ConvertChunk() kept foreign metadata of a DSF file")
+	}
+	ffmpeg, err := services.NewConverterWithOptions(services.Options{Backend: services.BackendFFmpeg})
+	if err != nil {
+		t.Fatalf("NewConverterWithOptions() error = %v", err)
+	}
+	if _, err := ffmpeg.ConvertChunk(dsf); err == nil {
+		t.Error("The ffmpeg backend accepted DSD input")
+	}
+}
+
+// dsdToneAt is a 1 kHz sine at DSD sample n of a DSD64 stream.
+func dsdToneAt(n float64) float64 {
+	return math.Sin(2 * math.Pi * 1000 * n / dsd64Rate)
+}
+
+// dsdTone modulates a 1 kHz tone into DSD64 with a second-order
+// sigma-delta modulator, returning the bits of each channel packed most
+// significant bit first. Odd channels carry the inverted tone.
+func dsdTone(samples, channels int, amplitude float64) [][]byte {
+	out := make([][]byte, channels)
+	for c := range out {
+		out[c] = make([]byte, (samples+7)/8)
+		sign := 1.0
+		if c%2 == 1 {
+			sign = -1
+		}
+		var i1, i2, y float64
+		for n := 0; n < samples; n++ {
+			x := sign * amplitude * dsdToneAt(float64(n))
+			i1 += x - y
+			i2 += i1 - y
+			y = -1
+			if i2 >= 0 {
+				y = 1
+				out[c][n/8] |= 0x80 >> uint(n%8)
+			}
+		}
+	}
+	return out
+}
+
+// createDSF builds a DSF file storing the channels in 4096-byte blocks,
+// least significant bit first.
+func createDSF(sampleRate int, channels [][]byte, samples int) []byte {
+	const blockSize = 4096
+	blocks := (len(channels[0]) + blockSize - 1) / blockSize
+	data := make([]byte, blocks*blockSize*len(channels))
+	for b := 0; b < blocks; b++ {
+		for c, ch := range channels {
+			block := data[(b*len(channels)+c)*blockSize:]
+			for i := 0; i < blockSize && b*blockSize+i < len(ch); i++ {
+				block[i] = bits.Reverse8(ch[b*blockSize+i])
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	le := func(v interface{}) { binary.Write(buf, binary.LittleEndian, v) }
+	buf.WriteString("DSD ")
+	le(uint64(28))
+	le(uint64(28 + 52 + 12 + len(data)))
+	le(uint64(0))
+	buf.WriteString("fmt ")
+	le(uint64(52))
+	le([]uint32{1, 0, 2, uint32(len(channels)), uint32(sampleRate), 1})
+	le(uint64(samples))
+	le([]uint32{blockSize, 0})
+	buf.WriteString("data")
+	le(uint64(12 + len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// createDFF builds a DSDIFF file with the channels interleaved byte by byte
+// and the given compression type.
+func createDFF(sampleRate int, channels [][]byte, compression string) []byte {
+	prop := bytes.NewBufferString("SND ")
+	rate := make([]byte, 4)
+	binary.BigEndian.PutUint32(rate, uint32(sampleRate))
+	prop.Write(dffChunk("FS  ", rate))
+	chnl := []byte{0, byte(len(channels))}
+	for c := range channels {
+		chnl = append(chnl, []byte("SLFTSRGT")[4*(c%2):4*(c%2)+4]...)
+	}
+	prop.Write(dffChunk("CHNL", chnl))
+	prop.Write(dffChunk("CMPR", append([]byte(compression), 0, 0)))
+
+	var data []byte
+	for i := range channels[0] {
+		for _, ch := range channels {
+			data = append(data, ch[i])
+		}
+	}
+	id := "DSD "
+	if compression == "DST " {
+		id = "DST "
+	}
+	return buildDFF(dffChunk("FVER", []byte{1, 5, 0, 0}), dffChunk("PROP", prop.Bytes()), dffChunk(id, data))
+}
+
+// dffChunk builds a DSDIFF chunk padded to an even length.
+func dffChunk(id string, body []byte) []byte {
+	buf := bytes.NewBufferString(id)
+	binary.Write(buf, binary.BigEndian, uint64(len(body)))
+	buf.Write(body)
+	if len(body)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// buildDFF wraps chunks in a DSDIFF FRM8 form.
+func buildDFF(chunks ...[]byte) []byte {
+	body := bytes.Join(chunks, nil)
+	buf := bytes.NewBufferString("FRM8")
+	binary.Write(buf, binary.BigEndian, uint64(4+len(body)))
+	buf.WriteString("DSD ")
+	buf.Write(body)
+	return buf.Bytes()
+}
@@ -0,0 +1,126 @@
+package unit
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+)
+
+func keepForeignConverter(t *testing.T) *services.Converter {
+	t.Helper()
+	c, err := services.NewConverterWithOptions(services.Options{
+		Backend:             services.BackendNative,
+		KeepForeignMetadata: true,
+	})
+	if err != nil {
+		t.Fatalf("NewConverterWithOptions() error = %v", err)
+	}
+	return c
+}
+
+func TestRestoreWAV_RoundTrip(t *testing.T) {
+	samples := make([]int32, 1001)
+	for i := range samples {
+		samples[i] = int32(i%200 - 100)
+	}
+	// An odd-length 8-bit data chunk is followed by a padding byte
+	odd := createWAV(22050, 1, 8, samples, riffChunk("LIST", infoList("INAM", "Odd")))
+	odd = append(odd, riffChunk("cue ", make([]byte, 4))...)
+
+	surround := make([]int32, 600)
+	for i := range surround {
+		surround[i] = int32(i*37%4096 - 2048)
+	}
+	tests := []struct {
+		name string
+		wav  []byte
+	}{
+		{"8-bit with trailing chunks", odd},
+		{"20 bits in 24", createExtensibleWAV(48000, 6, 24, 20, 0x60F, surround)},
+		{"RF64", toRF64(createWAV(44100, 2, 16, surround), "RF64", int64(len(surround)*2))},
+	}
+	for _, tt := range tests {
+		flacData, err := keepForeignConverter(t).ConvertChunk(tt.wav)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.name, err)
+		}
+		restored, err := services.RestoreWAV(flacData)
+		if err != nil {
+			t.Fatalf("%s: RestoreWAV() error = %v", tt.name, err)
+		}
+		if !bytes.Equal(restored, tt.wav) {
+			t.Errorf("%s: restored file differs from the original", tt.name)
+		}
+	}
+}
+
+func TestRestoreWAV_Stream(t *testing.T) {
+	samples := make([]int32, 5000*2)
+	for i := range samples {
+		samples[i] = int32(i%3000 - 1500)
+	}
+	wavData := createWAV(44100, 2, 16, samples, riffChunk("bext", make([]byte, 602)))
+
+	stream := keepForeignConverter(t).NewStream()
+	var out bytes.Buffer
+	for pos := 0; pos < len(wavData); pos += 1500 {
+		end := pos + 1500
+		if end > len(wavData) {
+			end = len(wavData)
+		}
+		flacData, err := stream.Write(wavData[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		out.Write(flacData)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+
+	if err := services.VerifyRestore(wavData, out.Bytes()); err != nil {
+		t.Errorf("VerifyRestore() error = %v", err)
+	}
+}
+
+func TestRestoreWAV_Verification(t *testing.T) {
+	// Bits below the declared 20 valid bits are discarded by the encoder, so
+	// the original cannot be rebuilt
+	wavData := createExtensibleWAV(48000, 2, 24, 20, 0x3, make([]int32, 100))
+	wavData[len(wavData)-3] = 0x01
+
+	_, err := keepForeignConverter(t).ConvertChunk(wavData)
+	var convErr *models.ConversionError
+	if !errors.As(err, &convErr) || convErr.Code != models.ErrConversionFailed {
+		t.Errorf("ConvertChunk() error = %v, want ErrConversionFailed", err)
+	}
+
+	// Streams are checked when they are closed
+	stream := keepForeignConverter(t).NewStream()
+	if _, err := stream.Write(wavData); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	_, err = stream.Close()
+	if !errors.As(err, &convErr) || convErr.Code != models.ErrConversionFailed {
+		t.Errorf("Close() error = %v, want ErrConversionFailed", err)
+	}
+}
+
+func TestRestoreWAV_Rejected(t *testing.T) {
+	if _, err := keepForeignConverter(t).ConvertChunk(createFloatWAV(48000, 1, 32, make([]float64, 10))); err == nil {
+		t.Error("ConvertChunk() kept foreign metadata of a floating-point file")
+	}
+
+	flacData, err := services.NewConverter().ConvertChunk(createWAV(44100, 1, 16, make([]int32, 100)))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	if _, err := services.RestoreWAV(flacData); err == nil {
+		t.Error("RestoreWAV() accepted a stream without stored chunks")
+	}
+}
@@ -0,0 +1,301 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+)
+
+func oggConverter(t *testing.T, opts services.Options) *services.Converter {
+	t.Helper()
+	opts.Backend = services.BackendNative
+	opts.Container = services.ContainerOgg
+	c, err := services.NewConverterWithOptions(opts)
+	if err != nil {
+		t.Fatalf("NewConverterWithOptions() error = %v", err)
+	}
+	return c
+}
+
+func TestConverter_OggFLAC(t *testing.T) {
+	wavData := createWAV(44100, 2, 16, toneSamples(10000, 2, 16), riffChunk("LIST", infoList("INAM", "Ogg")))
+	native, err := services.NewConverter().ConvertChunk(wavData)
+	if err != nil {
+		t.Fatalf("Failed to convert to FLAC: %v", err)
+	}
+	oggData, err := oggConverter(t, services.Options{}).ConvertChunk(wavData)
+	if err != nil {
+		t.Fatalf("Failed to convert to Ogg FLAC: %v", err)
+	}
+
+	pages := parseOggPages(t, oggData)
+	packets := oggPackets(pages)
+	first := packets[0].data
+	if len(first) != 51 || !bytes.Equal(first[:7], []byte{0x7F, 'F', 'L', 'A', 'C', 1, 0}) || string(first[9:13]) != "fLaC" {
+		t.Fatalf("Invalid mapping header packet % x", first[:13])
+	}
+	headers := int(binary.BigEndian.Uint16(first[7:9]))
+	if headers != 1 || packets[1].data[0]&0x7F != 4 {
+		t.Errorf("Got %d header packets starting with block type %d, want VORBIS_COMMENT alone", headers, packets[1].data[0]&0x7F)
+	}
+	for _, p := range packets[:1+headers] {
+		if p.page.granule != 0 || len(p.page.packets) != 1 {
+			t.Errorf("Header packet shares a page or has granule %d", p.page.granule)
+		}
+	}
+
+	// The packets rebuild the native stream, STREAMINFO totals included
+	rebuilt := append([]byte(nil), first[9:]...)
+	for _, p := range packets[1:] {
+		rebuilt = append(rebuilt, p.data...)
+	}
+	if !bytes.Equal(rebuilt, native) {
+		t.Error("Ogg packets differ from the native FLAC stream")
+	}
+
+	// Every page carries the samples up to its last packet
+	var samples uint64
+	for _, p := range packets[1+headers:] {
+		samples += uint64(flacFrameSamples(t, p.data))
+		if p.page.packets[len(p.page.packets)-1] == p && p.page.granule != samples {
+			t.Errorf("Page %d has granule %d, want %d", p.page.seq, p.page.granule, samples)
+		}
+	}
+	if samples != 10000 {
+		t.Errorf("Audio packets hold %d samples, want 10000", samples)
+	}
+}
+
+func TestConverter_OggFLACLargeFrames(t *testing.T) {
+	// Full-scale noise leaves 32-bit frames of 8 channels uncompressed, far
+	// beyond the 65025 bytes a page holds
+	noise := make([]int32, 4096*8)
+	seed := uint32(1)
+	for i := range noise {
+		seed = seed*1664525 + 1013904223
+		noise[i] = int32(seed)
+	}
+	wavData := createExtensibleWAV(48000, 8, 32, 32, 0x63F, noise)
+	oggData, err := oggConverter(t, services.Options{}).ConvertChunk(wavData)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+
+	pages := parseOggPages(t, oggData)
+	var continued int
+	for _, page := range pages {
+		if page.flags&0x01 != 0 {
+			continued++
+		}
+		if len(page.packets) == 0 && page.granule != ^uint64(0) {
+			t.Errorf("Page %d ends no packet but has granule %d", page.seq, page.granule)
+		}
+	}
+	if continued == 0 {
+		t.Error("No page continues a packet")
+	}
+	if last := pages[len(pages)-1]; last.granule != 4096 {
+		t.Errorf("Last page has granule %d, want 4096", last.granule)
+	}
+}
+
+func TestStreamEncoder_OggFLAC(t *testing.T) {
+	wavData := createWAV(44100, 1, 16, toneSamples(9000, 1, 16))
+	stream := oggConverter(t, services.Options{}).NewStream()
+	var out bytes.Buffer
+	for pos := 0; pos < len(wavData); pos += 1000 {
+		end := pos + 1000
+		if end > len(wavData) {
+			end = len(wavData)
+		}
+		data, err := stream.Write(wavData[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if len(data) > 0 && string(data[:4]) != "OggS" {
+			t.Fatal("Write returned a partial page")
+		}
+		out.Write(data)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+	offset, header := stream.HeaderPatch()
+	if offset != 0 || len(header) != 79 {
+		t.Fatalf("HeaderPatch() = %d bytes at %d, want the first page", len(header), offset)
+	}
+	streamed := out.Bytes()
+	copy(streamed[offset:], header)
+
+	pages := parseOggPages(t, streamed)
+	if info := oggPackets(pages)[0].data[17:]; !bytes.Equal(info, stream.StreamInfo()) {
+		t.Error("Patched first page does not carry the final STREAMINFO")
+	}
+	if last := pages[len(pages)-1]; last.granule != 9000 {
+		t.Errorf("Last page has granule %d, want 9000", last.granule)
+	}
+	var samples uint64
+	for _, p := range oggPackets(pages)[2:] {
+		samples += uint64(flacFrameSamples(t, p.data))
+	}
+	if samples != 9000 {
+		t.Errorf("Audio packets hold %d samples, want 9000", samples)
+	}
+}
+
+func TestConverter_OggRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		opts services.Options
+	}{
+		{"unknown container", services.Options{Backend: services.BackendNative, Container: "mp4"}},
+		{"foreign metadata", services.Options{Backend: services.BackendNative, Container: services.ContainerOgg, KeepForeignMetadata: true}},
+	}
+	for _, tt := range tests {
+		_, err := services.NewConverterWithOptions(tt.opts)
+		var convErr *models.ConversionError
+		if !errors.As(err, &convErr) || convErr.Code != models.ErrInvalidFormat {
+			t.Errorf("%s: NewConverterWithOptions() error = %v, want ErrInvalidFormat", tt.name, err)
+		}
+	}
+
+	c, err := services.NewConverterWithOptions(services.Options{Backend: services.BackendFFmpeg, Container: services.ContainerOgg})
+	if err != nil {
+		t.Fatalf("NewConverterWithOptions() error = %v", err)
+	}
+	if _, err := c.ConvertChunk(createWAV(44100, 1, 16, make([]int32, 10))); err == nil {
+		t.Error("ffmpeg backend produced Ogg output")
+	}
+}
+
+type oggPage struct {
+	flags   byte
+	granule uint64
+	seq     uint32
+	packets []*oggPacket
+}
+
+type oggPacket struct {
+	data []byte
+	// page is the page the packet ends on
+	page *oggPage
+}
+
+// parseOggPages splits an Ogg stream of a single logical stream into pages,
+// checking their checksums, sequence numbers and stream flags.
+func parseOggPages(t *testing.T, data []byte) []*oggPage {
+	t.Helper()
+	var pages []*oggPage
+	var serial uint32
+	var packet []byte
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" || data[4] != 0 {
+			t.Fatalf("Invalid page header at page %d", len(pages))
+		}
+		lacing := data[27 : 27+int(data[26])]
+		size := 27 + len(lacing)
+		for _, n := range lacing {
+			size += int(n)
+		}
+		page := append([]byte(nil), data[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:26])
+		binary.LittleEndian.PutUint32(page[22:26], 0)
+		if oggChecksum(page) != crc {
+			t.Fatalf("Page %d has a bad checksum", len(pages))
+		}
+
+		p := &oggPage{
+			flags:   page[5],
+			granule: binary.LittleEndian.Uint64(page[6:14]),
+			seq:     binary.LittleEndian.Uint32(page[18:22]),
+		}
+		if len(pages) == 0 {
+			serial = binary.LittleEndian.Uint32(page[14:18])
+		} else if binary.LittleEndian.Uint32(page[14:18]) != serial {
+			t.Fatalf("Page %d belongs to another stream", len(pages))
+		}
+		if p.seq != uint32(len(pages)) {
+			t.Fatalf("Page %d has sequence number %d", len(pages), p.seq)
+		}
+		if (p.flags&0x02 != 0) != (len(pages) == 0) || (p.flags&0x04 != 0) != (size == len(data)) {
+			t.Fatalf("Page %d has flags %#x", len(pages), p.flags)
+		}
+		if (p.flags&0x01 != 0) != (len(packet) > 0) {
+			t.Fatalf("Page %d continuation flag does not match its packets", len(pages))
+		}
+
+		body := page[27+len(lacing):]
+		for _, n := range lacing {
+			packet = append(packet, body[:n]...)
+			body = body[n:]
+			if n < 255 {
+				p.packets = append(p.packets, &oggPacket{data: packet, page: p})
+				packet = nil
+			}
+		}
+		pages = append(pages, p)
+		data = data[size:]
+	}
+	if len(packet) > 0 {
+		t.Fatal("Stream ends inside a packet")
+	}
+	return pages
+}
+
+func oggPackets(pages []*oggPage) []*oggPacket {
+	var packets []*oggPacket
+	for _, page := range pages {
+		packets = append(packets, page.packets...)
+	}
+	return packets
+}
+
+func oggChecksum(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// flacFrameSamples returns the block size of a FLAC frame.
+func flacFrameSamples(t *testing.T, frame []byte) int {
+	t.Helper()
+	if len(frame) < 4 || frame[0] != 0xFF || frame[1]&0xFE != 0xF8 {
+		t.Fatal("Audio packet is not a FLAC frame")
+	}
+	// Skip the coded frame number to reach the uncommon block size
+	length := 0
+	for mask := byte(0x80); frame[4]&mask != 0; mask >>= 1 {
+		length++
+	}
+	if length == 0 {
+		length = 1
+	}
+	pos := 4 + length
+	switch code := frame[2] >> 4; {
+	case code == 1:
+		return 192
+	case code >= 2 && code <= 5:
+		return 576 << (code - 2)
+	case code == 6:
+		return int(frame[pos]) + 1
+	case code == 7:
+		return int(binary.BigEndian.Uint16(frame[pos:])) + 1
+	default:
+		return 256 << (code - 8)
+	}
+}
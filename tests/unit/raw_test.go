@@ -0,0 +1,198 @@
+package unit
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+	"audio-converter/pkg/utils"
+)
+
+func TestDecodeRawPCM(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		bits      int
+		bigEndian bool
+		signed    bool
+		want      []int
+	}{
+		{"8-bit unsigned", []byte{0x00, 0x80, 0xFF}, 8, false, false, []int{-128, 0, 127}},
+		{"8-bit signed", []byte{0x80, 0x00, 0x7F}, 8, false, true, []int{-128, 0, 127}},
+		{"16-bit little-endian signed", []byte{0x00, 0x80, 0xFF, 0x7F}, 16, false, true, []int{-32768, 32767}},
+		{"16-bit little-endian unsigned", []byte{0x00, 0x00, 0x00, 0x80, 0xFF, 0xFF}, 16, false, false, []int{-32768, 0, 32767}},
+		{"16-bit big-endian unsigned", []byte{0x00, 0x00, 0x80, 0x00, 0xFF, 0xFF}, 16, true, false, []int{-32768, 0, 32767}},
+		{"24-bit big-endian signed", []byte{0x80, 0x00, 0x00, 0x00, 0x00, 0x01}, 24, true, true, []int{-8388608, 1}},
+		{"8-bit big-endian unsigned", []byte{0x00, 0xFF}, 8, true, false, []int{-128, 127}},
+	}
+	for _, tt := range tests {
+		got, err := utils.DecodeRawPCM(tt.data, tt.bits, tt.bigEndian, tt.signed)
+		if err != nil {
+			t.Fatalf("%s: DecodeRawPCM() error = %v", tt.name, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %d samples, want %d", tt.name, len(got), len(tt.want))
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: sample %d = %d, want %d", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestConverter_Raw(t *testing.T) {
+	tests := []struct {
+		name      string
+		bits      int
+		channels  int
+		byteOrder string
+		signed    bool
+	}{
+		{"16-bit little-endian", 16, 2, services.ByteOrderLittle, true},
+		{"16-bit big-endian", 16, 2, services.ByteOrderBig, true},
+		{"16-bit unsigned", 16, 1, services.ByteOrderLittle, false},
+		{"8-bit signed", 8, 2, services.ByteOrderLittle, true},
+		{"24-bit big-endian", 24, 6, services.ByteOrderBig, true},
+		{"32-bit little-endian", 32, 1, services.ByteOrderLittle, true},
+	}
+	for _, tt := range tests {
+		samples := toneSamples(3000, tt.channels, tt.bits)
+		raw := encodeRawPCM(samples, tt.bits, tt.byteOrder == services.ByteOrderBig, tt.signed)
+
+		rate, channels, bits, byteOrder, signed := 48000, tt.channels, tt.bits, tt.byteOrder, tt.signed
+		c, err := services.NewConverterWithOptions(services.Options{Raw: services.RawOptions{
+			SampleRate:    &rate,
+			Channels:      &channels,
+			BitsPerSample: &bits,
+			ByteOrder:     &byteOrder,
+			Signed:        &signed,
+		}})
+		if err != nil {
+			t.Fatalf("%s: NewConverterWithOptions() error = %v", tt.name, err)
+		}
+		flacData, err := c.ConvertChunk(raw)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", tt.name, err)
+		}
+		// mewkiz/flac cannot decode 32-bit frames
+		wavData, err := services.DecodeFLAC(flacData)
+		if err != nil {
+			t.Fatalf("%s: DecodeFLAC() error = %v", tt.name, err)
+		}
+		header, _ := utils.ParseWAVHeader(wavData)
+		if header.Format != (models.AudioFormat{SampleRate: 48000, NumChannels: tt.channels, BitsPerSample: tt.bits}) {
+			t.Errorf("%s: decoded format = %+v", tt.name, header.Format)
+		}
+		got, _ := utils.DecodePCM(wavData[header.DataOffset:], header.ContainerBits, header.Format.BitsPerSample)
+		if len(got) != len(samples) {
+			t.Fatalf("%s: decoded %d samples, want %d", tt.name, len(got), len(samples))
+		}
+		for i := range samples {
+			if got[i] != int(samples[i]) {
+				t.Fatalf("%s: sample %d = %d, want %d", tt.name, i, got[i], samples[i])
+			}
+		}
+	}
+}
+
+func TestStreamEncoder_Raw(t *testing.T) {
+	samples := toneSamples(4000, 2, 16)
+	raw := encodeRawPCM(samples, 16, false, true)
+	// Raw data is never taken for a header, even when it looks like one
+	copy(raw, "RIFF")
+	copy(samples, []int32{int32(int16(binary.LittleEndian.Uint16(raw[0:]))), int32(int16(binary.LittleEndian.Uint16(raw[2:])))})
+
+	rate, channels, bits := 44100, 2, 16
+	c, err := services.NewConverterWithOptions(services.Options{Raw: services.RawOptions{SampleRate: &rate, Channels: &channels, BitsPerSample: &bits}})
+	if err != nil {
+		t.Fatalf("NewConverterWithOptions() error = %v", err)
+	}
+	stream := c.NewStream()
+	var out []byte
+	// Messages split sample frames
+	for pos := 0; pos < len(raw); pos += 1001 {
+		end := pos + 1001
+		if end > len(raw) {
+			end = len(raw)
+		}
+		data, err := stream.Write(raw[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		out = append(out, data...)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out = append(out, tail...)
+	if format := stream.Format(); format == nil || *format != (models.AudioFormat{SampleRate: 44100, NumChannels: 2, BitsPerSample: 16}) {
+		t.Errorf("Format() = %+v", format)
+	}
+
+	got := decodeFLAC(t, out)
+	if len(got) != len(samples) {
+		t.Fatalf("Decoded %d samples, want %d", len(got), len(samples))
+	}
+	for i := range samples {
+		if got[i] != samples[i] {
+			t.Fatalf("Sample %d = %d, want %d", i, got[i], samples[i])
+		}
+	}
+}
+
+func TestRawOptions_Invalid(t *testing.T) {
+	rate, channels, bits, twelve, nine := 48000, 2, 16, 12, 9
+	order := "middle"
+	tests := []struct {
+		name string
+		opts services.RawOptions
+	}{
+		{"missing bit depth", services.RawOptions{SampleRate: &rate, Channels: &channels}},
+		{"signedness alone", services.RawOptions{Signed: new(bool)}},
+		{"12-bit samples", services.RawOptions{SampleRate: &rate, Channels: &channels, BitsPerSample: &twelve}},
+		{"9 channels", services.RawOptions{SampleRate: &rate, Channels: &nine, BitsPerSample: &bits}},
+		{"byte order", services.RawOptions{SampleRate: &rate, Channels: &channels, BitsPerSample: &bits, ByteOrder: &order}},
+	}
+	for _, tt := range tests {
+		_, err := services.NewConverterWithOptions(services.Options{Raw: tt.opts})
+		var convErr *models.ConversionError
+		if !errors.As(err, &convErr) || convErr.Code != models.ErrInvalidFormat {
+			t.Errorf("%s: NewConverterWithOptions() error = %v, want %s", tt.name, err, models.ErrInvalidFormat)
+		}
+	}
+
+	resolved, err := services.RawOptions{SampleRate: &rate, Channels: &channels, BitsPerSample: &bits}.Resolve()
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if *resolved.ByteOrder != services.ByteOrderLittle || !*resolved.Signed {
+		t.Errorf("Resolve() = %s, signed %v; want little-endian signed", *resolved.ByteOrder, *resolved.Signed)
+	}
+	if resolved, _ := (services.RawOptions{}).Resolve(); resolved != (services.RawOptions{}) {
+		t.Errorf("Resolve() of empty options = %+v", resolved)
+	}
+}
+
+// encodeRawPCM stores interleaved samples as headerless PCM.
+func encodeRawPCM(samples []int32, bitsPerSample int, bigEndian, signed bool) []byte {
+	width := bitsPerSample / 8
+	data := make([]byte, 0, len(samples)*width)
+	for _, s := range samples {
+		v := uint32(s)
+		if !signed {
+			v ^= 1 << uint(bitsPerSample-1)
+		}
+		for b := 0; b < width; b++ {
+			shift := 8 * uint(b)
+			if bigEndian {
+				shift = 8 * uint(width-1-b)
+			}
+			data = append(data, byte(v>>shift))
+		}
+	}
+	return data
+}
@@ -0,0 +1,359 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/meta"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+	"audio-converter/pkg/utils"
+)
+
+func levelConverter(t *testing.T, level int) *services.Converter {
+	t.Helper()
+	c, err := services.NewConverterWithOptions(services.Options{
+		Encoder: services.EncoderOptions{CompressionLevel: &level},
+	})
+	if err != nil {
+		t.Fatalf("NewConverterWithOptions() error = %v", err)
+	}
+	return c
+}
+
+func TestConverter_ReencodeFLAC(t *testing.T) {
+	samples := toneSamples(20000, 2, 16)
+	wavData := createWAV(44100, 2, 16, samples, riffChunk("LIST", infoList("INAM", "Partner master")), riffChunk("cue ", cueChunk(1, 0, 2, 10000)))
+	level0, err := levelConverter(t, 0).ConvertChunk(wavData)
+	if err != nil {
+		t.Fatalf("Failed to convert at level 0: %v", err)
+	}
+	input := withMetadata(level0,
+		metadataBlock(meta.TypePadding, make([]byte, 8192)),
+		metadataBlock(meta.TypeSeekTable, bytes.Join([][]byte{
+			seekPoint(0, 0, 4096), seekPoint(10000, 512, 4096), seekPoint(19999, 1024, 4096), seekPoint(meta.PlaceholderPoint, 0, 0),
+		}, nil)),
+		metadataBlock(meta.TypePicture, pictureBody("image/png", []byte("\x89PNG cover"))),
+		metadataBlock(meta.TypeApplication, []byte("testpartner data")),
+		metadataBlock(meta.Type(100), []byte("reserved block")))
+
+	stream := levelConverter(t, 8).NewStream()
+	var out bytes.Buffer
+	for pos := 0; pos < len(input); pos += 777 {
+		end := pos + 777
+		if end > len(input) {
+			end = len(input)
+		}
+		data, err := stream.Write(input[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		out.Write(data)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+	streamed := out.Bytes()
+	offset, header := stream.HeaderPatch()
+	copy(streamed[offset:], header)
+
+	reencoded, err := levelConverter(t, 8).ConvertChunk(input)
+	if err != nil {
+		t.Fatalf("ConvertChunk() error = %v", err)
+	}
+	if !bytes.Equal(reencoded, streamed) {
+		t.Error("ConvertChunk() and a stream produced different files")
+	}
+
+	got := decodeFLAC(t, reencoded)
+	if len(got) != len(samples) {
+		t.Fatalf("Decoded %d samples, want %d", len(got), len(samples))
+	}
+	for i := range samples {
+		if got[i] != samples[i] {
+			t.Fatalf("Sample %d = %d, want %d", i, got[i], samples[i])
+		}
+	}
+
+	// The new STREAMINFO describes the same audio
+	in, _ := flac.Parse(bytes.NewReader(input))
+	outStream, _ := flac.Parse(bytes.NewReader(reencoded))
+	if outStream.Info.MD5sum != in.Info.MD5sum || outStream.Info.NSamples != in.Info.NSamples {
+		t.Errorf("STREAMINFO has MD5 %x and %d samples, want %x and %d",
+			outStream.Info.MD5sum, outStream.Info.NSamples, in.Info.MD5sum, in.Info.NSamples)
+	}
+
+	// Every block but STREAMINFO carries over
+	types := make(map[meta.Type]int)
+	for _, block := range rawBlocks(reencoded) {
+		types[meta.Type(block[0]&0x7F)]++
+		if block[0]&0x7F == 100 && string(block[4:]) != "reserved block" {
+			t.Errorf("Reserved block holds %q", block[4:])
+		}
+	}
+	want := map[meta.Type]int{
+		meta.TypeStreamInfo: 1, meta.TypeVorbisComment: 1, meta.TypeCueSheet: 1, meta.TypePadding: 1,
+		meta.TypeSeekTable: 1, meta.TypePicture: 1, meta.TypeApplication: 1, 100: 1,
+	}
+	if len(types) != len(want) {
+		t.Errorf("Re-encoded stream has metadata blocks %v, want %v", types, want)
+	}
+	for typ, n := range want {
+		if types[typ] != n {
+			t.Errorf("Re-encoded stream has metadata blocks %v, want %v", types, want)
+			break
+		}
+	}
+
+	// The seek points lead to the frames holding the old targets
+	var table *meta.SeekTable
+	for _, block := range outStream.Blocks {
+		if block.Type == meta.TypeSeekTable {
+			table = block.Body.(*meta.SeekTable)
+		}
+	}
+	if table == nil || len(table.Points) != 4 {
+		t.Fatalf("Seek table = %+v, want 4 points", table)
+	}
+	firstFrame := 4
+	for _, block := range rawBlocks(reencoded) {
+		firstFrame += len(block)
+	}
+	for i, target := range []uint64{0, 10000, 19999} {
+		point := table.Points[i]
+		if point.SampleNum > target || point.SampleNum+uint64(point.NSamples) <= target {
+			t.Errorf("Seek point %d = %+v, want the frame holding sample %d", i, point, target)
+		}
+		pos := firstFrame + int(point.Offset)
+		if pos+2 > len(reencoded) || reencoded[pos] != 0xFF || reencoded[pos+1]&0xFE != 0xF8 {
+			t.Errorf("Seek point %d = %+v does not lead to a frame", i, point)
+		}
+	}
+	if table.Points[3].SampleNum != meta.PlaceholderPoint {
+		t.Errorf("Seek point 3 = %+v, want a placeholder", table.Points[3])
+	}
+	if title := flacTag(t, reencoded, "TITLE"); title != "Partner master" {
+		t.Errorf("TITLE = %q, want %q", title, "Partner master")
+	}
+
+	stats := stream.Stats()
+	if stats.SizeSaved == nil || *stats.SizeSaved != int64(len(input)-len(reencoded)) || *stats.SizeSaved <= 0 {
+		t.Errorf("SizeSaved = %v, want %d", stats.SizeSaved, len(input)-len(reencoded))
+	}
+	if stats.InputFormat != (models.AudioFormat{SampleRate: 44100, NumChannels: 2, BitsPerSample: 16}) || stats.TotalSamples != 20000 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+	if wav := services.NewConverter().NewStream().Stats(); wav.SizeSaved != nil {
+		t.Errorf("SizeSaved = %d for a stream that is not re-encoded", *wav.SizeSaved)
+	}
+}
+
+func TestConverter_Reencode32Bit(t *testing.T) {
+	samples := toneSamples(5000, 2, 32)
+	input, err := levelConverter(t, 0).ConvertChunk(createWAV(48000, 2, 32, samples))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	reencoded, err := levelConverter(t, 8).ConvertChunk(input)
+	if err != nil {
+		t.Fatalf("ConvertChunk() error = %v", err)
+	}
+	// mewkiz/flac cannot decode 32-bit frames
+	wavData, err := services.DecodeFLAC(reencoded)
+	if err != nil {
+		t.Fatalf("DecodeFLAC() error = %v", err)
+	}
+	header, _ := utils.ParseWAVHeader(wavData)
+	got, _ := utils.DecodePCM(wavData[header.DataOffset:], header.ContainerBits, header.Format.BitsPerSample)
+	if len(got) != len(samples) {
+		t.Fatalf("Decoded %d samples, want %d", len(got), len(samples))
+	}
+	for i := range samples {
+		if got[i] != int(samples[i]) {
+			t.Fatalf("Sample %d = %d, want %d", i, got[i], samples[i])
+		}
+	}
+}
+
+func TestStreamEncoder_ReencodeSmallMessages(t *testing.T) {
+	input, err := levelConverter(t, 0).ConvertChunk(createWAV(44100, 2, 16, toneSamples(20000, 2, 16)))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	want, err := levelConverter(t, 8).ConvertChunk(input)
+	if err != nil {
+		t.Fatalf("ConvertChunk() error = %v", err)
+	}
+
+	stream := levelConverter(t, 8).NewStream()
+	var out bytes.Buffer
+	for pos := 0; pos < len(input); pos += 13 {
+		data, err := stream.Write(input[pos:min(pos+13, len(input))])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		out.Write(data)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+	streamed := out.Bytes()
+	offset, header := stream.HeaderPatch()
+	copy(streamed[offset:], header)
+	if !bytes.Equal(streamed, want) {
+		t.Error("Streamed re-encoding differs from ConvertChunk() output")
+	}
+}
+
+func TestConverter_ReencodeCorruptFLAC(t *testing.T) {
+	input, err := services.NewConverter().ConvertChunk(createWAV(44100, 1, 16, toneSamples(10000, 1, 16)))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	badMD5 := append([]byte(nil), input...)
+	badMD5[8+18] ^= 0xFF
+	badFrame := append([]byte(nil), input...)
+	badFrame[len(badFrame)-100] ^= 0xFF
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"MD5 signature", badMD5},
+		{"frame", badFrame},
+		{"truncated", input[:len(input)-10]},
+	}
+	for _, tt := range tests {
+		_, err := services.NewConverter().ConvertChunk(tt.data)
+		var convErr *models.ConversionError
+		if !errors.As(err, &convErr) || convErr.Code != models.ErrStreamCorrupted {
+			t.Errorf("%s: ConvertChunk() error = %v, want %s", tt.name, err, models.ErrStreamCorrupted)
+		}
+	}
+
+	if _, err := keepForeignConverter(t).ConvertChunk(input); err == nil {
+		t.Error("ConvertChunk() kept foreign metadata of FLAC input")
+	}
+}
+
+func TestConverter_ReencodeToOgg(t *testing.T) {
+	// APPLICATION precedes VORBIS_COMMENT in the input
+	input := withMetadata(flacWithoutTags(t), metadataBlock(meta.TypeApplication, []byte("testdata")),
+		metadataBlock(meta.TypeSeekTable, seekPoint(0, 0, 4096)))
+	input = withMetadata(input, metadataBlock(meta.TypeVorbisComment, vorbisCommentBody("TITLE=Ogg")))
+
+	oggData, err := oggConverter(t, services.Options{}).ConvertChunk(input)
+	if err != nil {
+		t.Fatalf("ConvertChunk() error = %v", err)
+	}
+	packets := oggPackets(parseOggPages(t, oggData))
+	if len(packets) < 3 || packets[1].data[0]&0x7F != byte(meta.TypeVorbisComment) {
+		t.Fatal("Second Ogg packet is not VORBIS_COMMENT")
+	}
+	if packets[2].data[0]&0x7F != byte(meta.TypeApplication) {
+		t.Errorf("Third Ogg packet has block type %d, want APPLICATION", packets[2].data[0]&0x7F)
+	}
+	// Ogg FLAC is sought by granule position
+	for _, packet := range packets[1:] {
+		if packet.data[0]&0x7F == byte(meta.TypeSeekTable) {
+			t.Error("Ogg FLAC stream has a SEEKTABLE")
+		}
+	}
+}
+
+// flacWithoutTags converts a short tone to FLAC with no metadata blocks
+// besides STREAMINFO.
+func flacWithoutTags(t *testing.T) []byte {
+	t.Helper()
+	data, err := services.NewConverter().ConvertChunk(createWAV(44100, 1, 16, toneSamples(3000, 1, 16)))
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	return data
+}
+
+// withMetadata appends metadata blocks, each with a 4-byte block header, to
+// the metadata of a FLAC stream.
+func withMetadata(flacData []byte, blocks ...[]byte) []byte {
+	blockEnd := func(pos int) int {
+		return pos + 4 + (int(flacData[pos+1])<<16 | int(flacData[pos+2])<<8 | int(flacData[pos+3]))
+	}
+	pos := 4
+	for flacData[pos]&0x80 == 0 {
+		pos = blockEnd(pos)
+	}
+	last := pos
+	pos = blockEnd(pos)
+
+	out := append([]byte(nil), flacData[:pos]...)
+	out[last] &^= 0x80
+	for i, block := range blocks {
+		block = append([]byte(nil), block...)
+		if i == len(blocks)-1 {
+			block[0] |= 0x80
+		}
+		out = append(out, block...)
+	}
+	return append(out, flacData[pos:]...)
+}
+
+// rawBlocks returns the metadata blocks of a FLAC stream, headers included.
+func rawBlocks(flacData []byte) [][]byte {
+	var blocks [][]byte
+	for pos := 4; ; {
+		end := pos + 4 + (int(flacData[pos+1])<<16 | int(flacData[pos+2])<<8 | int(flacData[pos+3]))
+		blocks = append(blocks, flacData[pos:end])
+		if flacData[pos]&0x80 != 0 {
+			return blocks
+		}
+		pos = end
+	}
+}
+
+// metadataBlock builds a metadata block that is not the last.
+func metadataBlock(typ meta.Type, body []byte) []byte {
+	header := []byte{byte(typ), byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(header, body...)
+}
+
+// seekPoint builds a SEEKTABLE entry.
+func seekPoint(sample, offset uint64, samples uint16) []byte {
+	b := make([]byte, 18)
+	binary.BigEndian.PutUint64(b[0:], sample)
+	binary.BigEndian.PutUint64(b[8:], offset)
+	binary.BigEndian.PutUint16(b[16:], samples)
+	return b
+}
+
+// pictureBody builds a front cover PICTURE block body.
+func pictureBody(mime string, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(3))
+	binary.Write(buf, binary.BigEndian, uint32(len(mime)))
+	buf.WriteString(mime)
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	binary.Write(buf, binary.BigEndian, []uint32{1, 1, 24, 0, uint32(len(data))})
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// vorbisCommentBody builds a VORBIS_COMMENT block body.
+func vorbisCommentBody(tags ...string) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(4))
+	buf.WriteString("test")
+	binary.Write(buf, binary.LittleEndian, uint32(len(tags)))
+	for _, tag := range tags {
+		binary.Write(buf, binary.LittleEndian, uint32(len(tag)))
+		buf.WriteString(tag)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,428 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/mewkiz/flac"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+)
+
+func TestStreamEncoder_ContinuousStream(t *testing.T) {
+	samples := make([]int16, 0, 20000*2)
+	for i := 0; i < 20000; i++ {
+		samples = append(samples, int16(i%2000-1000), int16((i*3)%1500-750))
+	}
+	wavData := createPCM16WAV(44100, 2, samples)
+
+	stream := services.NewConverter().NewStream()
+	var out bytes.Buffer
+	var messages int
+	// Feed the stream in uneven pieces to mimic WebSocket messages.
+	for pos, size := 0, 1000; pos < len(wavData); pos, size = pos+size, size+333 {
+		end := pos + size
+		if end > len(wavData) {
+			end = len(wavData)
+		}
+		flacData, err := stream.Write(wavData[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if len(flacData) > 0 {
+			if messages > 0 && bytes.HasPrefix(flacData, []byte("fLaC")) {
+				t.Errorf("Message %d repeats the FLAC header", messages)
+			}
+			messages++
+		}
+		out.Write(flacData)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+
+	if messages < 2 {
+		t.Errorf("Expected frames to be emitted while streaming, got %d messages", messages)
+	}
+	decoded := decodeFLAC(t, out.Bytes())
+	if len(decoded) != len(samples) {
+		t.Fatalf("Decoded %d samples, want %d", len(decoded), len(samples))
+	}
+	for i := range samples {
+		if decoded[i] != int32(samples[i]) {
+			t.Fatalf("Sample %d differs: got %d, want %d", i, decoded[i], samples[i])
+		}
+	}
+}
+
+func TestStreamEncoder_HeaderPatch(t *testing.T) {
+	samples := toneSamples(15000, 2, 24)
+	wavData := createWAV(48000, 2, 24, samples)
+	stream := services.NewConverter().NewStream()
+	if _, header := stream.HeaderPatch(); header != nil {
+		t.Error("HeaderPatch() returned a header before the stream started")
+	}
+	var out bytes.Buffer
+	for pos := 0; pos < len(wavData); pos += 5000 {
+		end := pos + 5000
+		if end > len(wavData) {
+			end = len(wavData)
+		}
+		data, err := stream.Write(wavData[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		out.Write(data)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+
+	streamed := out.Bytes()
+	offset, header := stream.HeaderPatch()
+	if offset != 8 || len(header) != 34 {
+		t.Fatalf("HeaderPatch() = %d bytes at %d, want the STREAMINFO body at 8", len(header), offset)
+	}
+	copy(streamed[offset:], header)
+
+	want, err := services.NewConverter().ConvertChunk(wavData)
+	if err != nil {
+		t.Fatalf("ConvertChunk() error = %v", err)
+	}
+	if !bytes.Equal(streamed, want) {
+		t.Error("Patched stream differs from ConvertChunk() output")
+	}
+	info, err := flac.Parse(bytes.NewReader(streamed))
+	if err != nil {
+		t.Fatalf("Failed to parse FLAC: %v", err)
+	}
+	if info.Info.NSamples != 15000 || info.Info.MD5sum != pcmMD5(samples, 24) {
+		t.Errorf("STREAMINFO has %d samples and MD5 %x, want 15000 and %x", info.Info.NSamples, info.Info.MD5sum, pcmMD5(samples, 24))
+	}
+	if info.Info.FrameSizeMin == 0 || info.Info.FrameSizeMax < info.Info.FrameSizeMin {
+		t.Errorf("STREAMINFO frame sizes are %d to %d", info.Info.FrameSizeMin, info.Info.FrameSizeMax)
+	}
+}
+
+func TestStreamEncoder_SampleAlignment(t *testing.T) {
+	tests := []struct {
+		name          string
+		channels      int
+		bitsPerSample int
+	}{
+		{"stereo 16-bit", 2, 16},
+		{"three channels 16-bit", 3, 16},
+		{"mono 24-bit", 1, 24},
+		{"five channels 24-bit", 5, 24},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peak := int32(1) << uint(tt.bitsPerSample-2)
+			samples := make([]int32, 6001*tt.channels)
+			for i := range samples {
+				samples[i] = int32(i*7919)%peak - peak/2
+			}
+			wavData := createWAV(44100, tt.channels, tt.bitsPerSample, samples, riffChunk("junk", []byte{1, 2, 3}))
+			// Trailing chunks after the audio must not be decoded as samples.
+			wavData = append(wavData, riffChunk("LIST", []byte("INFOtrailing"))...)
+
+			// Messages of 7 bytes never line up with a header, sample or frame
+			// boundary.
+			stream := services.NewConverter().NewStream()
+			var out bytes.Buffer
+			for pos := 0; pos < len(wavData); pos += 7 {
+				end := pos + 7
+				if end > len(wavData) {
+					end = len(wavData)
+				}
+				flacData, err := stream.Write(wavData[pos:end])
+				if err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+				out.Write(flacData)
+			}
+			tail, err := stream.Close()
+			if err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			out.Write(tail)
+
+			decoded := decodeFLAC(t, out.Bytes())
+			if len(decoded) != len(samples) {
+				t.Fatalf("Decoded %d samples, want %d", len(decoded), len(samples))
+			}
+			for i := range samples {
+				if decoded[i] != samples[i] {
+					t.Fatalf("Sample %d differs: got %d, want %d", i, decoded[i], samples[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStreamEncoder_FloatClipping(t *testing.T) {
+	samples := []float64{0.5, 1.5, -2, -0.25, 0.999, -1}
+	wavData := createFloatWAV(44100, 2, 32, samples)
+
+	tests := []struct {
+		clipping    string
+		wantClipped uint64
+		want        []int32
+	}{
+		// 1.5 and -2 clip; -1.0 is the most negative integer and does not
+		{services.ClippingClip, 2, []int32{16384, 32767, -32768, -8192, 32735, -32768}},
+		{services.ClippingNormalize, 0, []int32{8192, 24575, -32767, -4096, 16367, -16384}},
+	}
+	for _, tt := range tests {
+		bits, dither, clipping := 16, services.DitherNone, tt.clipping
+		converter, err := services.NewConverterWithOptions(services.Options{
+			Float: services.FloatOptions{BitsPerSample: &bits, Dither: &dither, Clipping: &clipping},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream := converter.NewStream()
+		head, err := stream.Write(wavData)
+		if err != nil {
+			t.Fatalf("%s: Write failed: %v", tt.clipping, err)
+		}
+		tail, err := stream.Close()
+		if err != nil {
+			t.Fatalf("%s: Close failed: %v", tt.clipping, err)
+		}
+
+		if got := stream.ClippedSamples(); got != tt.wantClipped {
+			t.Errorf("%s: ClippedSamples() = %d, want %d", tt.clipping, got, tt.wantClipped)
+		}
+		if format := stream.OutputFormat(); format.BitsPerSample != 16 || format.Float {
+			t.Errorf("%s: OutputFormat() = %+v", tt.clipping, format)
+		}
+		decoded := decodeFLAC(t, append(head, tail...))
+		for i := range tt.want {
+			if decoded[i] != tt.want[i] {
+				t.Errorf("%s: decoded %v, want %v", tt.clipping, decoded, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestStreamEncoder_RF64(t *testing.T) {
+	samples := make([]int32, 0, 6000*2)
+	for i := 0; i < 6000; i++ {
+		samples = append(samples, int32(i%3000-1500), int32((i*7)%2000-1000))
+	}
+	wavData := createWAV(44100, 2, 16, samples)
+	rf64 := toRF64(wavData, "RF64", int64(len(samples)*2))
+
+	stream := services.NewConverter().NewStream()
+	var out bytes.Buffer
+	for pos := 0; pos < len(rf64); pos += 4096 {
+		end := pos + 4096
+		if end > len(rf64) {
+			end = len(rf64)
+		}
+		flacData, err := stream.Write(rf64[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		out.Write(flacData)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+
+	fileData, err := services.NewConverter().ConvertChunk(rf64)
+	if err != nil {
+		t.Fatalf("ConvertChunk failed: %v", err)
+	}
+	for name, flacData := range map[string][]byte{"stream": out.Bytes(), "file": fileData} {
+		decoded := decodeFLAC(t, flacData)
+		if len(decoded) != len(samples) {
+			t.Fatalf("%s: decoded %d samples, want %d", name, len(decoded), len(samples))
+		}
+		for i := range samples {
+			if decoded[i] != samples[i] {
+				t.Fatalf("%s: sample %d differs: got %d, want %d", name, i, decoded[i], samples[i])
+			}
+		}
+	}
+}
+
+func TestStreamEncoder_UnknownDataSize(t *testing.T) {
+	samples := make([]int32, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		samples = append(samples, int32(i%4000-2000))
+	}
+	for _, size := range []uint32{0, 0xFFFFFFFF} {
+		// A live recorder's header: neither size is known yet
+		wavData := createWAV(16000, 1, 16, samples)
+		binary.LittleEndian.PutUint32(wavData[4:], size)
+		binary.LittleEndian.PutUint32(wavData[40:], size)
+
+		stream := services.NewConverter().NewStream()
+		var out bytes.Buffer
+		for pos := 0; pos < len(wavData); pos += 3000 {
+			end := pos + 3000
+			if end > len(wavData) {
+				end = len(wavData)
+			}
+			flacData, err := stream.Write(wavData[pos:end])
+			if err != nil {
+				t.Fatalf("size %#x: Write failed: %v", size, err)
+			}
+			out.Write(flacData)
+		}
+		tail, err := stream.Close()
+		if err != nil {
+			t.Fatalf("size %#x: Close failed: %v", size, err)
+		}
+		out.Write(tail)
+
+		if got := len(decodeFLAC(t, out.Bytes())); got != len(samples) {
+			t.Fatalf("size %#x: decoded %d samples, want %d", size, got, len(samples))
+		}
+		flacData := out.Bytes()
+		copy(flacData[8:], stream.StreamInfo())
+		parsed, err := flac.New(bytes.NewReader(flacData))
+		if err != nil {
+			t.Fatalf("size %#x: failed to parse FLAC stream: %v", size, err)
+		}
+		if parsed.Info.NSamples != uint64(len(samples)) {
+			t.Errorf("size %#x: STREAMINFO has %d samples, want %d", size, parsed.Info.NSamples, len(samples))
+		}
+
+		fileData, err := services.NewConverter().ConvertChunk(wavData)
+		if err != nil {
+			t.Fatalf("size %#x: ConvertChunk failed: %v", size, err)
+		}
+		if !bytes.Equal(fileData, flacData) {
+			t.Errorf("size %#x: ConvertChunk output differs from the finalized stream", size)
+		}
+	}
+}
+
+func TestStreamEncoder_KeepForeignTrailingChunks(t *testing.T) {
+	samples := make([]int32, 20000*2)
+	for i := range samples {
+		samples[i] = int32(i%2500 - 1250)
+	}
+	wavData := createWAV(44100, 2, 16, samples, riffChunk("bext", make([]byte, 602)))
+	wavData = append(wavData, riffChunk("LIST", infoList("INAM", "After the audio"))...)
+	binary.LittleEndian.PutUint32(wavData[4:], uint32(len(wavData)-8))
+
+	stream := keepForeignConverter(t).NewStream()
+	var out bytes.Buffer
+	for pos := 0; pos < len(wavData); pos += 1500 {
+		end := pos + 1500
+		if end > len(wavData) {
+			end = len(wavData)
+		}
+		flacData, err := stream.Write(wavData[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		out.Write(flacData)
+	}
+	sent := out.Len()
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+	streamed := out.Bytes()
+	offset, header := stream.HeaderPatch()
+	copy(streamed[offset:], header)
+	// Frames are sent as they are encoded, the chunks after the audio
+	// written into the metadata by the patch
+	if sent <= int(offset)+len(header) {
+		t.Errorf("Write returned %d bytes, no frames, before the stream was closed", sent)
+	}
+
+	restored, err := services.RestoreWAV(streamed)
+	if err != nil {
+		t.Fatalf("RestoreWAV() error = %v", err)
+	}
+	if !bytes.Equal(restored, wavData) {
+		t.Error("Restored file differs from the streamed input")
+	}
+	if title := flacTag(t, streamed, "TITLE"); title != "After the audio" {
+		t.Errorf("TITLE = %q, want %q", title, "After the audio")
+	}
+
+	if n := stream.DiscardedBytes(); n != 0 {
+		t.Errorf("DiscardedBytes() = %d for chunks that were kept", n)
+	}
+
+	// Bytes the RIFF size does not declare cannot be stored any more
+	undeclared := createWAV(44100, 2, 16, samples)
+	undeclared = append(undeclared, riffChunk("LIST", infoList("INAM", "Undeclared"))...)
+	stream = keepForeignConverter(t).NewStream()
+	if _, err := stream.Write(undeclared); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	_, err = stream.Close()
+	var convErr *models.ConversionError
+	if !errors.As(err, &convErr) || convErr.Code != models.ErrConversionFailed {
+		t.Errorf("Close() error = %v, want ErrConversionFailed", err)
+	}
+}
+
+func TestStreamEncoder_TrailingChunks(t *testing.T) {
+	// The padding of the odd-length data chunk is not counted
+	odd := createWAV(8000, 1, 8, make([]int32, 9999))
+	list := riffChunk("LIST", infoList("INAM", "After the audio"))
+	undeclared := append(append([]byte(nil), odd...), list...)
+	odd = append(odd, list...)
+	binary.LittleEndian.PutUint32(odd[4:], uint32(len(odd)-8))
+
+	tests := []struct {
+		name      string
+		converter *services.Converter
+		data      []byte
+		discarded int64
+	}{
+		{"declared", services.NewConverter(), odd, 0},
+		{"undeclared", services.NewConverter(), undeclared, int64(len(list))},
+		{"Ogg", oggConverter(t, services.Options{}), odd, int64(len(list))},
+	}
+	for _, tt := range tests {
+		stream := tt.converter.NewStream()
+		var out bytes.Buffer
+		for pos := 0; pos < len(tt.data); pos += 1000 {
+			data, err := stream.Write(tt.data[pos:min(pos+1000, len(tt.data))])
+			if err != nil {
+				t.Fatalf("%s: Write failed: %v", tt.name, err)
+			}
+			out.Write(data)
+		}
+		tail, err := stream.Close()
+		if err != nil {
+			t.Fatalf("%s: Close failed: %v", tt.name, err)
+		}
+		out.Write(tail)
+		if n := stream.Stats().DiscardedBytes; n != tt.discarded {
+			t.Errorf("%s: DiscardedBytes = %d, want %d", tt.name, n, tt.discarded)
+		}
+		if tt.name != "declared" {
+			continue
+		}
+		// The chunks after the audio are written into the reserved padding
+		streamed := out.Bytes()
+		offset, header := stream.HeaderPatch()
+		copy(streamed[offset:], header)
+		if title := flacTag(t, streamed, "TITLE"); title != "After the audio" {
+			t.Errorf("%s: TITLE = %q, want %q", tt.name, title, "After the audio")
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+)
+
+func TestConverter_Verify(t *testing.T) {
+	dir := t.TempDir()
+	floatSamples := make([]float64, 2*3000)
+	for i := range floatSamples {
+		floatSamples[i] = float64(i%300-150) / 200
+	}
+	tests := []struct {
+		name string
+		opts services.Options
+		wav  []byte
+	}{
+		{"16-bit", services.Options{}, createWAV(44100, 2, 16, toneSamples(10000, 2, 16))},
+		{"24-bit", services.Options{}, createWAV(96000, 1, 24, toneSamples(10000, 1, 24))},
+		{"32-bit", services.Options{}, createWAV(48000, 2, 32, toneSamples(5000, 2, 32))},
+		{"8-bit", services.Options{}, createWAV(8000, 1, 8, toneSamples(3000, 1, 8))},
+		{"float", services.Options{}, createFloatWAV(48000, 2, 32, floatSamples)},
+		{"Ogg", services.Options{Container: services.ContainerOgg}, createWAV(44100, 2, 16, toneSamples(10000, 2, 16))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain, err := services.NewConverterWithOptions(tt.opts)
+			if err != nil {
+				t.Fatalf("NewConverterWithOptions() error = %v", err)
+			}
+			opts := tt.opts
+			opts.Verify, opts.VerifyDir = true, dir
+			verified, err := services.NewConverterWithOptions(opts)
+			if err != nil {
+				t.Fatalf("NewConverterWithOptions() error = %v", err)
+			}
+
+			want, err := plain.ConvertChunk(tt.wav)
+			if err != nil {
+				t.Fatalf("ConvertChunk() error = %v", err)
+			}
+			got, err := verified.ConvertChunk(tt.wav)
+			if err != nil {
+				t.Fatalf("ConvertChunk() with verification error = %v", err)
+			}
+			// Ogg streams differ in their random serial numbers
+			if tt.opts.Container != services.ContainerOgg && !bytes.Equal(got, want) {
+				t.Error("Verification changed the encoded stream")
+			}
+		})
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Verification saved %d reports for matching frames", len(entries))
+	}
+
+	ffmpeg, err := services.NewConverterWithOptions(services.Options{Backend: services.BackendFFmpeg, Verify: true})
+	if err != nil {
+		t.Fatalf("NewConverterWithOptions() error = %v", err)
+	}
+	if _, err := ffmpeg.ConvertChunk(createTestWAVChunk(t)); err == nil {
+		t.Error("ffmpeg backend accepted frame verification")
+	}
+}
+
+// verifyReport holds the fields of a saved verification report.
+type verifyReport struct {
+	Frame         uint64    `json:"frame"`
+	FirstSample   uint64    `json:"firstSample"`
+	SampleRate    uint32    `json:"sampleRate"`
+	BitsPerSample uint8     `json:"bitsPerSample"`
+	Error         string    `json:"error"`
+	Channel       *int      `json:"channel"`
+	Sample        *int      `json:"sample"`
+	Expected      [][]int32 `json:"expected"`
+	Decoded       [][]int32 `json:"decoded"`
+	Data          []byte    `json:"data"`
+}
+
+// readReport returns the only report saved in dir.
+func readReport(t *testing.T, dir string) verifyReport {
+	t.Helper()
+	paths, _ := filepath.Glob(filepath.Join(dir, "flac-verify-*.json"))
+	if len(paths) != 1 {
+		t.Fatalf("Found %d reports, want 1", len(paths))
+	}
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var report verifyReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Invalid report: %v", err)
+	}
+	return report
+}
+
+// mislabeledFLAC returns a 24-bit FLAC stream whose STREAMINFO declares 16
+// bits. Its frames still decode to 24-bit samples, which do not survive being
+// encoded again at 16 bits.
+func mislabeledFLAC(t *testing.T) []byte {
+	t.Helper()
+	flacData, err := services.NewConverter().ConvertChunk(createWAV(44100, 1, 24, toneSamples(4096, 1, 24)))
+	if err != nil {
+		t.Fatalf("ConvertChunk() error = %v", err)
+	}
+	// Bits per sample minus one is split over bytes 12 and 13 of the
+	// STREAMINFO body: 23 becomes 15
+	flacData[8+12] &^= 0x01
+	flacData[8+13] |= 0xF0
+	return flacData
+}
+
+func TestConverter_VerifyFails(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		dir := t.TempDir()
+		c, err := services.NewConverterWithOptions(services.Options{Verify: true, VerifyDir: dir})
+		if err != nil {
+			t.Fatalf("NewConverterWithOptions() error = %v", err)
+		}
+		input := mislabeledFLAC(t)
+		if streamed {
+			stream := c.NewStream()
+			if _, err = stream.Write(input); err == nil {
+				_, err = stream.Close()
+			}
+		} else {
+			_, err = c.ConvertChunk(input)
+		}
+
+		var convErr *models.ConversionError
+		if !errors.As(err, &convErr) || convErr.Code != models.ErrConversionFailed {
+			t.Fatalf("streamed %v: error = %v, want %s", streamed, err, models.ErrConversionFailed)
+		}
+		if !strings.Contains(convErr.Message, "Verification failed at frame 0") || !strings.Contains(convErr.Message, dir) {
+			t.Errorf("streamed %v: error %q does not locate the frame and its report", streamed, convErr.Message)
+		}
+		report := readReport(t, dir)
+		if report.Frame != 0 || report.FirstSample != 0 || report.SampleRate != 44100 || report.BitsPerSample != 16 {
+			t.Errorf("streamed %v: report describes frame %d at sample %d, %d Hz, %d bits",
+				streamed, report.Frame, report.FirstSample, report.SampleRate, report.BitsPerSample)
+		}
+		if report.Error == "" || len(report.Data) == 0 || len(report.Expected) != 1 || len(report.Expected[0]) != 4096 {
+			t.Errorf("streamed %v: report has error %q, %d frame bytes and %d channels of input",
+				streamed, report.Error, len(report.Data), len(report.Expected))
+		}
+		if report.Channel != nil {
+			ch, i := *report.Channel, *report.Sample
+			if report.Expected[ch][i] == report.Decoded[ch][i] {
+				t.Errorf("streamed %v: report points at sample %d of channel %d, which matches", streamed, i, ch)
+			}
+		}
+	}
+}
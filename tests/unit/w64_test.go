@@ -0,0 +1,160 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"audio-converter/internal/models"
+	"audio-converter/internal/services"
+	"audio-converter/pkg/utils"
+)
+
+var (
+	w64RIFFSuffix = []byte{0x2E, 0x91, 0xCF, 0x11, 0xA5, 0xD6, 0x28, 0xDB, 0x04, 0xC1, 0x00, 0x00}
+	w64ListSuffix = []byte{0x2F, 0x91, 0xCF, 0x11, 0xA5, 0xD6, 0x28, 0xDB, 0x04, 0xC1, 0x00, 0x00}
+	w64WAVESuffix = []byte{0xF3, 0xAC, 0xD3, 0x11, 0x8C, 0xD1, 0x00, 0xC0, 0x4F, 0x8E, 0xDB, 0x8A}
+)
+
+func TestParseW64Header(t *testing.T) {
+	wav := createExtensibleWAV(48000, 6, 24, 20, 0x60F, make([]int32, 60))
+	w64 := toW64(wav)
+
+	want, _ := utils.ParseWAVHeader(wav)
+	header, err := utils.ParseHeader(w64)
+	if err != nil {
+		t.Fatalf("ParseHeader() error = %v", err)
+	}
+	if header.Form != "W64" || header.Format != want.Format || header.ContainerBits != 24 || header.ChannelMask != 0x60F {
+		t.Errorf("Got %s %+v in %d bits with mask %#x", header.Form, header.Format, header.ContainerBits, header.ChannelMask)
+	}
+	if header.DataSize != want.DataSize || !bytes.Equal(w64[header.DataOffset:header.DataOffset+int(header.DataSize)], wav[want.DataOffset:]) {
+		t.Errorf("Samples at %d with size %d do not match the WAV data", header.DataOffset, header.DataSize)
+	}
+
+	if _, err := utils.ParseHeader(w64[:60]); err != utils.ErrIncompleteHeader {
+		t.Errorf("ParseHeader() of a partial header error = %v, want ErrIncompleteHeader", err)
+	}
+	if _, err := utils.ParseHeader(w64[:10]); err != utils.ErrIncompleteHeader {
+		t.Errorf("ParseHeader() of a partial GUID error = %v, want ErrIncompleteHeader", err)
+	}
+}
+
+func TestParseW64Header_Errors(t *testing.T) {
+	w64 := toW64(createWAV(44100, 1, 16, make([]int32, 10)))
+
+	badForm := append([]byte(nil), w64...)
+	copy(badForm[24:28], "avi ")
+	badSize := append([]byte(nil), w64...)
+	binary.LittleEndian.PutUint64(badSize[56:64], 16)
+	badGUID := append([]byte(nil), w64...)
+	badGUID[5] ^= 0xFF
+
+	tests := []struct {
+		name string
+		data []byte
+		code string
+	}{
+		{"form type", badForm, models.ErrInvalidFormat},
+		{"chunk size", badSize, models.ErrInvalidChunkSize},
+		{"file GUID", badGUID, models.ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		_, err := utils.ParseHeader(tt.data)
+		var convErr *models.ConversionError
+		if !errors.As(err, &convErr) || convErr.Code != tt.code {
+			t.Errorf("%s: ParseHeader() error = %v, want %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+func TestConverter_W64(t *testing.T) {
+	samples := toneSamples(5000, 2, 24)
+	// The data chunk is followed by padding to the next 8-byte boundary
+	w64 := toW64(createWAV(96000, 2, 24, samples[:len(samples)-2], riffChunk("LIST", infoList("INAM", "Take 3"))))
+	w64 = append(w64, w64Chunk("list", w64ListSuffix, infoList("IART", "Ensemble"))...)
+	binary.LittleEndian.PutUint64(w64[16:24], uint64(len(w64)))
+
+	flacData, err := services.NewConverter().ConvertChunk(w64)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	got := decodeFLAC(t, flacData)
+	if len(got) != len(samples)-2 {
+		t.Fatalf("Decoded %d samples, want %d", len(got), len(samples)-2)
+	}
+	for i := range got {
+		if got[i] != samples[i] {
+			t.Fatalf("Sample %d = %d, want %d", i, got[i], samples[i])
+		}
+	}
+	if title := flacTag(t, flacData, "TITLE"); title != "Take 3" {
+		t.Errorf("TITLE = %q, want %q", title, "Take 3")
+	}
+	if artist := flacTag(t, flacData, "ARTIST"); artist != "Ensemble" {
+		t.Errorf("ARTIST = %q, want %q", artist, "Ensemble")
+	}
+
+	// A stream yields the same audio
+	stream := services.NewConverter().NewStream()
+	var out bytes.Buffer
+	for pos := 0; pos < len(w64); pos += 999 {
+		end := pos + 999
+		if end > len(w64) {
+			end = len(w64)
+		}
+		data, err := stream.Write(w64[pos:end])
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		out.Write(data)
+	}
+	tail, err := stream.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	out.Write(tail)
+	if streamed := decodeFLAC(t, out.Bytes()); len(streamed) != len(got) {
+		t.Errorf("Stream decoded %d samples, want %d", len(streamed), len(got))
+	}
+
+	if _, err := keepForeignConverter(t).ConvertChunk(w64); err == nil {
+		t.Error("ConvertChunk() kept foreign metadata of a Wave64 file")
+	}
+}
+
+// toW64 rewraps the chunks of a RIFF WAV file as a Wave64 file.
+func toW64(wav []byte) []byte {
+	body := new(bytes.Buffer)
+	for pos := 12; pos+8 <= len(wav); {
+		id := string(wav[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(wav[pos+4 : pos+8]))
+		data := wav[pos+8 : pos+8+size]
+		if id == "LIST" {
+			body.Write(w64Chunk("list", w64ListSuffix, data))
+		} else {
+			body.Write(w64Chunk(id, w64WAVESuffix, data))
+		}
+		pos += 8 + size + size&1
+	}
+	buf := bytes.NewBufferString("riff")
+	buf.Write(w64RIFFSuffix)
+	binary.Write(buf, binary.LittleEndian, uint64(40+body.Len()))
+	buf.WriteString("wave")
+	buf.Write(w64WAVESuffix)
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+// w64Chunk builds a Wave64 chunk padded to a multiple of 8 bytes.
+func w64Chunk(id string, suffix, data []byte) []byte {
+	buf := bytes.NewBufferString(id)
+	buf.Write(suffix)
+	binary.Write(buf, binary.LittleEndian, uint64(24+len(data)))
+	buf.Write(data)
+	for buf.Len()%8 != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,391 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"audio-converter/internal/services"
+	"audio-converter/pkg/utils"
+)
+
+func TestParseWAVHeader_SkipsChunksBeforeData(t *testing.T) {
+	wavData := createWAV(48000, 3, 24, make([]int32, 30), riffChunk("LIST", []byte("INFOISFT\x04\x00\x00\x00test")))
+
+	header, err := utils.ParseWAVHeader(wavData)
+	if err != nil {
+		t.Fatalf("ParseWAVHeader() error = %v", err)
+	}
+	if header.Format.SampleRate != 48000 || header.Format.NumChannels != 3 || header.Format.BitsPerSample != 24 {
+		t.Errorf("Unexpected format %+v", header.Format)
+	}
+	if header.BlockAlign != 9 {
+		t.Errorf("BlockAlign = %d, want 9", header.BlockAlign)
+	}
+	if header.DataSize != 90 || string(wavData[header.DataOffset-8:header.DataOffset-4]) != "data" {
+		t.Errorf("Data chunk at %d with size %d is wrong", header.DataOffset, header.DataSize)
+	}
+}
+
+func TestParseWAVHeader_LargeChunkBeforeData(t *testing.T) {
+	// Artwork larger than the header limit is skipped; the tags after it
+	// are still read
+	samples := toneSamples(1000, 2, 16)
+	wavData := createWAV(44100, 2, 16, samples,
+		riffChunk("PIC ", make([]byte, 3<<20)),
+		riffChunk("LIST", infoList("INAM", "After the artwork")))
+
+	header, err := utils.ParseWAVHeader(wavData)
+	if err != nil {
+		t.Fatalf("ParseWAVHeader() error = %v", err)
+	}
+	if len(header.Chunks) != 1 || header.Chunks[0].ID != "LIST" {
+		t.Errorf("Kept %d chunks, want only the LIST chunk", len(header.Chunks))
+	}
+	if _, err := utils.ParseWAVHeader(wavData[:2<<20]); err != utils.ErrIncompleteHeader {
+		t.Errorf("ParseWAVHeader() inside the artwork error = %v, want ErrIncompleteHeader", err)
+	}
+
+	flacData, err := services.NewConverter().ConvertChunk(wavData)
+	if err != nil {
+		t.Fatalf("Failed to convert: %v", err)
+	}
+	if got := flacTag(t, flacData, "TITLE"); got != "After the artwork" {
+		t.Errorf("TITLE = %q, want %q", got, "After the artwork")
+	}
+	if got := decodeFLAC(t, flacData); len(got) != len(samples) {
+		t.Errorf("Decoded %d samples, want %d", len(got), len(samples))
+	}
+}
+
+func TestParseWAVHeader_Incomplete(t *testing.T) {
+	wavData := createWAV(44100, 2, 16, make([]int32, 4))
+	for _, n := range []int{0, 11, 20, 40} {
+		if _, err := utils.ParseWAVHeader(wavData[:n]); err != utils.ErrIncompleteHeader {
+			t.Errorf("ParseWAVHeader(%d bytes) error = %v, want ErrIncompleteHeader", n, err)
+		}
+	}
+}
+
+func TestParseWAVHeader_Extensible(t *testing.T) {
+	wavData := createExtensibleWAV(48000, 6, 24, 20, 0x60F, make([]int32, 12))
+
+	header, err := utils.ParseWAVHeader(wavData)
+	if err != nil {
+		t.Fatalf("ParseWAVHeader() error = %v", err)
+	}
+	if !header.Extensible || header.FormatTag != utils.WAVFormatPCM {
+		t.Errorf("Extensible = %v, FormatTag = %#x", header.Extensible, header.FormatTag)
+	}
+	if header.Format.BitsPerSample != 20 || header.ContainerBits != 24 {
+		t.Errorf("BitsPerSample = %d, ContainerBits = %d, want 20 and 24", header.Format.BitsPerSample, header.ContainerBits)
+	}
+	if header.ChannelMask != 0x60F {
+		t.Errorf("ChannelMask = %#x, want 0x60f", header.ChannelMask)
+	}
+}
+
+func TestParseWAVHeader_ExtensibleRejectsUnknownSubFormat(t *testing.T) {
+	wavData := createExtensibleWAV(48000, 2, 16, 16, 0x3, make([]int32, 2))
+	// Corrupt the GUID suffix shared by the KSDATAFORMAT_SUBTYPE_* formats
+	wavData[20+24+4] ^= 0xFF
+
+	if _, err := utils.ParseWAVHeader(wavData); err == nil {
+		t.Error("ParseWAVHeader() accepted an unknown sub-format")
+	}
+}
+
+func TestParseWAVHeader_RF64(t *testing.T) {
+	const dataSize = 5 << 30
+	for _, form := range []string{"RF64", "BW64"} {
+		t.Run(form, func(t *testing.T) {
+			// Only the header is present; a 5 GiB data chunk cannot be
+			// described by a 32-bit RIFF size
+			wavData := toRF64(createWAV(48000, 2, 24, make([]int32, 2)), form, dataSize)
+
+			header, err := utils.ParseWAVHeader(wavData)
+			if err != nil {
+				t.Fatalf("ParseWAVHeader() error = %v", err)
+			}
+			if header.Form != form {
+				t.Errorf("Form = %q, want %q", header.Form, form)
+			}
+			if header.DataSize != dataSize {
+				t.Errorf("DataSize = %d, want %d", header.DataSize, int64(dataSize))
+			}
+			if string(wavData[header.DataOffset-8:header.DataOffset-4]) != "data" {
+				t.Errorf("DataOffset %d does not follow the data chunk header", header.DataOffset)
+			}
+		})
+	}
+}
+
+func TestParseWAVHeader_RF64RequiresDS64(t *testing.T) {
+	wavData := createWAV(44100, 2, 16, make([]int32, 4))
+	copy(wavData, "RF64")
+
+	if _, err := utils.ParseWAVHeader(wavData); err == nil {
+		t.Error("ParseWAVHeader() accepted an RF64 file without a ds64 chunk")
+	}
+}
+
+func TestParseWAVHeader_UnknownDataSize(t *testing.T) {
+	for _, size := range []uint32{0, 0xFFFFFFFF} {
+		wavData := createWAV(44100, 2, 16, make([]int32, 4))
+		binary.LittleEndian.PutUint32(wavData[4:], size)
+		binary.LittleEndian.PutUint32(wavData[40:], size)
+
+		header, err := utils.ParseWAVHeader(wavData)
+		if err != nil {
+			t.Fatalf("ParseWAVHeader(size %#x) error = %v", size, err)
+		}
+		if header.DataSize != utils.UnknownDataSize {
+			t.Errorf("ParseWAVHeader(size %#x) DataSize = %d, want UnknownDataSize", size, header.DataSize)
+		}
+	}
+}
+
+func TestParseWAVHeader_EmptyDataChunk(t *testing.T) {
+	wavData := createWAV(44100, 2, 16, nil)
+	wavData = append(wavData, riffChunk("LIST", infoList("INAM", "Silence"))...)
+	binary.LittleEndian.PutUint32(wavData[4:], uint32(len(wavData)-8))
+
+	header, err := utils.ParseWAVHeader(wavData)
+	if err != nil {
+		t.Fatalf("ParseWAVHeader() error = %v", err)
+	}
+	if header.DataSize != 0 {
+		t.Fatalf("DataSize = %d, want 0", header.DataSize)
+	}
+
+	flacData, err := services.NewConverter().ConvertChunk(wavData)
+	if err != nil {
+		t.Fatalf("ConvertChunk() error = %v", err)
+	}
+	if got := decodeFLAC(t, flacData); len(got) != 0 {
+		t.Errorf("Decoded %d samples from an empty data chunk", len(got))
+	}
+	if title := flacTag(t, flacData, "TITLE"); title != "Silence" {
+		t.Errorf("TITLE = %q, want %q", title, "Silence")
+	}
+}
+
+func TestIsFLACChannelLayout(t *testing.T) {
+	tests := []struct {
+		mask     uint32
+		channels int
+		want     bool
+	}{
+		{0, 6, true},
+		{0x3, 2, true},
+		{0x3F, 6, true},
+		{0x60F, 6, true},
+		{0x63F, 8, true},
+		{0x30, 2, false},
+		{0xFF, 8, false},
+		{0x3F, 8, false},
+	}
+	for _, tt := range tests {
+		if got := utils.IsFLACChannelLayout(tt.mask, tt.channels); got != tt.want {
+			t.Errorf("IsFLACChannelLayout(%#x, %d) = %v, want %v", tt.mask, tt.channels, got, tt.want)
+		}
+	}
+}
+
+func TestDecodePCM(t *testing.T) {
+	tests := []struct {
+		name                     string
+		containerBits, validBits int
+		data                     []byte
+		want                     []int
+	}{
+		{"8-bit unsigned", 8, 8, []byte{0x00, 0x80, 0xFF}, []int{-128, 0, 127}},
+		{"16-bit", 16, 16, []byte{0x00, 0x80, 0xFF, 0x7F}, []int{-32768, 32767}},
+		{"24-bit packed", 24, 24, []byte{0x00, 0x00, 0x80, 0x01, 0x00, 0x00, 0xFF, 0xFF, 0xFF}, []int{-8388608, 1, -1}},
+		{"20-bit in 24", 24, 20, []byte{0xF0, 0xFF, 0x7F, 0x10, 0x00, 0x00}, []int{524287, 1}},
+		{"24-bit in 32", 32, 24, []byte{0x00, 0x00, 0x00, 0x80, 0x00, 0xFF, 0xFF, 0xFF}, []int{-8388608, -1}},
+		{"32-bit", 32, 32, []byte{0x00, 0x00, 0x00, 0x80, 0xFF, 0xFF, 0xFF, 0x7F}, []int{-2147483648, 2147483647}},
+	}
+	for _, tt := range tests {
+		got, err := utils.DecodePCM(tt.data, tt.containerBits, tt.validBits)
+		if err != nil {
+			t.Errorf("%s: DecodePCM() error = %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: DecodePCM() = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: DecodePCM() = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseWAVHeader_Float(t *testing.T) {
+	for _, bits := range []int{32, 64} {
+		header, err := utils.ParseWAVHeader(createFloatWAV(48000, 2, bits, make([]float64, 4)))
+		if err != nil {
+			t.Fatalf("%d-bit: ParseWAVHeader() error = %v", bits, err)
+		}
+		if header.FormatTag != utils.WAVFormatIEEEFloat || !header.Format.Float || header.Format.BitsPerSample != bits {
+			t.Errorf("%d-bit: unexpected header %+v", bits, header)
+		}
+	}
+
+	wavData := createFloatWAV(48000, 2, 32, make([]float64, 4))
+	// Declare 24-bit floats, which do not exist
+	binary.LittleEndian.PutUint16(wavData[20+14:], 24)
+	binary.LittleEndian.PutUint16(wavData[20+12:], 6)
+	if _, err := utils.ParseWAVHeader(wavData); err == nil {
+		t.Error("ParseWAVHeader() accepted 24-bit floating-point samples")
+	}
+}
+
+func TestDecodeFloatPCM(t *testing.T) {
+	want := []float64{-1, 0.5, 0, 0.25}
+	for _, bits := range []int{32, 64} {
+		wavData := createFloatWAV(44100, 1, bits, want)
+		header, err := utils.ParseWAVHeader(wavData)
+		if err != nil {
+			t.Fatalf("ParseWAVHeader() error = %v", err)
+		}
+		got, err := utils.DecodeFloatPCM(wavData[header.DataOffset:], bits)
+		if err != nil {
+			t.Fatalf("%d-bit: DecodeFloatPCM() error = %v", bits, err)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%d-bit: DecodeFloatPCM() = %v, want %v", bits, got, want)
+				break
+			}
+		}
+	}
+}
+
+// createWAV builds a PCM WAV file with the given interleaved samples. Extra
+// chunks are placed between the fmt and data chunks.
+func createWAV(sampleRate, channels, bitsPerSample int, samples []int32, extra ...[]byte) []byte {
+	width := (bitsPerSample + 7) / 8
+	fmtChunk := new(bytes.Buffer)
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(1))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(channels))
+	binary.Write(fmtChunk, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(fmtChunk, binary.LittleEndian, uint32(sampleRate*channels*width))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(channels*width))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(bitsPerSample))
+	return buildWAV(fmtChunk.Bytes(), encodePCM(width, bitsPerSample, samples), extra...)
+}
+
+// createExtensibleWAV builds a WAVE_FORMAT_EXTENSIBLE PCM file with validBits
+// significant bits in each containerBits-bit sample.
+func createExtensibleWAV(sampleRate, channels, containerBits, validBits int, mask uint32, samples []int32) []byte {
+	width := containerBits / 8
+	fmtChunk := new(bytes.Buffer)
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(0xFFFE))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(channels))
+	binary.Write(fmtChunk, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(fmtChunk, binary.LittleEndian, uint32(sampleRate*channels*width))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(channels*width))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(containerBits))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(22))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(validBits))
+	binary.Write(fmtChunk, binary.LittleEndian, mask)
+	// KSDATAFORMAT_SUBTYPE_PCM
+	fmtChunk.Write([]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71})
+	return buildWAV(fmtChunk.Bytes(), encodePCM(width, validBits, samples))
+}
+
+// createFloatWAV builds an IEEE floating-point WAV file of 32- or 64-bit
+// samples.
+func createFloatWAV(sampleRate, channels, bitsPerSample int, samples []float64) []byte {
+	width := bitsPerSample / 8
+	fmtChunk := new(bytes.Buffer)
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(3))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(channels))
+	binary.Write(fmtChunk, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(fmtChunk, binary.LittleEndian, uint32(sampleRate*channels*width))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(channels*width))
+	binary.Write(fmtChunk, binary.LittleEndian, uint16(bitsPerSample))
+
+	data := new(bytes.Buffer)
+	for _, s := range samples {
+		if bitsPerSample == 32 {
+			binary.Write(data, binary.LittleEndian, float32(s))
+		} else {
+			binary.Write(data, binary.LittleEndian, s)
+		}
+	}
+	return buildWAV(fmtChunk.Bytes(), data.Bytes())
+}
+
+// encodePCM left-justifies each sample in a width-byte little-endian
+// container. 8-bit samples are stored unsigned, as WAV requires.
+func encodePCM(width, bitsPerSample int, samples []int32) []byte {
+	data := new(bytes.Buffer)
+	for _, s := range samples {
+		v := uint32(s) << uint(width*8-bitsPerSample)
+		if width == 1 {
+			v += 0x80
+		}
+		for b := 0; b < width; b++ {
+			data.WriteByte(byte(v >> (8 * b)))
+		}
+	}
+	return data.Bytes()
+}
+
+// buildWAV wraps a fmt chunk body, extra chunks and sample data in a RIFF
+// file.
+func buildWAV(fmtChunk, data []byte, extra ...[]byte) []byte {
+	body := new(bytes.Buffer)
+	body.WriteString("WAVE")
+	body.Write(riffChunk("fmt ", fmtChunk))
+	for _, chunk := range extra {
+		body.Write(chunk)
+	}
+	body.Write(riffChunk("data", data))
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(body.Len()))
+	buf.Write(body.Bytes())
+	return buf.Bytes()
+}
+
+// toRF64 rewrites a RIFF file built by buildWAV as an RF64 or BW64 file whose
+// RIFF and data sizes are in a ds64 chunk, declaring dataSize bytes of audio.
+func toRF64(wavData []byte, form string, dataSize int64) []byte {
+	ds64 := new(bytes.Buffer)
+	binary.Write(ds64, binary.LittleEndian, uint64(int64(len(wavData))+36-8))
+	binary.Write(ds64, binary.LittleEndian, uint64(dataSize))
+	binary.Write(ds64, binary.LittleEndian, uint64(0))
+	binary.Write(ds64, binary.LittleEndian, uint32(0))
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(form)
+	binary.Write(buf, binary.LittleEndian, uint32(0xFFFFFFFF))
+	buf.WriteString("WAVE")
+	buf.Write(riffChunk("ds64", ds64.Bytes()))
+	buf.Write(wavData[12:])
+
+	// Replace the 32-bit data size with the RF64 placeholder
+	out := buf.Bytes()
+	pos := bytes.Index(out, []byte("data"))
+	binary.LittleEndian.PutUint32(out[pos+4:], 0xFFFFFFFF)
+	return out
+}
+
+func riffChunk(id string, body []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(id)
+	binary.Write(buf, binary.LittleEndian, uint32(len(body)))
+	buf.Write(body)
+	if len(body)%2 == 1 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}